@@ -3,6 +3,7 @@ package actions
 import (
 	"fmt"
 	"sort"
+	"time"
 
 	"github.com/nest-egg/ami-replacer/apis"
 
@@ -11,41 +12,28 @@ import (
 	"github.com/aws/aws-sdk-go/service/ec2"
 
 	"github.com/nest-egg/ami-replacer/config"
+	"github.com/nest-egg/ami-replacer/log"
 	"golang.org/x/xerrors"
 )
 
-//Ami extracts imageID of current ASG from Launch Template.
+//Ami returns the image an instance was launched from. The launch template of the asg
+//is not resolved again, as $Default and $Latest move to the newest AMI once rpl updates it.
 func (r *Replacer) Ami(id string) (string, error) {
 
-	params := &autoscaling.DescribeAutoScalingInstancesInput{
-		InstanceIds: []*string{
-			aws.String(id),
-		},
-	}
-	output, err := r.asg.AsgAPI.DescribeAutoScalingInstances(params)
-	if err != nil {
-		return "", xerrors.Errorf("Failed to describe asg instances: %w", err)
-	}
-
-	inst := output.AutoScalingInstances[0]
-	if inst.LaunchTemplate == nil {
-		return "", fmt.Errorf("AutoScaling Group is missing Instances: %+v", *inst)
-	}
-
-	templateID := inst.LaunchTemplate.LaunchTemplateId
-	ver := inst.LaunchTemplate.Version
-	latest, err := r.asg.Ec2Api.DescribeLaunchTemplateVersions(&ec2.DescribeLaunchTemplateVersionsInput{
-		LaunchTemplateId: aws.String(*templateID),
-		Versions: []*string{
-			aws.String(*ver),
-		},
+	output, err := r.asg.Ec2Api.DescribeInstances(&ec2.DescribeInstancesInput{
+		InstanceIds: aws.StringSlice([]string{id}),
 	})
 	if err != nil {
-		return "", xerrors.Errorf("Failed to describe launch templates: %w", err)
+		return "", xerrors.Errorf("Failed to describe instances: %w", err)
 	}
-
-	amiid := *latest.LaunchTemplateVersions[0].LaunchTemplateData.ImageId
-	return amiid, nil
+	for _, res := range output.Reservations {
+		for _, inst := range res.Instances {
+			if aws.StringValue(inst.InstanceId) == id {
+				return aws.StringValue(inst.ImageId), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("Instance %s not found", id)
 }
 
 func (r *Replacer) asgInfo(asgname string) (grp []*autoscaling.Group, err error) {
@@ -80,43 +68,244 @@ func (r *Replacer) asgInfo(asgname string) (grp []*autoscaling.Group, err error)
 	return results, nil
 }
 
-func (r *Replacer) deregisterAMI(c *config.Config) (*ec2.DeregisterImageOutput, error) {
-	gen := c.Generation
+// outdatedAMIs returns the outdated images of every lineage
+// along with the lineages the images were grouped into.
+func (r *Replacer) outdatedAMIs(c *config.Config) ([]*ec2.Image, []*lineage, error) {
+	filters, err := imageFilters(c)
+	if err != nil {
+		return nil, nil, err
+	}
 	params := &ec2.DescribeImagesInput{
-		Owners: []*string{aws.String(c.Owner)},
-		Filters: []*ec2.Filter{{
-			Name:   aws.String("name"),
-			Values: []*string{aws.String(c.Image)},
-		}}}
+		Owners:  []*string{aws.String(c.Owner)},
+		Filters: filters,
+	}
 	i, err := r.asg.Ec2Api.DescribeImages(params)
 	if err != nil {
-		return nil, xerrors.Errorf("Failed to describe images: %w", err)
+		return nil, nil, xerrors.Errorf("Failed to describe images: %w", err)
 	}
 
 	sort.Sort(apis.ImageSlice(i.Images))
-	len := apis.ImageSlice(i.Images).Len()
-	if len <= gen {
-		return nil, xerrors.New("No outdated images")
-	}
-	images := make([]map[string]interface{}, 0, len)
-	for j := gen - 1; j < len; j++ {
-
-		if false {
-			m := map[string]interface{}{
-				"Name":         i.Images[j].Name,
-				"CreationDate": i.Images[j].CreationDate,
-				"ImageId":      i.Images[j].ImageId,
+	groups, err := groupLineages(i.Images, c)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	var result []*ec2.Image
+	for _, g := range groups {
+		result = append(result, outdated(g.images, c, now)...)
+	}
+	return result, groups, nil
+}
+
+// imageFilters selects images by the name wildcard of c.Image and every tag of c.Tags.
+func imageFilters(c *config.Config) ([]*ec2.Filter, error) {
+	tags, err := config.ParseTagFilters(c.Tags)
+	if err != nil {
+		return nil, xerrors.Errorf("Invalid image tag: %w", err)
+	}
+	filters := []*ec2.Filter{{
+		Name:   aws.String("name"),
+		Values: []*string{aws.String(c.Image)},
+	}}
+	for _, tag := range tags {
+		if tag.AnyValue {
+			filters = append(filters, &ec2.Filter{
+				Name:   aws.String("tag-key"),
+				Values: []*string{aws.String(tag.Key)},
+			})
+			continue
+		}
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String("tag:" + tag.Key),
+			Values: []*string{aws.String(tag.Value)},
+		})
+	}
+	return filters, nil
+}
+
+// outdated applies the retention policy of c to images sorted newest first.
+// Images older than MaxAge are always outdated. Otherwise the newest
+// Generation-1 images, or every image while there are no more than Generation,
+// and every image younger than KeepDays are retained.
+func outdated(images []*ec2.Image, c *config.Config, now time.Time) []*ec2.Image {
+	gen := c.Generation - 1
+	if len(images) <= c.Generation {
+		gen = len(images)
+	}
+	keep := time.Duration(c.KeepDays) * 24 * time.Hour
+	var result []*ec2.Image
+	for j, image := range images {
+		age := now.Sub(apis.CreationTime(image))
+		switch {
+		case c.MaxAge > 0 && age > c.MaxAge:
+		case j < gen:
+			continue
+		case c.KeepDays > 0 && age < keep:
+			continue
+		}
+		result = append(result, image)
+	}
+	return result
+}
+
+// amisToDeregister returns outdated AMIs no resource references,
+// the outdated AMIs skipped because they are pinned or still in use,
+// and the lineages the AMIs were grouped into.
+func (r *Replacer) amisToDeregister(c *config.Config) ([]*ec2.Image, []SkippedImage, []*lineage, error) {
+	images, groups, err := r.outdatedAMIs(c)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(images) == 0 {
+		log.Logger.Infof("No outdated images of %s", c.Image)
+		return nil, nil, groups, nil
+	}
+	images, skipped, err := r.excludeKept(c, images)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return images, skipped, groups, nil
+}
+
+// excludeKept splits outdated images into images to deregister
+// and images pinned by c.KeepTag, still in use or shared.
+func (r *Replacer) excludeKept(c *config.Config, images []*ec2.Image) ([]*ec2.Image, []SkippedImage, error) {
+	images, pinned, err := excludePinned(c, images)
+	if err != nil {
+		return nil, nil, err
+	}
+	images, unsafe, err := r.excludeUnsafe(c, images)
+	if err != nil {
+		return nil, nil, err
+	}
+	return images, append(pinned, unsafe...), nil
+}
+
+// excludeUnsafe skips images deregistering would break:
+// images still in use, and images shared unless c.ForceUnshare is set.
+func (r *Replacer) excludeUnsafe(c *config.Config, images []*ec2.Image) ([]*ec2.Image, []SkippedImage, error) {
+	images, inuse, err := r.excludeInUse(images)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("Failed to exclude images in use: %w", err)
+	}
+	images, shared, err := r.excludeShared(c, images)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("Failed to exclude shared images: %w", err)
+	}
+	return images, append(inuse, shared...), nil
+}
+
+// excludePinned skips images having the c.KeepTag tag.
+// Pinned images still count as a generation.
+func excludePinned(c *config.Config, images []*ec2.Image) ([]*ec2.Image, []SkippedImage, error) {
+	if c.KeepTag == "" {
+		return images, nil, nil
+	}
+	keep, err := config.ParseTagFilter(c.KeepTag)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("Invalid keep tag: %w", err)
+	}
+	var free []*ec2.Image
+	var skipped []SkippedImage
+	for _, image := range images {
+		if !keep.Match(imageTags(image)) {
+			free = append(free, image)
+			continue
+		}
+		id := aws.StringValue(image.ImageId)
+		log.Logger.Infof("Skip image %s pinned by tag %s", id, keep)
+		skipped = append(skipped, SkippedImage{
+			ImageID: id,
+			Name:    aws.StringValue(image.Name),
+			Reason:  "pinned by tag " + keep.String(),
+		})
+	}
+	return free, skipped, nil
+}
+
+func imageTags(image *ec2.Image) map[string]string {
+	tags := make(map[string]string, len(image.Tags))
+	for _, t := range image.Tags {
+		tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	return tags
+}
+
+func (r *Replacer) deregisterAMI(c *config.Config) (*ec2.DeregisterImageOutput, error) {
+	if len(c.Regions) != 0 {
+		return nil, r.deregisterAcrossRegions(c)
+	}
+	if c.Retire {
+		return nil, r.retireAMIs(c)
+	}
+	images, skipped, groups, err := r.amisToDeregister(c)
+	if err != nil {
+		return nil, err
+	}
+	r.result.SkippedImages = append(r.result.SkippedImages, skipped...)
+	if err := r.deregisterImages(c, images); err != nil {
+		return nil, err
+	}
+	r.recordLineages(summarizeLineages(groups, c, images))
+	return nil, nil
+}
+
+// deregisterImages deregisters images, and deletes their snapshots with c.DeleteSnapshots.
+func (r *Replacer) deregisterImages(c *config.Config, images []*ec2.Image) error {
+	for _, image := range images {
+		imageid := image.ImageId
+		// read the snapshots before the image and its mappings are gone
+		snapshots := imageSnapshots(image)
+		summary := summarizeImage(image)
+		if c.ForceUnshare {
+			accounts, err := r.unshare(*imageid)
+			if err != nil {
+				return err
 			}
-			images = append(images, m)
+			summary.Unshared = accounts
 		}
-		imageid := i.Images[j].ImageId
 		_, err := r.asg.Ec2Api.DeregisterImage(&ec2.DeregisterImageInput{
-			DryRun:  aws.Bool(dryrun),
+			DryRun:  aws.Bool(r.dryrun),
 			ImageId: aws.String(*imageid),
 		})
 		if err != nil {
-			return nil, xerrors.Errorf("Failed to deregister image: %w", err)
+			return xerrors.Errorf("Failed to deregister image: %w", err)
+		}
+		r.result.Images = append(r.result.Images, summary)
+		if c.DeleteSnapshots {
+			if err := r.deleteImageSnapshots(*imageid, snapshots); err != nil {
+				return err
+			}
 		}
 	}
-	return nil, nil
+	return nil
+}
+
+func (r *Replacer) recordLineages(lineages []LineageSummary) {
+	r.result.Lineages = lineages
+	for _, l := range lineages {
+		log.Logger.Infof("Lineage %q: retained %d, deleted %d images", l.Lineage, l.Retained, l.Deleted)
+	}
+}
+
+// deleteImageSnapshots deletes the snapshots of a deregistered image
+// unless another image or a volume still uses them.
+func (r *Replacer) deleteImageSnapshots(imageid string, snapshots []*ec2.EbsBlockDevice) error {
+	for _, ebs := range snapshots {
+		id := aws.StringValue(ebs.SnapshotId)
+		inuse, err := r.snapshotInUse(id, imageid)
+		if err != nil {
+			return err
+		}
+		if inuse {
+			log.Logger.Infof("Keep snapshot %s of image %s still in use", id, imageid)
+			continue
+		}
+		if _, err := r.deleteSnapshot(id); err != nil {
+			return err
+		}
+		log.Logger.Infof("Deleted snapshot %s of image %s", id, imageid)
+		r.result.Snapshots = append(r.result.Snapshots, summarizeImageSnapshot(imageid, ebs))
+	}
+	return nil
 }
@@ -1,8 +1,15 @@
 package actions
 
 import (
+	"bytes"
 	"context"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
 
 	"github.com/nest-egg/ami-replacer/config"
 )
@@ -67,18 +74,13 @@ func TestAMI_Ami(t *testing.T) {
 			instanceid: "ok",
 		},
 		{
-			name:       "exec error_DescribeAutoScalingInstances",
+			name:       "exec error_DescribeInstances",
 			instanceid: "exec_error",
 			shouldErr:  true,
 		},
 		{
-			name:       "no_launch_template",
-			instanceid: "no_launch_template",
-			shouldErr:  true,
-		},
-		{
-			name:       "exec_error_DescribeLaunchTemplateVersions",
-			instanceid: "exec_error_2",
+			name:       "not_found",
+			instanceid: "not_found",
 			shouldErr:  true,
 		},
 	}
@@ -159,3 +161,245 @@ func TestAMI_deregisterAmi(t *testing.T) {
 
 	}
 }
+
+func TestAMI_RemoveAMIsResult(t *testing.T) {
+	region := "ap-northeast-1"
+	profile := "admin"
+	mockreplacer := NewMockReplacer(
+		context.Background(),
+		region,
+		profile,
+	)
+	res := &Result{Target: "ok"}
+	mockreplacer.Record(res)
+	conf := &config.Config{
+		Image:      "testimage*",
+		Owner:      "owner",
+		Generation: 2,
+	}
+	if err := mockreplacer.RemoveAMIs(conf); err != nil {
+		t.Fatalf("got: %v\nwant: %v", err, nil)
+	}
+	if len(res.Images) != 1 {
+		t.Errorf("got: %d deregistered images\nwant: %d", len(res.Images), 1)
+	}
+	var buf bytes.Buffer
+	if err := (Results{res}).WriteTable(&buf); err != nil || !strings.Contains(buf.String(), "ami-00000000000000003") {
+		t.Errorf("failed to render result: %v\n%s", err, buf.String())
+	}
+}
+
+func TestAMI_RemoveAMIsDeleteSnapshots(t *testing.T) {
+	region := "ap-northeast-1"
+	profile := "admin"
+	tests := []struct {
+		name            string
+		deleteSnapshots bool
+		want            []string
+	}{
+		{"keep snapshots", false, nil},
+		{"delete unused snapshots", true, []string{"snap-free"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockreplacer := NewMockReplacer(
+				context.Background(),
+				region,
+				profile,
+			)
+			res := &Result{Target: tt.name}
+			mockreplacer.Record(res)
+			conf := &config.Config{
+				Image:           "testimage*",
+				Owner:           "owner",
+				Generation:      2,
+				DeleteSnapshots: tt.deleteSnapshots,
+			}
+			if err := mockreplacer.RemoveAMIs(conf); err != nil {
+				t.Fatalf("got: %v\nwant: %v", err, nil)
+			}
+			var got []string
+			for _, snapshot := range res.Snapshots {
+				got = append(got, snapshot.SnapshotID)
+				if snapshot.ImageID != "ami-00000000000000003" {
+					t.Errorf("got: snapshot of %s\nwant: %s", snapshot.ImageID, "ami-00000000000000003")
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got: %v\nwant: %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAMI_outdated(t *testing.T) {
+	now := time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC)
+	image := func(id string, daysAgo int) *ec2.Image {
+		return &ec2.Image{
+			ImageId:      aws.String(id),
+			CreationDate: aws.String(now.AddDate(0, 0, -daysAgo).Format("2006-01-02T15:04:05.000Z")),
+		}
+	}
+	images := []*ec2.Image{
+		image("ami-1", 1),
+		image("ami-10", 10),
+		image("ami-40", 40),
+		image("ami-100", 100),
+	}
+	testCases := []struct {
+		name     string
+		gen      int
+		keepDays int
+		maxAge   time.Duration
+		want     []string
+	}{
+		{
+			name: "generations",
+			gen:  3,
+			want: []string{"ami-40", "ami-100"},
+		},
+		{
+			name: "no_more_than_generations",
+			gen:  4,
+		},
+		{
+			name:     "generations_and_keep_days",
+			gen:      1,
+			keepDays: 30,
+			want:     []string{"ami-40", "ami-100"},
+		},
+		{
+			name:   "max_age_regardless_of_generations",
+			gen:    4,
+			maxAge: 90 * 24 * time.Hour,
+			want:   []string{"ami-100"},
+		},
+		{
+			name:     "all_policies",
+			gen:      1,
+			keepDays: 5,
+			maxAge:   60 * 24 * time.Hour,
+			want:     []string{"ami-10", "ami-40", "ami-100"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			conf := &config.Config{
+				Generation: tc.gen,
+				KeepDays:   tc.keepDays,
+				MaxAge:     tc.maxAge,
+			}
+			var got []string
+			for _, image := range outdated(images, conf, now) {
+				got = append(got, *image.ImageId)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got: %v\nwant: %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAMI_amisToDeregister(t *testing.T) {
+	region := "ap-northeast-1"
+	profile := "admin"
+	inUse := []string{"launch configuration legacy-lc", "asg pinned-asg"}
+	testCases := []struct {
+		name        string
+		gen         int
+		keepTag     string
+		wantImages  []string
+		wantSkipped map[string][]string
+	}{
+		{
+			name:        "in_use_by_launch_configuration_and_asg",
+			gen:         2,
+			wantImages:  []string{"ami-00000000000000003"},
+			wantSkipped: map[string][]string{"ami-00000000000000002": inUse},
+		},
+		{
+			name:    "pinned_by_tag",
+			gen:     2,
+			keepTag: "Pinned=release",
+			wantSkipped: map[string][]string{
+				"ami-00000000000000003": {"pinned by tag Pinned=release"},
+				"ami-00000000000000002": inUse,
+			},
+		},
+		{
+			name:        "keep_tag_value_mismatch",
+			gen:         2,
+			keepTag:     "Pinned=golden",
+			wantImages:  []string{"ami-00000000000000003"},
+			wantSkipped: map[string][]string{"ami-00000000000000002": inUse},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockreplacer := NewMockReplacer(
+				context.Background(),
+				region,
+				profile,
+			)
+			conf := &config.Config{
+				Image:      "testimage*",
+				Owner:      "owner",
+				Generation: tc.gen,
+				KeepTag:    tc.keepTag,
+			}
+			images, skipped, _, err := mockreplacer.amisToDeregister(conf)
+			if err != nil {
+				t.Fatalf("got: %v\nwant: %v", err, nil)
+			}
+			var gotImages []string
+			for _, image := range images {
+				gotImages = append(gotImages, *image.ImageId)
+			}
+			if !reflect.DeepEqual(gotImages, tc.wantImages) {
+				t.Errorf("got: %v\nwant: %v", gotImages, tc.wantImages)
+			}
+			if len(skipped) != len(tc.wantSkipped) {
+				t.Errorf("got: %+v skipped\nwant: %d", skipped, len(tc.wantSkipped))
+			}
+			for _, image := range skipped {
+				reasons, ok := tc.wantSkipped[image.ImageID]
+				if !ok {
+					t.Errorf("got: %s skipped\nwant: not skipped", image.ImageID)
+				}
+				for _, reason := range reasons {
+					if !strings.Contains(image.Reason, reason) {
+						t.Errorf("got: %s skipped for %q\nwant: containing %q", image.ImageID, image.Reason, reason)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAMI_imageFilters(t *testing.T) {
+	conf := &config.Config{
+		Image: "app-*",
+		Tags:  []string{"Application=api", "Environment"},
+	}
+	filters, err := imageFilters(conf)
+	if err != nil {
+		t.Fatalf("got: %v\nwant: %v", err, nil)
+	}
+	got := map[string]string{}
+	for _, f := range filters {
+		got[aws.StringValue(f.Name)] = aws.StringValue(f.Values[0])
+	}
+	want := map[string]string{
+		"name":            "app-*",
+		"tag:Application": "api",
+		"tag-key":         "Environment",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v\nwant: %v", got, want)
+	}
+
+	conf.Tags = []string{"=api"}
+	if _, err := imageFilters(conf); err == nil {
+		t.Errorf("got: %v\nwant: error", err)
+	}
+}
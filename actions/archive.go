@@ -0,0 +1,192 @@
+package actions
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/recyclebin"
+	"github.com/nest-egg/ami-replacer/config"
+	"github.com/nest-egg/ami-replacer/log"
+	"golang.org/x/xerrors"
+)
+
+// snapshotsToProcess returns the unused snapshots rms acts on with c.Action,
+// along with those it spares and why.
+func (r *Replacer) snapshotsToProcess(c *config.Config) ([]*ec2.Snapshot, []SkippedSnapshot, error) {
+
+	snapshots, skipped, err := r.unusedSnapshots(c)
+	if err != nil || len(snapshots) == 0 {
+		return snapshots, skipped, err
+	}
+	var spared []SkippedSnapshot
+	switch c.Action {
+	case config.ActionArchive:
+		snapshots, spared, err = r.archivableSnapshots(snapshots)
+	case config.ActionRecycle:
+		snapshots, spared, err = r.recyclableSnapshots(snapshots)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return snapshots, append(skipped, spared...), nil
+}
+
+// archivableSnapshots keeps the completed snapshots in the standard tier
+// that are not being archived or restored.
+func (r *Replacer) archivableSnapshots(snapshots []*ec2.Snapshot) ([]*ec2.Snapshot, []SkippedSnapshot, error) {
+
+	operations, err := r.tieringOperations()
+	if err != nil {
+		return nil, nil, err
+	}
+	var archivable []*ec2.Snapshot
+	var skipped []SkippedSnapshot
+	for _, snapshot := range snapshots {
+		id := aws.StringValue(snapshot.SnapshotId)
+		reason := ""
+		switch op := operations[id]; {
+		case aws.StringValue(snapshot.StorageTier) == ec2.StorageTierArchive:
+			reason = "already archived"
+		case strings.HasSuffix(op, "-in-progress"):
+			reason = "in transition: " + op
+		case snapshot.RestoreExpiryTime != nil:
+			reason = "temporarily restored"
+		case aws.StringValue(snapshot.State) != ec2.SnapshotStateCompleted:
+			reason = "not completed"
+		}
+		if reason != "" {
+			skipped = append(skipped, SkippedSnapshot{SnapshotID: id, Reason: reason})
+			continue
+		}
+		archivable = append(archivable, snapshot)
+	}
+	return archivable, skipped, nil
+}
+
+// tieringOperations maps snapshots to the status of their last tiering operation.
+func (r *Replacer) tieringOperations() (map[string]string, error) {
+
+	operations := map[string]string{}
+	params := &ec2.DescribeSnapshotTierStatusInput{MaxResults: aws.Int64(1000)}
+	for {
+		output, err := r.asg.Ec2Api.DescribeSnapshotTierStatus(params)
+		if err != nil {
+			return nil, xerrors.Errorf("Failed to describe snapshot tier status: %w", err)
+		}
+		for _, status := range output.SnapshotTierStatuses {
+			operations[aws.StringValue(status.SnapshotId)] = aws.StringValue(status.LastTieringOperationStatus)
+		}
+		if aws.StringValue(output.NextToken) == "" {
+			break
+		}
+		params.NextToken = output.NextToken
+	}
+	return operations, nil
+}
+
+func (r *Replacer) archiveSnapshot(snapshotid string) (*ec2.ModifySnapshotTierOutput, error) {
+
+	params := &ec2.ModifySnapshotTierInput{
+		DryRun:      aws.Bool(r.dryrun),
+		SnapshotId:  aws.String(snapshotid),
+		StorageTier: aws.String(ec2.TargetStorageTierArchive),
+	}
+	output, err := r.asg.Ec2Api.ModifySnapshotTier(params)
+	if err != nil {
+		return nil, xerrors.Errorf("Failed to archive snapshot: %w", err)
+	}
+	return output, nil
+}
+
+// retentionRule is an available Recycle Bin rule retaining deleted snapshots.
+type retentionRule struct {
+	id        string
+	retention string
+	tags      []*recyclebin.ResourceTag
+}
+
+// covers reports whether the rule retains the snapshot once deleted.
+// A rule without tags retains every snapshot of the region.
+func (rule retentionRule) covers(tags map[string]string) bool {
+	if len(rule.tags) == 0 {
+		return true
+	}
+	for _, t := range rule.tags {
+		value, ok := tags[aws.StringValue(t.ResourceTagKey)]
+		if ok && (t.ResourceTagValue == nil || aws.StringValue(t.ResourceTagValue) == value) {
+			return true
+		}
+	}
+	return false
+}
+
+// recyclableSnapshots keeps the snapshots a Recycle Bin rule retains once deleted.
+func (r *Replacer) recyclableSnapshots(snapshots []*ec2.Snapshot) ([]*ec2.Snapshot, []SkippedSnapshot, error) {
+
+	rules, err := r.retentionRules()
+	if err != nil {
+		return nil, nil, err
+	}
+	var recyclable []*ec2.Snapshot
+	var skipped []SkippedSnapshot
+	for _, snapshot := range snapshots {
+		id := aws.StringValue(snapshot.SnapshotId)
+		tags := snapshotTags(snapshot)
+		covered := false
+		for _, rule := range rules {
+			if rule.covers(tags) {
+				log.Logger.Debugf("Snapshot %s is retained for %s by Recycle Bin rule %s", id, rule.retention, rule.id)
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			skipped = append(skipped, SkippedSnapshot{SnapshotID: id, Reason: "not retained by any Recycle Bin rule"})
+			continue
+		}
+		recyclable = append(recyclable, snapshot)
+	}
+	return recyclable, skipped, nil
+}
+
+// retentionRules lists the available Recycle Bin rules for EBS snapshots.
+func (r *Replacer) retentionRules() ([]retentionRule, error) {
+
+	var rules []retentionRule
+	params := &recyclebin.ListRulesInput{ResourceType: aws.String(recyclebin.ResourceTypeEbsSnapshot)}
+	for {
+		output, err := r.asg.RbinAPI.ListRules(params)
+		if err != nil {
+			return nil, xerrors.Errorf("Failed to list Recycle Bin rules: %w", err)
+		}
+		for _, summary := range output.Rules {
+			rule, err := r.asg.RbinAPI.GetRule(&recyclebin.GetRuleInput{Identifier: summary.Identifier})
+			if err != nil {
+				return nil, xerrors.Errorf("Failed to get Recycle Bin rule %s: %w", aws.StringValue(summary.Identifier), err)
+			}
+			if aws.StringValue(rule.Status) != recyclebin.RuleStatusAvailable {
+				continue
+			}
+			rules = append(rules, retentionRule{
+				id:        aws.StringValue(rule.Identifier),
+				retention: retentionOf(rule.RetentionPeriod),
+				tags:      rule.ResourceTags,
+			})
+		}
+		if aws.StringValue(output.NextToken) == "" {
+			break
+		}
+		params.NextToken = output.NextToken
+	}
+	log.Logger.Debugf("%d Recycle Bin rules retain EBS snapshots", len(rules))
+	return rules, nil
+}
+
+func retentionOf(period *recyclebin.RetentionPeriod) string {
+	if period == nil {
+		return "an unknown period"
+	}
+	return fmt.Sprintf("%d %s", aws.Int64Value(period.RetentionPeriodValue), strings.ToLower(aws.StringValue(period.RetentionPeriodUnit)))
+}
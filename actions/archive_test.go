@@ -0,0 +1,114 @@
+package actions
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/recyclebin"
+	"github.com/nest-egg/ami-replacer/config"
+)
+
+func TestArchive_covers(t *testing.T) {
+	tag := func(key string, value *string) *recyclebin.ResourceTag {
+		return &recyclebin.ResourceTag{ResourceTagKey: aws.String(key), ResourceTagValue: value}
+	}
+	testCases := []struct {
+		name string
+		rule retentionRule
+		tags map[string]string
+		want bool
+	}{
+		{
+			name: "region_level",
+			tags: map[string]string{"Team": "web"},
+			want: true,
+		},
+		{
+			name: "tag_value",
+			rule: retentionRule{tags: []*recyclebin.ResourceTag{tag("Team", aws.String("infra"))}},
+			tags: map[string]string{"Team": "infra"},
+			want: true,
+		},
+		{
+			name: "other_value",
+			rule: retentionRule{tags: []*recyclebin.ResourceTag{tag("Team", aws.String("infra"))}},
+			tags: map[string]string{"Team": "web"},
+		},
+		{
+			name: "any_value",
+			rule: retentionRule{tags: []*recyclebin.ResourceTag{tag("Team", nil)}},
+			tags: map[string]string{"Team": "web"},
+			want: true,
+		},
+		{
+			name: "untagged",
+			rule: retentionRule{tags: []*recyclebin.ResourceTag{tag("Team", nil)}},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.rule.covers(tc.tags); got != tc.want {
+				t.Errorf("got: %v\nwant: %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestArchive_RemoveSnapShots(t *testing.T) {
+	testCases := []struct {
+		name        string
+		action      string
+		wantDone    []string
+		wantSkipped []SkippedSnapshot
+	}{
+		{
+			name:     "archive",
+			action:   config.ActionArchive,
+			wantDone: []string{"snap-tier-standard", "snap-tier-untagged"},
+			wantSkipped: []SkippedSnapshot{
+				{SnapshotID: "snap-tier-archived", Reason: "already archived"},
+				{SnapshotID: "snap-tier-moving", Reason: "in transition: archival-in-progress"},
+				{SnapshotID: "snap-tier-restored", Reason: "temporarily restored"},
+				{SnapshotID: "snap-tier-pending", Reason: "not completed"},
+			},
+		},
+		{
+			name:     "recycle",
+			action:   config.ActionRecycle,
+			wantDone: []string{"snap-tier-standard", "snap-tier-archived", "snap-tier-moving", "snap-tier-restored", "snap-tier-pending"},
+			wantSkipped: []SkippedSnapshot{
+				{SnapshotID: "snap-tier-untagged", Reason: "not retained by any Recycle Bin rule"},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockreplacer := NewMockReplacer(
+				context.Background(),
+				"ap-northeast-1",
+				"admin",
+			)
+			res := &Result{Target: tc.name}
+			mockreplacer.Record(res)
+			conf := &config.Config{Owner: mockTieredOwner, Action: tc.action}
+			if err := mockreplacer.RemoveSnapShots(conf); err != nil {
+				t.Fatalf("got: %v\nwant: %v", err, nil)
+			}
+			var done []string
+			for _, s := range res.Snapshots {
+				if s.Action != tc.action {
+					t.Errorf("got: %s %s\nwant: %s %s", s.SnapshotID, s.Action, s.SnapshotID, tc.action)
+				}
+				done = append(done, s.SnapshotID)
+			}
+			if !reflect.DeepEqual(done, tc.wantDone) {
+				t.Errorf("got: %v\nwant: %v", done, tc.wantDone)
+			}
+			if !reflect.DeepEqual(res.SkippedSnapshots, tc.wantSkipped) {
+				t.Errorf("got: %+v\nwant: %+v", res.SkippedSnapshots, tc.wantSkipped)
+			}
+		})
+	}
+}
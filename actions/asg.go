@@ -1,14 +1,12 @@
 package actions
 
 import (
-	"fmt"
-	"sync"
-
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/cenkalti/backoff"
 
+	"github.com/nest-egg/ami-replacer/fsm"
 	"github.com/nest-egg/ami-replacer/log"
 	"golang.org/x/xerrors"
 )
@@ -22,7 +20,7 @@ func (r *Replacer) replaceUnusedInstance(clst *cluster) (*ec2.TerminateInstances
 	log.Logger.Infof("Terminate instance %v", instances)
 
 	params := &ec2.TerminateInstancesInput{
-		DryRun:      aws.Bool(dryrun),
+		DryRun:      aws.Bool(r.dryrun),
 		InstanceIds: aws.StringSlice(instances),
 	}
 	result, err := r.asg.Ec2Api.TerminateInstances(params)
@@ -87,17 +85,24 @@ func asgSize(asginfo []*autoscaling.Group) int {
 	return size
 }
 
+// obsoleteInstances returns the instances running tasks on an AMI other than the newest one.
+func obsoleteInstances(instances []Instance, newestami string) []Instance {
+	var obsolete []Instance
+	for _, inst := range instances {
+		if inst.RunningTasks != 0 && inst.ImageID != newestami {
+			obsolete = append(obsolete, inst)
+		}
+	}
+	return obsolete
+}
+
 func (r *Replacer) swapInstance(clst *cluster) error {
 
 	instances := clst.ecsInstance
-	var wg sync.WaitGroup
 	var emptyInstanceCount int
 	asgname := clst.asg.name
 
 	log.Logger.Infof("replace ECS cluster instances with newest AMI: %s", clst.asg.newestami)
-	if err := r.deploy.FSM.Event("start"); err != nil {
-		return xerrors.Errorf("Failed to enter state: %w", err)
-	}
 	for _, inst := range instances {
 		_, err := r.clearScaleinProtection(inst.InstanceID, asgname)
 		if err != nil {
@@ -112,66 +117,73 @@ func (r *Replacer) swapInstance(clst *cluster) error {
 		return xerrors.New("No empty isntances")
 	}
 
-	for _, inst := range instances {
-		wg.Add(1)
-		_, errc := r.swap(inst, &wg, clst.asg)
-		err := <-errc
-		if err != nil {
+	obsolete := obsoleteInstances(instances, clst.asg.newestami)
+	batch := clst.batch
+	if batch < 1 {
+		batch = 1
+	}
+	for start := 0; start < len(obsolete); start += batch {
+		end := start + batch
+		if end > len(obsolete) {
+			end = len(obsolete)
+		}
+		if err := r.swapBatch(obsolete[start:end], clst.asg); err != nil {
 			return xerrors.Errorf("Failed to replace instances: %w", err)
 		}
-		log.Logger.Info("Successfully replaced instances!")
-	}
-	wg.Wait()
-	if err := r.deploy.FSM.Event("finish"); err != nil {
-		return xerrors.Errorf("Failed to enter state: %w", err)
+		r.recordReplaced(obsolete[start:end], clst.asg.newestami)
+		log.Logger.Infof("Successfully replaced %d of %d instances!", end, len(obsolete))
 	}
 	return nil
 }
 
-func (r *Replacer) swap(inst Instance, wg *sync.WaitGroup, asg asg) (<-chan string, <-chan error) {
-	out := make(chan string, 1)
-	errc := make(chan error, 1)
-	var stoptarget []string
-	go func() {
-		{
-			log.Logger.Infof("Start replacing instances: %v", inst)
-			if inst.RunningTasks != 0 && inst.ImageID != asg.newestami {
-				log.Logger.Infof("ECS instances %s is running obsolete AMI", inst.InstanceID)
-				_, err := r.drainInstance(inst)
-				if err != nil {
-					errc <- xerrors.Errorf("Cannnot drain instance: %w", err)
-				}
-				stoptarget = append(stoptarget, inst.InstanceID)
-				c := &cluster{
-					unusedInstances: stoptarget,
-					asg:             asg,
-				}
-				clustername := inst.Cluster
-				if err := r.waitTasksRunning(clustername, asg.name); err != nil {
-					errc <- xerrors.Errorf("Waiter has returned error: %w", err)
-				}
-				output, err := r.replaceUnusedInstance(c)
-				_ = output
-				if err != nil {
-					errc <- xerrors.Errorf("Failed to replace unused instance: %w", err)
-				}
-				if err := r.waitTasksRunning(clustername, asg.name); err != nil {
-					errc <- xerrors.Errorf("Waiter has returned error: %w", err)
-				}
-				log.Logger.Infof("Target ECS instances successfully stopped")
-			} else if inst.RunningTasks != 0 && inst.ImageID == asg.newestami {
-				log.Logger.Infof("Target ECS instances %s already runs newest AMI", inst.InstanceID)
-			} else if inst.RunningTasks == 0 {
-				log.Logger.Infof("Nothing to do. Empty instance with the newest ami: %v", inst.InstanceID)
-			}
-			out <- "done!"
-			close(errc)
-			close(out)
-			defer wg.Done()
-		}
-	}()
+// swapBatch drains a batch of instances running an obsolete AMI together and terminates them
+// once their tasks are running elsewhere, so the asg launches replacements with the newest AMI.
+// It returns when the tasks are running again, before the next batch is started.
+func (r *Replacer) swapBatch(batch []Instance, asg asg) error {
 
-	return out, errc
+	var stoptarget []string
+	for _, inst := range batch {
+		log.Logger.Infof("ECS instances %s is running obsolete AMI", inst.InstanceID)
+		stoptarget = append(stoptarget, inst.InstanceID)
+	}
+	log.Logger.Infof("Start replacing instances: %v", stoptarget)
+	clustername := batch[0].Cluster
+	if err := r.deploy.Enter(fsm.Draining); err != nil {
+		return err
+	}
+	if err := r.track(batch, instanceDraining); err != nil {
+		return xerrors.Errorf("Failed to record drained instances: %w", err)
+	}
+	if _, err := r.drainInstances(clustername, batch); err != nil {
+		return xerrors.Errorf("Cannnot drain instances: %w", err)
+	}
+	if err := r.waitTasksRunning(clustername, asg.name); err != nil {
+		return xerrors.Errorf("Waiter has returned error: %w", err)
+	}
+	c := &cluster{
+		unusedInstances: stoptarget,
+		asg:             asg,
+	}
+	if err := r.deploy.Enter(fsm.Terminating); err != nil {
+		return err
+	}
+	if err := r.track(batch, instanceTerminating); err != nil {
+		return xerrors.Errorf("Failed to record terminated instances: %w", err)
+	}
+	if _, err := r.replaceUnusedInstance(c); err != nil {
+		return xerrors.Errorf("Failed to replace unused instance: %w", err)
+	}
+	if err := r.deploy.Enter(fsm.Stabilizing); err != nil {
+		return err
+	}
+	if err := r.waitTasksRunning(clustername, asg.name); err != nil {
+		return xerrors.Errorf("Waiter has returned error: %w", err)
+	}
+	if err := r.track(batch, instanceReplaced); err != nil {
+		return xerrors.Errorf("Failed to record replaced instances: %w", err)
+	}
+	log.Logger.Infof("Target ECS instances successfully stopped")
+	return nil
 }
 
 func (r *Replacer) waitTasksRunning(clustername string, asgname string) error {
@@ -344,7 +356,7 @@ func (r *Replacer) ecsInstance(clst *cluster) ([]Instance, error) {
 	}
 
 	if count == len {
-		return nil, fmt.Errorf("All instances have been already running with newest images")
+		return nil, ErrAlreadyNewest
 	}
 
 	for _, st := range status.ContainerInstances {
@@ -1,10 +1,13 @@
 package actions
 
 import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/recyclebin/recyclebiniface"
 	"github.com/nest-egg/ami-replacer/apis"
 )
 
@@ -13,13 +16,40 @@ type AutoScaling struct {
 	AsgAPI autoscalingiface.AutoScalingAPI
 	Ec2Api ec2iface.EC2API
 	EcsAPI ecsiface.ECSAPI
+	// RbinAPI looks up the Recycle Bin rules rms --action recycle relies on.
+	RbinAPI recyclebiniface.RecycleBinAPI
+
+	// inRegion builds the api interfaces of another region
+	// with the same credentials.
+	inRegion func(region string) *AutoScaling
+}
+
+// AssumeRole is an iam role assumed with the profile credentials.
+// The zero value uses the profile credentials as they are.
+type AssumeRole struct {
+	RoleArn    string
+	ExternalID string
 }
 
-func newAsg(region string, profile string) (asg *AutoScaling) {
+func newAsg(region string, profile string, role AssumeRole) (asg *AutoScaling) {
 	sess := session.Must(session.NewSessionWithOptions(session.Options{
 		SharedConfigState: session.SharedConfigEnable,
 		Profile:           profile,
+		Config:            aws.Config{Region: aws.String(region)},
 	}))
+	if role.RoleArn != "" {
+		creds := stscreds.NewCredentials(sess, role.RoleArn, func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = "ami-replacer"
+			if role.ExternalID != "" {
+				p.ExternalID = aws.String(role.ExternalID)
+			}
+		})
+		sess = sess.Copy(&aws.Config{Credentials: creds})
+	}
+	return newRegionalAsg(sess, region)
+}
+
+func newRegionalAsg(sess *session.Session, region string) (asg *AutoScaling) {
 
 	ec2Api := apis.NewEC2API(
 		sess,
@@ -33,11 +63,19 @@ func newAsg(region string, profile string) (asg *AutoScaling) {
 		sess,
 		region,
 	)
+	rbinAPI := apis.NewRecycleBinAPI(
+		sess,
+		region,
+	)
 
 	return &AutoScaling{
-		AsgAPI: asgAPI,
-		Ec2Api: ec2Api,
-		EcsAPI: ecsAPI,
+		AsgAPI:  asgAPI,
+		Ec2Api:  ec2Api,
+		EcsAPI:  ecsAPI,
+		RbinAPI: rbinAPI,
+		inRegion: func(region string) *AutoScaling {
+			return newRegionalAsg(sess, region)
+		},
 	}
 
 }
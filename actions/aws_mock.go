@@ -2,28 +2,48 @@ package actions
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"github.com/aws/aws-sdk-go/service/ecs"
 	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/recyclebin"
+	"github.com/aws/aws-sdk-go/service/recyclebin/recyclebiniface"
 	"github.com/nest-egg/ami-replacer/fsm"
 )
 
 type mockASGiface struct {
 	autoscalingiface.AutoScalingAPI
+
+	// calls recorded for rollback tests.
+	updates    []*autoscaling.UpdateAutoScalingGroupInput
+	terminated []string
+	protected  []string
 }
 type mockEC2iface struct {
 	ec2iface.EC2API
+	region string
+
+	// launch template changes recorded for template tests.
+	templates []string
 }
 
 type mockECSiface struct {
 	ecsiface.ECSAPI
+
+	reactivated []string
+}
+
+type mockRbiniface struct {
+	recyclebiniface.RecycleBinAPI
 }
 
 type mockAutoScaling struct {
@@ -32,6 +52,49 @@ type mockAutoScaling struct {
 	EcsAPI *mockECSiface
 }
 
+func (rb *mockRbiniface) ListRules(params *recyclebin.ListRulesInput) (*recyclebin.ListRulesOutput, error) {
+
+	if params.NextToken == nil {
+		return &recyclebin.ListRulesOutput{
+			Rules:     []*recyclebin.RuleSummary{{Identifier: aws.String("rule-infra")}},
+			NextToken: aws.String("page2"),
+		}, nil
+	}
+	return &recyclebin.ListRulesOutput{
+		Rules: []*recyclebin.RuleSummary{{Identifier: aws.String("rule-pending")}},
+	}, nil
+}
+
+func (rb *mockRbiniface) GetRule(params *recyclebin.GetRuleInput) (*recyclebin.GetRuleOutput, error) {
+
+	retention := &recyclebin.RetentionPeriod{
+		RetentionPeriodValue: aws.Int64(7),
+		RetentionPeriodUnit:  aws.String(recyclebin.RetentionPeriodUnitDays),
+	}
+	switch *params.Identifier {
+	case "rule-infra":
+		return &recyclebin.GetRuleOutput{
+			Identifier:      params.Identifier,
+			ResourceType:    aws.String(recyclebin.ResourceTypeEbsSnapshot),
+			RetentionPeriod: retention,
+			Status:          aws.String(recyclebin.RuleStatusAvailable),
+			ResourceTags: []*recyclebin.ResourceTag{{
+				ResourceTagKey:   aws.String("Team"),
+				ResourceTagValue: aws.String("infra"),
+			}},
+		}, nil
+	case "rule-pending":
+		// A region-level rule, ignored until it becomes available.
+		return &recyclebin.GetRuleOutput{
+			Identifier:      params.Identifier,
+			ResourceType:    aws.String(recyclebin.ResourceTypeEbsSnapshot),
+			RetentionPeriod: retention,
+			Status:          aws.String(recyclebin.RuleStatusPending),
+		}, nil
+	}
+	return nil, fmt.Errorf("error executing GetRule")
+}
+
 //MockReplacement mocks Replacement.
 type MockReplacement struct {
 	ctx context.Context
@@ -57,21 +120,32 @@ func NewMockReplacer(
 	region string,
 	profile string) *Replacer {
 
-	asgroup := newAsg(region, profile)
+	asgroup := newAsg(region, profile, AssumeRole{})
 	deploy := fsm.NewDeploy("start")
 	asgroup.Ec2Api = &mockEC2iface{}
 	asgroup.AsgAPI = &mockASGiface{}
 	asgroup.EcsAPI = &mockECSiface{}
+	asgroup.RbinAPI = &mockRbiniface{}
+	asgroup.inRegion = func(region string) *AutoScaling {
+		return &AutoScaling{
+			AsgAPI:  &mockASGiface{},
+			Ec2Api:  &mockEC2iface{region: region},
+			EcsAPI:  &mockECSiface{},
+			RbinAPI: &mockRbiniface{},
+		}
+	}
 	return &Replacer{
 		ctx:    ctx,
 		asg:    asgroup,
 		deploy: deploy,
+		result: &Result{},
 	}
 }
 
 func (asg *mockASGiface) UpdateAutoScalingGroup(params *autoscaling.UpdateAutoScalingGroupInput) (*autoscaling.UpdateAutoScalingGroupOutput, error) {
 
 	var output *autoscaling.UpdateAutoScalingGroupOutput
+	asg.updates = append(asg.updates, params)
 	output = &autoscaling.UpdateAutoScalingGroupOutput{}
 	return output, nil
 }
@@ -79,14 +153,27 @@ func (asg *mockASGiface) UpdateAutoScalingGroup(params *autoscaling.UpdateAutoSc
 func (asg *mockASGiface) SetInstanceProtection(params *autoscaling.SetInstanceProtectionInput) (*autoscaling.SetInstanceProtectionOutput, error) {
 
 	var output *autoscaling.SetInstanceProtectionOutput
+	if aws.BoolValue(params.ProtectedFromScaleIn) {
+		asg.protected = append(asg.protected, aws.StringValueSlice(params.InstanceIds)...)
+	}
 	output = &autoscaling.SetInstanceProtectionOutput{}
 	return output, nil
 }
 
+func (asg *mockASGiface) TerminateInstanceInAutoScalingGroup(params *autoscaling.TerminateInstanceInAutoScalingGroupInput) (*autoscaling.TerminateInstanceInAutoScalingGroupOutput, error) {
+
+	asg.terminated = append(asg.terminated, fmt.Sprintf("%s decrement=%v", aws.StringValue(params.InstanceId), aws.BoolValue(params.ShouldDecrementDesiredCapacity)))
+	return &autoscaling.TerminateInstanceInAutoScalingGroupOutput{}, nil
+}
+
 func (asg *mockASGiface) DescribeAutoScalingGroups(params *autoscaling.DescribeAutoScalingGroupsInput) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
 
 	var output *autoscaling.DescribeAutoScalingGroupsOutput
 
+	if len(params.AutoScalingGroupNames) == 0 {
+		return mockTaggedAsgs(params), nil
+	}
+
 	switch *params.AutoScalingGroupNames[0] {
 	case "no_asg":
 		output = &autoscaling.DescribeAutoScalingGroupsOutput{
@@ -183,6 +270,9 @@ func (asg *mockASGiface) DescribeAutoScalingGroups(params *autoscaling.DescribeA
 			},
 			VPCZoneIdentifier: aws.String("subnet-00000001"),
 		}
+		if *params.AutoScalingGroupNames[0] == "obsolete-template-asg" {
+			g.LaunchTemplate.LaunchTemplateId = aws.String("obsolete")
+		}
 		output = &autoscaling.DescribeAutoScalingGroupsOutput{
 			AutoScalingGroups: []*autoscaling.Group{
 				g,
@@ -192,38 +282,127 @@ func (asg *mockASGiface) DescribeAutoScalingGroups(params *autoscaling.DescribeA
 	return output, nil
 }
 
-func (asg *mockASGiface) DescribeAutoScalingInstances(params *autoscaling.DescribeAutoScalingInstancesInput) (*autoscaling.DescribeAutoScalingInstancesOutput, error) {
+// mockTaggedAsgs pages through tagged asgs, applying tag-key and tag:<key> filters like the api.
+func mockTaggedAsgs(params *autoscaling.DescribeAutoScalingGroupsInput) *autoscaling.DescribeAutoScalingGroupsOutput {
 
-	var instances *autoscaling.DescribeAutoScalingInstancesOutput
-	switch *params.InstanceIds[0] {
-	case "exec_error":
-		return nil, fmt.Errorf("failed to describe asg instances")
-	case "no_launch_template":
-		instances = &autoscaling.DescribeAutoScalingInstancesOutput{
-			AutoScalingInstances: []*autoscaling.InstanceDetails{
-				{
-					LaunchTemplate: nil,
-				},
-			},
+	output := mockAsgPage(params.NextToken)
+	groups := []*autoscaling.Group{}
+	for _, g := range output.AutoScalingGroups {
+		if mockMatchAsgFilters(params.Filters, asgTags(g)) {
+			groups = append(groups, g)
 		}
-	case "exec_error_2":
-		instances = &autoscaling.DescribeAutoScalingInstancesOutput{
-			AutoScalingInstances: []*autoscaling.InstanceDetails{
+	}
+	output.AutoScalingGroups = groups
+	return output
+}
+
+func mockMatchAsgFilters(filters []*autoscaling.Filter, tags map[string]string) bool {
+	for _, f := range filters {
+		name := aws.StringValue(f.Name)
+		matched := false
+		for _, v := range aws.StringValueSlice(f.Values) {
+			if name == "tag-key" {
+				_, matched = tags[v]
+			} else if value, ok := tags[strings.TrimPrefix(name, "tag:")]; ok && value == v {
+				matched = true
+			}
+			if matched {
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func mockAsgPage(nextToken *string) *autoscaling.DescribeAutoScalingGroupsOutput {
+
+	tag := func(key string, value string) *autoscaling.TagDescription {
+		return &autoscaling.TagDescription{
+			Key:   aws.String(key),
+			Value: aws.String(value),
+		}
+	}
+	template := func(id string) *autoscaling.LaunchTemplateSpecification {
+		return &autoscaling.LaunchTemplateSpecification{
+			LaunchTemplateId: aws.String(id),
+			Version:          aws.String("$Latest"),
+		}
+	}
+
+	if aws.StringValue(nextToken) == "" {
+		return &autoscaling.DescribeAutoScalingGroupsOutput{
+			AutoScalingGroups: []*autoscaling.Group{
 				{
-					LaunchTemplate: &autoscaling.LaunchTemplateSpecification{
-						LaunchTemplateId: aws.String("error_id"),
-						Version:          aws.String("$Latest"),
+					AutoScalingGroupName: aws.String("api-asg"),
+					LaunchTemplate:       template("lt-00000000000000000"),
+					Tags: []*autoscaling.TagDescription{
+						tag("ami-replacer/managed", "true"),
+						tag("ami-replacer/cluster", "api-cluster"),
 					},
 				},
+				{
+					AutoScalingGroupName: aws.String("unmanaged-asg"),
+					LaunchTemplate:       template("lt-00000000000000000"),
+				},
 			},
+			NextToken: aws.String("page2"),
 		}
-	case "instance-with-obsolete-image":
+	}
+	return &autoscaling.DescribeAutoScalingGroupsOutput{
+		AutoScalingGroups: []*autoscaling.Group{
+			{
+				AutoScalingGroupName: aws.String("worker-asg"),
+				LaunchTemplate:       template("userdata"),
+				Tags: []*autoscaling.TagDescription{
+					tag("ami-replacer/managed", "true"),
+				},
+			},
+			{
+				AutoScalingGroupName: aws.String("pinned-asg"),
+				LaunchTemplate: &autoscaling.LaunchTemplateSpecification{
+					LaunchTemplateId: aws.String("obsolete"),
+					Version:          aws.String("7"),
+				},
+			},
+			{
+				AutoScalingGroupName: aws.String("broken-asg"),
+				LaunchTemplate:       template("lt-00000000000000000"),
+				Tags: []*autoscaling.TagDescription{
+					tag("broken", "true"),
+				},
+			},
+		},
+	}
+}
+
+func (asg *mockASGiface) DescribeLaunchConfigurations(params *autoscaling.DescribeLaunchConfigurationsInput) (*autoscaling.DescribeLaunchConfigurationsOutput, error) {
+
+	output := &autoscaling.DescribeLaunchConfigurationsOutput{
+		LaunchConfigurations: []*autoscaling.LaunchConfiguration{
+			{
+				LaunchConfigurationName: aws.String("legacy-lc"),
+				ImageId:                 aws.String("ami-00000000000000002"),
+			},
+		},
+	}
+	return output, nil
+}
+
+func (asg *mockASGiface) DescribeAutoScalingInstances(params *autoscaling.DescribeAutoScalingInstancesInput) (*autoscaling.DescribeAutoScalingInstancesOutput, error) {
+
+	var instances *autoscaling.DescribeAutoScalingInstancesOutput
+	switch *params.InstanceIds[0] {
+	case "instance-with-obsolete-image", "instance-with-obsolete-image2", "instance-with-obsolete-image3":
+		// launched from an older version, the asg reports the version it tracks.
 		instances = &autoscaling.DescribeAutoScalingInstancesOutput{
 			AutoScalingInstances: []*autoscaling.InstanceDetails{
 				{
 					LaunchTemplate: &autoscaling.LaunchTemplateSpecification{
-						LaunchTemplateId: aws.String("obsolete"),
-						Version:          aws.String("$Latest"),
+						LaunchTemplateId: aws.String("lt-00000000000000000"),
+						Version:          aws.String("$Default"),
 					},
 				},
 			},
@@ -250,6 +429,20 @@ func (ec *mockEC2iface) DescribeLaunchTemplateVersions(params *ec2.DescribeLaunc
 	switch *params.LaunchTemplateId {
 	case "error_id":
 		return output, fmt.Errorf("failed to describr launch template versions")
+	case "userdata":
+		version := &ec2.LaunchTemplateVersion{
+			LaunchTemplateData: &ec2.ResponseLaunchTemplateData{
+				ImageId:  aws.String("ami-00000000000000001"),
+				UserData: aws.String(base64.StdEncoding.EncodeToString([]byte("#!/bin/bash\necho ECS_CLUSTER=worker-cluster >> /etc/ecs/ecs.config\n"))),
+			},
+			LaunchTemplateId: aws.String("userdata"),
+			VersionNumber:    aws.Int64(99),
+		}
+		output = &ec2.DescribeLaunchTemplateVersionsOutput{
+			LaunchTemplateVersions: []*ec2.LaunchTemplateVersion{
+				version,
+			},
+		}
 	case "obsolete":
 		version := &ec2.LaunchTemplateVersion{
 			LaunchTemplateData: &ec2.ResponseLaunchTemplateData{
@@ -283,9 +476,82 @@ func (ec *mockEC2iface) DescribeLaunchTemplateVersions(params *ec2.DescribeLaunc
 func (ec *mockEC2iface) DescribeImages(params *ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error) {
 
 	var output *ec2.DescribeImagesOutput
+	if len(params.Filters) == 0 {
+		return mockAccountImages(params), nil
+	}
+	if ec.region != "" && *params.Filters[0].Values[0] == "app-*" {
+		return mockRegionalImages(ec.region), nil
+	}
+	if ec.region != "" && *params.Filters[0].Values[0] == "shared-app-*" {
+		return mockSharedRegionalImages(ec.region), nil
+	}
 	switch *params.Filters[0].Values[0] {
 	case "error*":
 		return nil, fmt.Errorf("error executing DescribeImages")
+	case "retire*":
+		image := func(id string, created string, deprecation string) *ec2.Image {
+			img := &ec2.Image{
+				CreationDate: aws.String(created),
+				Name:         aws.String(id),
+				ImageId:      aws.String(id),
+			}
+			if deprecation != "" {
+				img.DeprecationTime = aws.String(deprecation)
+				img.Tags = []*ec2.Tag{{Key: aws.String(retireStageTag), Value: aws.String(stageDeprecated)}}
+			}
+			return img
+		}
+		output = &ec2.DescribeImagesOutput{
+			Images: []*ec2.Image{
+				image("ami-retire-4", "2019-04-01T00:00:00.000Z", "2019-05-01T00:00:00.000Z"),
+				image("ami-retire-3", "2019-03-01T00:00:00.000Z", ""),
+				image("ami-retire-2", "2019-02-01T00:00:00.000Z", "2999-01-01T00:00:00.000Z"),
+				image("ami-retire-1", "2019-01-01T00:00:00.000Z", "2019-05-01T00:00:00.000Z"),
+				image("ami-retire-0", "2018-12-01T00:00:00.000Z", ""),
+			},
+		}
+	case "shared*":
+		output = &ec2.DescribeImagesOutput{
+			Images: []*ec2.Image{
+				{
+					CreationDate: aws.String("2019-03-01T00:00:00.000Z"),
+					Name:         aws.String("shared-3"),
+					ImageId:      aws.String("ami-shared-3"),
+				},
+				{
+					CreationDate: aws.String("2019-02-01T00:00:00.000Z"),
+					Name:         aws.String("shared-2"),
+					ImageId:      aws.String("ami-shared-2"),
+				},
+				{
+					CreationDate: aws.String("2019-01-01T00:00:00.000Z"),
+					Name:         aws.String("shared-1"),
+					ImageId:      aws.String("ami-public-1"),
+				},
+			},
+		}
+	case "org-shared*":
+		output = &ec2.DescribeImagesOutput{
+			Images: []*ec2.Image{
+				{
+					CreationDate: aws.String("2019-03-01T00:00:00.000Z"),
+					Name:         aws.String("org-shared-3"),
+					ImageId:      aws.String("ami-org-3"),
+				},
+				{
+					CreationDate: aws.String("2019-02-01T00:00:00.000Z"),
+					Name:         aws.String("org-shared-2"),
+					ImageId:      aws.String("ami-org-2"),
+				},
+				{
+					CreationDate: aws.String("2019-01-01T00:00:00.000Z"),
+					Name:         aws.String("org-shared-1"),
+					ImageId:      aws.String("ami-ou-1"),
+				},
+			},
+		}
+	case "snap-free", "snap-free-old", "snap-free-new", "snap-free-backup", "snap-free-dlm", "snap-free-excluded":
+		output = &ec2.DescribeImagesOutput{}
 	case "error2*":
 		output = &ec2.DescribeImagesOutput{
 			Images: []*ec2.Image{
@@ -326,6 +592,25 @@ func (ec *mockEC2iface) DescribeImages(params *ec2.DescribeImagesInput) (*ec2.De
 					Name:         aws.String("testimage3"),
 					ImageId:      aws.String("ami-00000000000000003"),
 					OwnerId:      aws.String("owner"),
+					Tags: []*ec2.Tag{
+						{Key: aws.String("Pinned"), Value: aws.String("release")},
+					},
+					BlockDeviceMappings: []*ec2.BlockDeviceMapping{
+						{
+							DeviceName: aws.String("/dev/xvda"),
+							Ebs: &ec2.EbsBlockDevice{
+								SnapshotId: aws.String("snap-free"),
+								VolumeSize: aws.Int64(8),
+							},
+						},
+						{
+							DeviceName: aws.String("/dev/xvdb"),
+							Ebs: &ec2.EbsBlockDevice{
+								SnapshotId: aws.String("snapshot1"),
+								VolumeSize: aws.Int64(30),
+							},
+						},
+					},
 				},
 			},
 		}
@@ -333,6 +618,234 @@ func (ec *mockEC2iface) DescribeImages(params *ec2.DescribeImagesInput) (*ec2.De
 	return output, nil
 }
 
+// mockRegionalImages returns app images of ap-northeast-1 and their copies in other regions.
+// Copies are created later than the source images and tagged with the source image id.
+func mockRegionalImages(region string) *ec2.DescribeImagesOutput {
+
+	image := func(id string, name string, created string, tags ...string) *ec2.Image {
+		img := &ec2.Image{
+			ImageId:      aws.String(id),
+			Name:         aws.String(name),
+			CreationDate: aws.String(created),
+			OwnerId:      aws.String("owner"),
+		}
+		for i := 0; i+1 < len(tags); i += 2 {
+			img.Tags = append(img.Tags, &ec2.Tag{Key: aws.String(tags[i]), Value: aws.String(tags[i+1])})
+		}
+		return img
+	}
+	output := &ec2.DescribeImagesOutput{}
+	switch region {
+	case "ap-northeast-1":
+		output.Images = []*ec2.Image{
+			image("ami-apne1-3", "app-3", "2019-03-01T00:00:00.000Z"),
+			image("ami-apne1-2", "app-2", "2019-02-01T00:00:00.000Z"),
+			image("ami-apne1-1", "app-1", "2019-01-01T00:00:00.000Z"),
+		}
+	case "us-east-1":
+		output.Images = []*ec2.Image{
+			image("ami-use1-2", "app-2", "2019-03-10T00:00:00.000Z", "SourceAMI", "ami-apne1-2"),
+			image("ami-use1-1", "app-1", "2019-03-09T00:00:00.000Z", "SourceAMI", "ami-apne1-1"),
+		}
+	case "eu-west-1":
+		output.Images = []*ec2.Image{
+			image("ami-euw1-1", "copy-of-app-1", "2019-03-09T00:00:00.000Z", "SourceAMI", "ami-apne1-1", "Pinned", "release"),
+		}
+	}
+	return output
+}
+
+// mockSharedRegionalImages are copies of the generations shared-app-1 and shared-app-2,
+// the oldest copy in us-east-1 being shared with another account.
+func mockSharedRegionalImages(region string) *ec2.DescribeImagesOutput {
+
+	image := func(id string, name string, created string) *ec2.Image {
+		return &ec2.Image{
+			ImageId:      aws.String(id),
+			Name:         aws.String(name),
+			CreationDate: aws.String(created),
+			OwnerId:      aws.String("owner"),
+		}
+	}
+	output := &ec2.DescribeImagesOutput{}
+	switch region {
+	case "ap-northeast-1":
+		output.Images = []*ec2.Image{
+			image("ami-shared-apne1-3", "shared-app-3", "2019-03-01T00:00:00.000Z"),
+			image("ami-shared-apne1-2", "shared-app-2", "2019-02-01T00:00:00.000Z"),
+			image("ami-shared-apne1-1", "shared-app-1", "2019-01-01T00:00:00.000Z"),
+		}
+	case "us-east-1":
+		output.Images = []*ec2.Image{
+			image("ami-shared-use1-1", "shared-app-1", "2019-03-09T00:00:00.000Z"),
+		}
+	}
+	return output
+}
+
+// mockSweepOwner owns the snapshots of mockSweep.
+const mockSweepOwner = "sweep"
+
+// mockSweep is an account of 10000 snapshots, the even ones used by
+// images and every fourth from the second used by volumes.
+var mockSweep = newMockSweep(10000)
+
+type mockSweepAccount struct {
+	snapshots []*ec2.Snapshot
+	images    []*ec2.Image
+	volumes   []*ec2.Volume
+}
+
+func newMockSweep(n int) *mockSweepAccount {
+	sweep := &mockSweepAccount{}
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < n; i++ {
+		id := aws.String(fmt.Sprintf("snap-sweep-%05d", i))
+		sweep.snapshots = append(sweep.snapshots, &ec2.Snapshot{
+			OwnerId:    aws.String(mockSweepOwner),
+			SnapshotId: id,
+			StartTime:  aws.Time(start.Add(time.Duration(i) * time.Minute)),
+			VolumeSize: aws.Int64(8),
+		})
+		switch i % 4 {
+		case 0, 2:
+			sweep.images = append(sweep.images, &ec2.Image{
+				ImageId: aws.String(fmt.Sprintf("ami-sweep-%05d", i)),
+				BlockDeviceMappings: []*ec2.BlockDeviceMapping{{
+					DeviceName: aws.String("/dev/xvda"),
+					Ebs:        &ec2.EbsBlockDevice{SnapshotId: id},
+				}},
+			})
+		case 1:
+			sweep.volumes = append(sweep.volumes, &ec2.Volume{
+				VolumeId:   aws.String(fmt.Sprintf("vol-sweep-%05d", i)),
+				SnapshotId: id,
+			})
+		}
+	}
+	return sweep
+}
+
+// mockPage returns the bounds of the page of n items starting at the offset in nextToken.
+func mockPage(n int, nextToken *string, maxResults *int64) (int, int, *string) {
+	start := 0
+	if token := aws.StringValue(nextToken); token != "" {
+		fmt.Sscanf(token, "%d", &start)
+	}
+	end := n
+	if max := int(aws.Int64Value(maxResults)); max > 0 && start+max < n {
+		end = start + max
+		return start, end, aws.String(fmt.Sprint(end))
+	}
+	return start, end, nil
+}
+
+// mockAccountImages pages through every image of an owner or shared with the account.
+func mockAccountImages(params *ec2.DescribeImagesInput) *ec2.DescribeImagesOutput {
+
+	var images []*ec2.Image
+	switch {
+	case len(params.ExecutableUsers) != 0:
+		images = []*ec2.Image{{
+			ImageId: aws.String("ami-shared-in"),
+			BlockDeviceMappings: []*ec2.BlockDeviceMapping{{
+				Ebs: &ec2.EbsBlockDevice{SnapshotId: aws.String("snapshot2")},
+			}},
+		}}
+	case aws.StringValue(params.Owners[0]) == mockSweepOwner:
+		images = mockSweep.images
+	default:
+		images = []*ec2.Image{{
+			ImageId: aws.String("ami-3"),
+			BlockDeviceMappings: []*ec2.BlockDeviceMapping{{
+				Ebs: &ec2.EbsBlockDevice{SnapshotId: aws.String("snapshot1")},
+			}},
+		}}
+	}
+	start, end, next := mockPage(len(images), params.NextToken, params.MaxResults)
+	return &ec2.DescribeImagesOutput{Images: images[start:end], NextToken: next}
+}
+
+// mockAccountVolumes pages through every volume of the region.
+func mockAccountVolumes(params *ec2.DescribeVolumesInput) *ec2.DescribeVolumesOutput {
+
+	volumes := append([]*ec2.Volume{{
+		SnapshotId: aws.String("snapshot1"),
+		VolumeId:   aws.String("volume1"),
+	}}, mockSweep.volumes...)
+	start, end, next := mockPage(len(volumes), params.NextToken, params.MaxResults)
+	return &ec2.DescribeVolumesOutput{Volumes: volumes[start:end], NextToken: next}
+}
+
+func (ec *mockEC2iface) DescribeRegions(params *ec2.DescribeRegionsInput) (*ec2.DescribeRegionsOutput, error) {
+
+	output := &ec2.DescribeRegionsOutput{}
+	for _, region := range []string{"us-east-1", "eu-west-1", "ap-northeast-1"} {
+		output.Regions = append(output.Regions, &ec2.Region{RegionName: aws.String(region)})
+	}
+	return output, nil
+}
+
+func (ec *mockEC2iface) DescribeImageAttribute(params *ec2.DescribeImageAttributeInput) (*ec2.DescribeImageAttributeOutput, error) {
+
+	output := &ec2.DescribeImageAttributeOutput{ImageId: params.ImageId}
+	switch *params.ImageId {
+	case "ami-shared-2":
+		output.LaunchPermissions = []*ec2.LaunchPermission{
+			{UserId: aws.String("111111111111")},
+			{UserId: aws.String("222222222222")},
+		}
+	case "ami-shared-use1-1":
+		output.LaunchPermissions = []*ec2.LaunchPermission{
+			{UserId: aws.String("111111111111")},
+		}
+	case "ami-public-1":
+		output.LaunchPermissions = []*ec2.LaunchPermission{
+			{Group: aws.String("all")},
+		}
+	case "ami-org-2":
+		output.LaunchPermissions = []*ec2.LaunchPermission{
+			{OrganizationArn: aws.String("arn:aws:organizations::111111111111:organization/o-example")},
+		}
+	case "ami-ou-1":
+		output.LaunchPermissions = []*ec2.LaunchPermission{
+			{OrganizationalUnitArn: aws.String("arn:aws:organizations::111111111111:ou/o-example/ou-example")},
+		}
+	}
+	return output, nil
+}
+
+func (ec *mockEC2iface) ModifyImageAttribute(params *ec2.ModifyImageAttributeInput) (*ec2.ModifyImageAttributeOutput, error) {
+
+	if params.LaunchPermission == nil || len(params.LaunchPermission.Remove) == 0 {
+		return nil, fmt.Errorf("error executing ModifyImageAttribute")
+	}
+	return &ec2.ModifyImageAttributeOutput{}, nil
+}
+
+func (ec *mockEC2iface) EnableImageDeprecation(params *ec2.EnableImageDeprecationInput) (*ec2.EnableImageDeprecationOutput, error) {
+
+	if params.DeprecateAt == nil {
+		return nil, fmt.Errorf("error executing EnableImageDeprecation")
+	}
+	return &ec2.EnableImageDeprecationOutput{Return: aws.Bool(true)}, nil
+}
+
+func (ec *mockEC2iface) DisableImageDeprecation(params *ec2.DisableImageDeprecationInput) (*ec2.DisableImageDeprecationOutput, error) {
+
+	return &ec2.DisableImageDeprecationOutput{Return: aws.Bool(true)}, nil
+}
+
+func (ec *mockEC2iface) CreateTags(params *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+func (ec *mockEC2iface) DeleteTags(params *ec2.DeleteTagsInput) (*ec2.DeleteTagsOutput, error) {
+
+	return &ec2.DeleteTagsOutput{}, nil
+}
+
 func (ec *mockEC2iface) DeregisterImage(params *ec2.DeregisterImageInput) (*ec2.DeregisterImageOutput, error) {
 
 	var output *ec2.DeregisterImageOutput
@@ -351,6 +864,14 @@ func (ec *mockEC2iface) DeleteSnapshot(params *ec2.DeleteSnapshotInput) (*ec2.De
 	switch *params.SnapshotId {
 	case "error":
 		return nil, fmt.Errorf("error executing DeleteSnapshot")
+	case "snap-inuse":
+		return nil, awserr.New("InvalidSnapshot.InUse", "snapshot is in use by ami-3", nil)
+	case "snap-throttled":
+		return nil, awserr.New("RequestLimitExceeded", "Request limit exceeded.", nil)
+	case "snap-denied":
+		return nil, awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation.", nil)
+	case "snap-dryrun":
+		return nil, awserr.New("DryRunOperation", "Request would have succeeded, but DryRun flag is set.", nil)
 	default:
 		output = &ec2.DeleteSnapshotOutput{}
 	}
@@ -363,6 +884,35 @@ func (ec *mockEC2iface) DescribeSnapshots(params *ec2.DescribeSnapshotsInput) (*
 	switch *params.OwnerIds[0] {
 	case "error":
 		return nil, fmt.Errorf("error executing DescribeSnapshot")
+	case mockSweepOwner:
+		output = &ec2.DescribeSnapshotsOutput{Snapshots: mockSweep.snapshots}
+	case mockTieredOwner:
+		output = &ec2.DescribeSnapshotsOutput{Snapshots: mockTieredSnapshots()}
+	case "filtered":
+		now := time.Now()
+		snapshot := func(id string, daysAgo int, description string, tags ...*ec2.Tag) *ec2.Snapshot {
+			return &ec2.Snapshot{
+				OwnerId:     aws.String("filtered"),
+				SnapshotId:  aws.String(id),
+				Description: aws.String(description),
+				StartTime:   aws.Time(now.AddDate(0, 0, -daysAgo)),
+				VolumeSize:  aws.Int64(8),
+				Tags:        tags,
+			}
+		}
+		tag := func(key string, value string) *ec2.Tag {
+			return &ec2.Tag{Key: aws.String(key), Value: aws.String(value)}
+		}
+		output = &ec2.DescribeSnapshotsOutput{
+			Snapshots: []*ec2.Snapshot{
+				snapshot("snap-free-old", 60, "Created by CreateImage", tag("Team", "infra")),
+				snapshot("snap-free-new", 1, "Created by CreateImage", tag("Team", "infra")),
+				snapshot("snap-free-backup", 61, "This snapshot is created by the AWS Backup service.", tag("Team", "infra")),
+				snapshot("snap-free-dlm", 62, "Created for policy: policy-0123456789abcdef0 schedule: Default Schedule", tag("Team", "infra")),
+				snapshot("snap-free-excluded", 63, "Created by CreateImage", tag("Team", "infra"), tag("Retain", "true")),
+				snapshot("snapshot1", 64, "Created by CreateImage", tag("Team", "infra")),
+			},
+		}
 	default:
 		output = &ec2.DescribeSnapshotsOutput{
 			Snapshots: []*ec2.Snapshot{
@@ -382,12 +932,83 @@ func (ec *mockEC2iface) DescribeSnapshots(params *ec2.DescribeSnapshotsInput) (*
 	return output, nil
 }
 
+// mockTieredOwner owns snapshots in every storage tier and tiering state.
+const mockTieredOwner = "tiered"
+
+func mockTieredSnapshots() []*ec2.Snapshot {
+	now := time.Now()
+	snapshot := func(id string, daysAgo int, state string, tier string, tags ...*ec2.Tag) *ec2.Snapshot {
+		return &ec2.Snapshot{
+			OwnerId:     aws.String(mockTieredOwner),
+			SnapshotId:  aws.String(id),
+			StartTime:   aws.Time(now.AddDate(0, 0, -daysAgo)),
+			State:       aws.String(state),
+			StorageTier: aws.String(tier),
+			VolumeSize:  aws.Int64(8),
+			Tags:        tags,
+		}
+	}
+	infra := &ec2.Tag{Key: aws.String("Team"), Value: aws.String("infra")}
+	restored := snapshot("snap-tier-restored", 94, ec2.SnapshotStateCompleted, ec2.StorageTierStandard, infra)
+	restored.RestoreExpiryTime = aws.Time(now.AddDate(0, 0, 3))
+	return []*ec2.Snapshot{
+		snapshot("snap-tier-standard", 90, ec2.SnapshotStateCompleted, ec2.StorageTierStandard, infra),
+		snapshot("snap-tier-untagged", 91, ec2.SnapshotStateCompleted, ec2.StorageTierStandard),
+		snapshot("snap-tier-archived", 92, ec2.SnapshotStateCompleted, ec2.StorageTierArchive, infra),
+		snapshot("snap-tier-moving", 93, ec2.SnapshotStateCompleted, ec2.StorageTierStandard, infra),
+		restored,
+		snapshot("snap-tier-pending", 95, ec2.SnapshotStatePending, ec2.StorageTierStandard, infra),
+	}
+}
+
+func (ec *mockEC2iface) DescribeSnapshotTierStatus(params *ec2.DescribeSnapshotTierStatusInput) (*ec2.DescribeSnapshotTierStatusOutput, error) {
+
+	status := func(id string, operation string) *ec2.SnapshotTierStatus {
+		return &ec2.SnapshotTierStatus{
+			SnapshotId:                 aws.String(id),
+			LastTieringOperationStatus: aws.String(operation),
+		}
+	}
+	if params.NextToken == nil {
+		return &ec2.DescribeSnapshotTierStatusOutput{
+			SnapshotTierStatuses: []*ec2.SnapshotTierStatus{
+				status("snap-tier-standard", ec2.TieringOperationStatusArchivalFailed),
+			},
+			NextToken: aws.String("page2"),
+		}, nil
+	}
+	return &ec2.DescribeSnapshotTierStatusOutput{
+		SnapshotTierStatuses: []*ec2.SnapshotTierStatus{
+			status("snap-tier-moving", ec2.TieringOperationStatusArchivalInProgress),
+		},
+	}, nil
+}
+
+func (ec *mockEC2iface) ModifySnapshotTier(params *ec2.ModifySnapshotTierInput) (*ec2.ModifySnapshotTierOutput, error) {
+
+	switch *params.SnapshotId {
+	case "error":
+		return nil, fmt.Errorf("error executing ModifySnapshotTier")
+	case "snap-tier-archived":
+		return nil, awserr.New("IncorrectState", "The snapshot is already archived.", nil)
+	}
+	return &ec2.ModifySnapshotTierOutput{
+		SnapshotId:       params.SnapshotId,
+		TieringStartTime: aws.Time(time.Now()),
+	}, nil
+}
+
 func (ec *mockEC2iface) DescribeVolumes(params *ec2.DescribeVolumesInput) (*ec2.DescribeVolumesOutput, error) {
 
 	var output *ec2.DescribeVolumesOutput
+	if len(params.Filters) == 0 {
+		return mockAccountVolumes(params), nil
+	}
 	switch *params.Filters[0].Values[0] {
 	case "error":
 		return nil, fmt.Errorf("error executing DescribeVolumes")
+	case "snap-free", "snap-free-old", "snap-free-new", "snap-free-backup", "snap-free-dlm", "snap-free-excluded":
+		output = &ec2.DescribeVolumesOutput{}
 	default:
 		output = &ec2.DescribeVolumesOutput{
 			Volumes: []*ec2.Volume{
@@ -408,32 +1029,96 @@ func (ec *mockEC2iface) DescribeVolumes(params *ec2.DescribeVolumesInput) (*ec2.
 func (ec *mockEC2iface) DescribeInstances(params *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
 
 	var output *ec2.DescribeInstancesOutput
-	switch *params.InstanceIds[0] {
-	case "error":
-		return nil, fmt.Errorf("failed to execute DescribeInstances")
-	default:
+	if len(params.InstanceIds) == 0 {
 		output = &ec2.DescribeInstancesOutput{
 			Reservations: []*ec2.Reservation{
 				{
 					ReservationId: aws.String("reserv1"),
 					Instances: []*ec2.Instance{
 						{
-							Placement: &ec2.Placement{
-								AvailabilityZone: aws.String("ap-northeast-1a"),
-							},
-							State: &ec2.InstanceState{
-								Code: aws.Int64(48),
-							},
+							InstanceId: aws.String("i-00000000000000000"),
+							ImageId:    aws.String("ami-00000000000000001"),
 						},
 					},
 				},
 			},
 		}
+		return output, nil
+	}
+	id := aws.StringValue(params.InstanceIds[0])
+	imageid := "ami-00000000000000001"
+	switch id {
+	case "error", "exec_error":
+		return nil, fmt.Errorf("failed to execute DescribeInstances")
+	case "not_found":
+		return &ec2.DescribeInstancesOutput{}, nil
+	case "instance-with-obsolete-image", "instance-with-obsolete-image2", "instance-with-obsolete-image3":
+		imageid = "ami-00000000000000002"
 	}
+	output = &ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{
+			{
+				ReservationId: aws.String("reserv1"),
+				Instances: []*ec2.Instance{
+					{
+						InstanceId: aws.String(id),
+						ImageId:    aws.String(imageid),
+						Placement: &ec2.Placement{
+							AvailabilityZone: aws.String("ap-northeast-1a"),
+						},
+						State: &ec2.InstanceState{
+							Code: aws.Int64(48),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	return output, nil
+}
+
+func (ec *mockEC2iface) DescribeLaunchTemplates(params *ec2.DescribeLaunchTemplatesInput) (*ec2.DescribeLaunchTemplatesOutput, error) {
 
+	output := &ec2.DescribeLaunchTemplatesOutput{
+		LaunchTemplates: []*ec2.LaunchTemplate{
+			{
+				LaunchTemplateId:     aws.String("lt-00000000000000000"),
+				LaunchTemplateName:   aws.String("mytemplate"),
+				DefaultVersionNumber: aws.Int64(99),
+				LatestVersionNumber:  aws.Int64(99),
+			},
+		},
+	}
 	return output, nil
 }
 
+func (ec *mockEC2iface) CreateLaunchTemplateVersion(params *ec2.CreateLaunchTemplateVersionInput) (*ec2.CreateLaunchTemplateVersionOutput, error) {
+
+	ec.templates = append(ec.templates, fmt.Sprintf("create %s from %s with %s",
+		aws.StringValue(params.LaunchTemplateId), aws.StringValue(params.SourceVersion), aws.StringValue(params.LaunchTemplateData.ImageId)))
+	return &ec2.CreateLaunchTemplateVersionOutput{
+		LaunchTemplateVersion: &ec2.LaunchTemplateVersion{
+			LaunchTemplateId: params.LaunchTemplateId,
+			VersionNumber:    aws.Int64(100),
+		},
+	}, nil
+}
+
+func (ec *mockEC2iface) ModifyLaunchTemplate(params *ec2.ModifyLaunchTemplateInput) (*ec2.ModifyLaunchTemplateOutput, error) {
+
+	ec.templates = append(ec.templates, fmt.Sprintf("default %s %s", aws.StringValue(params.LaunchTemplateId), aws.StringValue(params.DefaultVersion)))
+	return &ec2.ModifyLaunchTemplateOutput{}, nil
+}
+
+func (ec *mockEC2iface) DeleteLaunchTemplateVersions(params *ec2.DeleteLaunchTemplateVersionsInput) (*ec2.DeleteLaunchTemplateVersionsOutput, error) {
+
+	for _, v := range params.Versions {
+		ec.templates = append(ec.templates, fmt.Sprintf("delete %s %s", aws.StringValue(params.LaunchTemplateId), aws.StringValue(v)))
+	}
+	return &ec2.DeleteLaunchTemplateVersionsOutput{}, nil
+}
+
 func (ec *mockEC2iface) StopInstances(params *ec2.StopInstancesInput) (*ec2.StopInstancesOutput, error) {
 	var output *ec2.StopInstancesOutput
 	output = &ec2.StopInstancesOutput{}
@@ -444,7 +1129,7 @@ func (ecsi *mockECSiface) ListContainerInstances(params *ecs.ListContainerInstan
 
 	var output *ecs.ListContainerInstancesOutput
 	switch *params.Cluster {
-	case "error_cluster":
+	case "error_cluster", "error-cluster":
 		return nil, fmt.Errorf("failed to execute ListContainerInstances")
 	default:
 		output = &ecs.ListContainerInstancesOutput{
@@ -485,6 +1170,46 @@ func (ecsi *mockECSiface) DescribeContainerInstances(params *ecs.DescribeContain
 				},
 			},
 		}
+	case "obsolete-cluster":
+		output = &ecs.DescribeContainerInstancesOutput{
+			ContainerInstances: []*ecs.ContainerInstance{
+				{
+					Ec2InstanceId:        aws.String("instance-with-obsolete-image"),
+					RunningTasksCount:    aws.Int64(1),
+					PendingTasksCount:    aws.Int64(0),
+					ContainerInstanceArn: aws.String("arn1"),
+					Status:               aws.String("ACTIVE"),
+					AgentConnected:       aws.Bool(true),
+				},
+				{
+					Ec2InstanceId:        aws.String("instance2"),
+					RunningTasksCount:    aws.Int64(1),
+					PendingTasksCount:    aws.Int64(0),
+					ContainerInstanceArn: aws.String("arn2"),
+					Status:               aws.String("ACTIVE"),
+					AgentConnected:       aws.Bool(true),
+				},
+			},
+		}
+	case "obsolete-batch-cluster":
+		instance := func(id string, arn string, running int64) *ecs.ContainerInstance {
+			return &ecs.ContainerInstance{
+				Ec2InstanceId:        aws.String(id),
+				RunningTasksCount:    aws.Int64(running),
+				PendingTasksCount:    aws.Int64(0),
+				ContainerInstanceArn: aws.String(arn),
+				Status:               aws.String("ACTIVE"),
+				AgentConnected:       aws.Bool(true),
+			}
+		}
+		output = &ecs.DescribeContainerInstancesOutput{
+			ContainerInstances: []*ecs.ContainerInstance{
+				instance("instance-with-obsolete-image", "arn1", 1),
+				instance("instance-with-obsolete-image2", "arn2", 1),
+				instance("instance-with-obsolete-image3", "arn3", 1),
+				instance("instance2", "arn4", 0),
+			},
+		}
 	case "no-running-tasks":
 		output = &ecs.DescribeContainerInstancesOutput{
 			ContainerInstances: []*ecs.ContainerInstance{
@@ -595,7 +1320,10 @@ func (ecsi *mockECSiface) DescribeContainerInstances(params *ecs.DescribeContain
 	return output, nil
 }
 
-func (ecsi *mockECSiface) UpdateContainerInstancesState(*ecs.UpdateContainerInstancesStateInput) (*ecs.UpdateContainerInstancesStateOutput, error) {
+func (ecsi *mockECSiface) UpdateContainerInstancesState(params *ecs.UpdateContainerInstancesStateInput) (*ecs.UpdateContainerInstancesStateOutput, error) {
+	if aws.StringValue(params.Status) == "ACTIVE" {
+		ecsi.reactivated = append(ecsi.reactivated, aws.StringValueSlice(params.ContainerInstances)...)
+	}
 	output := &ecs.UpdateContainerInstancesStateOutput{
 		ContainerInstances: []*ecs.ContainerInstance{
 			{
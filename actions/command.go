@@ -2,58 +2,128 @@ package actions
 
 import (
 	"fmt"
-	"sort"
 
-	"github.com/nest-egg/ami-replacer/apis"
 	"github.com/nest-egg/ami-replacer/config"
+	"github.com/nest-egg/ami-replacer/fsm"
 	"github.com/nest-egg/ami-replacer/log"
 	"golang.org/x/xerrors"
 )
 
-var (
-	state  string
-	dryrun bool
-)
+// ErrAlreadyNewest is returned when every cluster instance already runs the newest AMI.
+var ErrAlreadyNewest = xerrors.New("All instances have been already running with newest images")
 
 //ReplaceInstance replace ecs cluster instances with newest amis.
 func (r *Replacer) ReplaceInstance(c *config.Config) error {
 
-	dryrun = c.Dryrun
+	r.dryrun = c.Dryrun
 
+	if c.Resume {
+		if err := r.resumeRun(c); err != nil {
+			return xerrors.Errorf("Failed to resume run: %w", err)
+		}
+	}
 	clst, err := r.setClusterStatus(c)
+	if xerrors.Is(err, ErrAlreadyNewest) {
+		if r.run == nil {
+			log.Logger.Infof("Cluster %s is already running the newest AMI", c.Clustername)
+			return nil
+		}
+		// the resumed run still has to finish its drained instances and restore the cluster size.
+		clst, err = &cluster{name: c.Clustername, asg: asg{name: c.Asgname, newestami: r.run.NewestAMI}}, nil
+	}
 	if err != nil {
 		return xerrors.Errorf("Failed to set cluster status: %w", err)
 	}
 
+	if !r.dryrun && r.run == nil {
+		if err := r.recordRun(c, clst); err != nil {
+			return xerrors.Errorf("Failed to record run: %w", err)
+		}
+		log.Logger.Infof("Recorded run %s, roll it back with: ami-replacer rollback %s", r.run.ID, r.run.ID)
+	}
+	defer func() { r.result.Transitions = r.deploy.History() }()
+	// the asg launches the newest AMI before the first instance is replaced.
+	err = r.updateLaunchTemplate(c, clst)
+	if err == nil {
+		err = r.replace(clst)
+	}
+	if err == nil {
+		return nil
+	}
+	if ferr := r.deploy.Enter(fsm.Failed); ferr != nil {
+		log.Logger.Warnf("%v", ferr)
+	}
+	if r.run != nil && !c.NoRollback {
+		log.Logger.Errorf("Replacement failed, roll back run %s: %v", r.run.ID, err)
+		if rerr := r.Rollback(r.run); rerr != nil {
+			return xerrors.Errorf("Failed to roll back after %v: %w", err, rerr)
+		}
+		r.result.RolledBack = true
+		if ferr := r.deploy.Enter(fsm.RolledBack); ferr != nil {
+			log.Logger.Warnf("%v", ferr)
+		}
+	}
+	return err
+}
+
+// replace surges the cluster, swaps its instances and restores its size,
+// saving the run after every step. A resumed run skips the steps it completed.
+func (r *Replacer) replace(clst *cluster) error {
+
+	var err error
 	defaultClusterSize := clst.size
+	if r.run != nil && r.run.ClusterSize != 0 {
+		defaultClusterSize = r.run.ClusterSize
+	}
+
+	// the cluster shrinks only once every drained instance has been replaced.
+	r.deploy.Guard(fsm.Shrinking, func(from string) error {
+		if r.run != nil && r.run.State.RUNNUM != r.run.State.STOPNUM {
+			return fmt.Errorf("Cluster is not steady state")
+		}
+		return nil
+	})
 
-	if len(clst.unusedInstances) != 0 {
-		if err := r.deploy.FSM.Event("start"); err != nil {
-			return xerrors.New("Failed to enter state")
+	if err := r.finishDrained(clst); err != nil {
+		return xerrors.Errorf("Failed to finish drained instances: %w", err)
+	}
+
+	if len(clst.unusedInstances) != 0 && !r.run.reached(stepCleaned) {
+		if err := r.deploy.Enter(fsm.Terminating); err != nil {
+			return err
 		}
 		_, err := r.replaceUnusedInstance(clst)
 		if err != nil {
 			return xerrors.Errorf("Failed to replace unused instance: %w", err)
 		}
-		if err := r.deploy.FSM.Event("finish"); err != nil {
-			return xerrors.New("Failed to enter state")
+		r.result.TerminatedInstances = append(r.result.TerminatedInstances, clst.unusedInstances...)
+		if err := r.deploy.Enter(fsm.Stabilizing); err != nil {
+			return err
 		}
 		clst, err = r.refreshClusterStatus(clst)
 		if err != nil {
 			return xerrors.Errorf("Failed to refresh cluster status: %w", err)
 		}
 	}
+	if err := r.checkpoint(stepCleaned); err != nil {
+		return err
+	}
 
-	state = r.deploy.FSM.Current()
-
-	if len(clst.freeInstances) == 0 && state == "closed" {
-		log.Logger.Infof("Cluster %v has no empty ECS instances", clst.name)
+	// surge the cluster so that a whole batch can be drained at once.
+	if surge := clst.batch - len(clst.freeInstances); surge > 0 && !r.run.reached(stepSurged) {
+		log.Logger.Infof("Cluster %v has %d empty ECS instances for a batch of %d", clst.name, len(clst.freeInstances), clst.batch)
 		log.Logger.Infof("Extend the size of the cluster.. current size: %d", clst.size)
-		if clst.size+1 > defaultClusterSize {
-			if err := r.optimizeClusterSize(clst, clst.size+1); err != nil {
+		if clst.size+surge > defaultClusterSize {
+			if err := r.deploy.Enter(fsm.Surging); err != nil {
+				return err
+			}
+			if err := r.optimizeClusterSize(clst, clst.size+surge); err != nil {
 				return xerrors.Errorf("Failed to increase asg size: %w", err)
 			}
-		} else if clst.size+1 <= defaultClusterSize {
+		} else if clst.size+surge <= defaultClusterSize {
+			if err := r.deploy.Enter(fsm.WaitingForCapacity); err != nil {
+				return err
+			}
 			if err := r.waitInstanceRunning(clst, defaultClusterSize); err != nil {
 				return xerrors.Errorf("Failed to execute waiter: %w", err)
 			}
@@ -64,55 +134,46 @@ func (r *Replacer) ReplaceInstance(c *config.Config) error {
 			return xerrors.Errorf("Failed to refresh cluster status: %w", err)
 		}
 	}
+	if err := r.checkpoint(stepSurged); err != nil {
+		return err
+	}
 
-	if len(clst.ecsInstance) != 0 && state == "closed" {
+	if len(clst.ecsInstance) != 0 {
 		if err := r.swapInstance(clst); err != nil {
 			return xerrors.Errorf("Failed to swap cluster instance: %w", err)
 		}
 	}
+	if err := r.checkpoint(stepSwapped); err != nil {
+		return err
+	}
 
-	state = r.deploy.FSM.Current()
-	if state != "closed" {
-		return fmt.Errorf("Cluster is not steady state")
-	} else if state == "closed" {
-		if err := r.optimizeClusterSize(clst, defaultClusterSize); err != nil {
-			return xerrors.Errorf("Failed to decrease asg size: %w", err)
-		}
-		log.Logger.Info("Successfully restored the size of the cluster")
-
+	if err := r.deploy.Enter(fsm.Shrinking); err != nil {
+		return err
 	}
-	return nil
+	if err := r.optimizeClusterSize(clst, defaultClusterSize); err != nil {
+		return xerrors.Errorf("Failed to decrease asg size: %w", err)
+	}
+	log.Logger.Info("Successfully restored the size of the cluster")
+	if err := r.deploy.Enter(fsm.Done); err != nil {
+		return err
+	}
+	return r.checkpoint(stepDone)
 }
 
-//RemoveSnapShots removes obsolete snapshots.
+//RemoveSnapShots removes, archives or recycles obsolete snapshots depending on c.Action.
 func (r *Replacer) RemoveSnapShots(c *config.Config) error {
 
-	dryrun = c.Dryrun
-	result, err := r.searchSnapshot(c.Owner)
+	r.dryrun = c.Dryrun
+	result, skipped, err := r.snapshotsToProcess(c)
 	if err != nil {
-		return xerrors.Errorf("Failed to search unused instance: %w", err)
+		return xerrors.Errorf("Failed to search unused snapshots: %w", err)
 	}
-	sort.Sort(apis.VolumeSlice(result))
-	length := apis.VolumeSlice(result).Len()
-	for i := 0; i < length; i++ {
-		id := *result[i].SnapshotId
-		snaps, err := r.imageExists(id)
-		if err != nil {
-			return xerrors.Errorf("Failed to get existing image: %w", err)
-		}
-		if snaps.Images == nil {
-			volumes, err := r.volumeExists(id)
-			if err != nil {
-				return xerrors.Errorf("Failed to get existing volume: %w", err)
-			}
-			if len(volumes) == 0 {
-				log.Logger.Infof("Delete snapshot: %v", id)
-				_, err := r.deleteSnapshot(id)
-				if err != nil {
-					return xerrors.Errorf("Failed to delete snapshot: %w", err)
-				}
-			}
-		}
+	if len(skipped) != 0 {
+		log.Logger.Infof("Skip %d snapshots", len(skipped))
+	}
+	r.result.SkippedSnapshots = append(r.result.SkippedSnapshots, skipped...)
+	if err := newSnapshotDeleter(r, c).deleteAll(result); err != nil {
+		return xerrors.Errorf("Failed to process snapshots: %w", err)
 	}
 	return nil
 }
@@ -120,7 +181,7 @@ func (r *Replacer) RemoveSnapShots(c *config.Config) error {
 //RemoveAMIs removes obsolete AMIs
 func (r *Replacer) RemoveAMIs(c *config.Config) error {
 
-	dryrun = c.Dryrun
+	r.dryrun = c.Dryrun
 	output, err := r.deregisterAMI(c)
 	_ = output
 	if err != nil {
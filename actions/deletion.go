@@ -0,0 +1,238 @@
+package actions
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/cenkalti/backoff"
+	"github.com/nest-egg/ami-replacer/config"
+	"github.com/nest-egg/ami-replacer/log"
+	"golang.org/x/xerrors"
+)
+
+// errorClass tells how rms handles a failed DeleteSnapshot.
+type errorClass int
+
+const (
+	// errorFailed fails the snapshot, other snapshots are still deleted.
+	errorFailed errorClass = iota
+	// errorRetryable is retried with exponential backoff.
+	errorRetryable
+	// errorSkippable keeps the snapshot without failing, e.g. when it has just come into use.
+	errorSkippable
+	// errorFatal fails the snapshot and stops deleting any more.
+	errorFatal
+)
+
+// Error codes of DeleteSnapshot and ModifySnapshotTier by class. Codes not listed fail the snapshot.
+var errorClasses = map[string]errorClass{
+	"RequestLimitExceeded":     errorRetryable,
+	"Throttling":               errorRetryable,
+	"ThrottlingException":      errorRetryable,
+	"InternalError":            errorRetryable,
+	"ServiceUnavailable":       errorRetryable,
+	"Unavailable":              errorRetryable,
+	"InvalidSnapshot.InUse":    errorSkippable,
+	"InvalidSnapshot.NotFound": errorSkippable,
+	"IncorrectState":           errorSkippable,
+	"AuthFailure":              errorFatal,
+	"UnauthorizedOperation":    errorFatal,
+	"ExpiredToken":             errorFatal,
+	"RequestExpired":           errorFatal,
+	"InvalidClientTokenId":     errorFatal,
+}
+
+// classify returns the class of err and its aws error code, if any.
+func classify(err error) (errorClass, string) {
+	var aerr awserr.Error
+	if !xerrors.As(err, &aerr) {
+		return errorFailed, ""
+	}
+	return errorClasses[aerr.Code()], aerr.Code()
+}
+
+// snapshotFailure is a snapshot rms failed to delete.
+type snapshotFailure struct {
+	snapshotID string
+	err        error
+}
+
+// DeletionError lists every snapshot rms failed to delete or archive.
+type DeletionError struct {
+	Action   string
+	Total    int
+	failures []snapshotFailure
+}
+
+func (e *DeletionError) Error() string {
+	msgs := make([]string, 0, len(e.failures))
+	for _, f := range e.failures {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", f.snapshotID, f.err))
+	}
+	return fmt.Sprintf("failed to %s %d of %d snapshots: %s", e.Action, len(e.failures), e.Total, strings.Join(msgs, "; "))
+}
+
+// SnapshotIDs returns the snapshots rms failed to delete.
+func (e *DeletionError) SnapshotIDs() []string {
+	ids := make([]string, 0, len(e.failures))
+	for _, f := range e.failures {
+		ids = append(ids, f.snapshotID)
+	}
+	return ids
+}
+
+// snapshotVerbs words the logs of each rms action.
+var snapshotVerbs = map[string]struct{ done, would, fail string }{
+	config.ActionDelete:  {"Deleted", "Would delete", "delete"},
+	config.ActionArchive: {"Archived", "Would archive", "archive"},
+	config.ActionRecycle: {"Recycled", "Would recycle", "recycle"},
+}
+
+// snapshotDeleter deletes or archives snapshots with a bounded pool of workers sharing a rate limit.
+type snapshotDeleter struct {
+	r       *Replacer
+	action  string
+	workers int
+	limiter *tokenBucket
+	backOff func() backoff.BackOff
+}
+
+func newSnapshotDeleter(r *Replacer, c *config.Config) *snapshotDeleter {
+	workers := c.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	action := c.Action
+	if action == "" {
+		action = config.ActionDelete
+	}
+	return &snapshotDeleter{
+		r:       r,
+		action:  action,
+		workers: workers,
+		limiter: newTokenBucket(c.RateLimit, workers),
+		backOff: func() backoff.BackOff {
+			b := backoff.NewExponentialBackOff()
+			b.InitialInterval = time.Duration(1) * time.Second
+			b.MaxInterval = time.Duration(20) * time.Second
+			b.MaxElapsedTime = time.Duration(120) * time.Second
+			b.Reset()
+			return b
+		},
+	}
+}
+
+// deletion is the outcome of deleting one snapshot.
+type deletion struct {
+	deleted bool
+	skipped string
+	err     error
+}
+
+// deleteAll deletes or archives snapshots and records them with the action taken, continuing past failures.
+// A fatal error stops handing out snapshots, those not attempted yet are kept.
+// It returns a *DeletionError listing every failure.
+func (d *snapshotDeleter) deleteAll(snapshots []*ec2.Snapshot) error {
+
+	ctx, cancel := context.WithCancel(d.r.ctx)
+	defer cancel()
+
+	outcomes := make([]deletion, len(snapshots))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < d.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				outcomes[i] = d.delete(ctx, aws.StringValue(snapshots[i].SnapshotId))
+				if class, _ := classify(outcomes[i].err); class == errorFatal {
+					cancel()
+				}
+			}
+		}()
+	}
+dispatch:
+	for i := range snapshots {
+		select {
+		case <-ctx.Done():
+			break dispatch
+		case jobs <- i:
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	derr := &DeletionError{Action: d.action, Total: len(snapshots)}
+	for i, o := range outcomes {
+		switch {
+		case o.deleted:
+			summary := summarizeSnapshot(snapshots[i])
+			summary.Action = d.action
+			d.r.result.Snapshots = append(d.r.result.Snapshots, summary)
+		case o.skipped != "":
+			d.r.result.SkippedSnapshots = append(d.r.result.SkippedSnapshots, SkippedSnapshot{
+				SnapshotID: aws.StringValue(snapshots[i].SnapshotId),
+				Reason:     o.skipped,
+			})
+		case o.err != nil:
+			derr.failures = append(derr.failures, snapshotFailure{aws.StringValue(snapshots[i].SnapshotId), o.err})
+		}
+	}
+	if len(derr.failures) != 0 {
+		return derr
+	}
+	return nil
+}
+
+// apply deletes or archives a snapshot depending on the action.
+func (d *snapshotDeleter) apply(id string) error {
+	if d.action == config.ActionArchive {
+		_, err := d.r.archiveSnapshot(id)
+		return err
+	}
+	_, err := d.r.deleteSnapshot(id)
+	return err
+}
+
+// delete applies the action to a snapshot once a token is available, retrying retryable errors.
+func (d *snapshotDeleter) delete(ctx context.Context, id string) deletion {
+
+	verb := snapshotVerbs[d.action]
+	var result deletion
+	attempt := func() error {
+		if err := d.limiter.wait(ctx); err != nil {
+			return backoff.Permanent(err)
+		}
+		err := d.apply(id)
+		class, code := classify(err)
+		switch {
+		case err == nil:
+			log.Logger.Infof("%s snapshot: %v", verb.done, id)
+			result.deleted = true
+		case code == "DryRunOperation":
+			log.Logger.Infof("%s snapshot: %v", verb.would, id)
+			result.deleted = true
+		case class == errorRetryable:
+			log.Logger.Warnf("Retry to %s snapshot %s: %v", verb.fail, id, code)
+			return err
+		case class == errorSkippable:
+			log.Logger.Infof("Skip snapshot %s: %s", id, code)
+			result.skipped = code
+		default:
+			log.Logger.Errorf("Failed to %s snapshot %s: %v", verb.fail, id, err)
+			return backoff.Permanent(err)
+		}
+		return nil
+	}
+	if err := backoff.Retry(attempt, backoff.WithContext(d.backOff(), ctx)); err != nil {
+		result.err = err
+	}
+	return result
+}
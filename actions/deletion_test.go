@@ -0,0 +1,157 @@
+package actions
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/cenkalti/backoff"
+	"github.com/nest-egg/ami-replacer/config"
+	"golang.org/x/xerrors"
+)
+
+func TestDeletion_classify(t *testing.T) {
+	testCases := []struct {
+		name string
+		err  error
+		want errorClass
+	}{
+		{
+			name: "throttled",
+			err:  xerrors.Errorf("Failed to delete snapshot: %w", awserr.New("RequestLimitExceeded", "", nil)),
+			want: errorRetryable,
+		},
+		{
+			name: "in_use",
+			err:  xerrors.Errorf("Failed to delete snapshot: %w", awserr.New("InvalidSnapshot.InUse", "", nil)),
+			want: errorSkippable,
+		},
+		{
+			name: "unauthorized",
+			err:  awserr.New("UnauthorizedOperation", "", nil),
+			want: errorFatal,
+		},
+		{
+			name: "tier_changed",
+			err:  xerrors.Errorf("Failed to archive snapshot: %w", awserr.New("IncorrectState", "", nil)),
+			want: errorSkippable,
+		},
+		{
+			name: "unknown_code",
+			err:  awserr.New("InvalidParameterValue", "", nil),
+			want: errorFailed,
+		},
+		{
+			name: "not_aws",
+			err:  fmt.Errorf("connection reset"),
+			want: errorFailed,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got, _ := classify(tc.err); got != tc.want {
+				t.Errorf("got: %v\nwant: %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDeletion_deleteAll(t *testing.T) {
+	testCases := []struct {
+		name        string
+		workers     int
+		snapshots   []string
+		wantDeleted []string
+		wantSkipped []string
+		wantFailed  []string
+	}{
+		{
+			name:        "ok",
+			workers:     4,
+			snapshots:   []string{"snap-1", "snap-2", "snap-dryrun", "snap-3"},
+			wantDeleted: []string{"snap-1", "snap-2", "snap-dryrun", "snap-3"},
+		},
+		{
+			name:        "continue_past_failures",
+			workers:     4,
+			snapshots:   []string{"snap-1", "snap-inuse", "snap-throttled", "error", "snap-2"},
+			wantDeleted: []string{"snap-1", "snap-2"},
+			wantSkipped: []string{"snap-inuse"},
+			wantFailed:  []string{"snap-throttled", "error"},
+		},
+		{
+			name:        "stop_on_fatal",
+			workers:     1,
+			snapshots:   []string{"snap-1", "snap-denied", "snap-2", "snap-3"},
+			wantDeleted: []string{"snap-1"},
+			wantFailed:  []string{"snap-denied"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockreplacer := NewMockReplacer(
+				context.Background(),
+				"ap-northeast-1",
+				"admin",
+			)
+			res := &Result{}
+			mockreplacer.Record(res)
+			d := newSnapshotDeleter(mockreplacer, &config.Config{Workers: tc.workers})
+			d.backOff = func() backoff.BackOff { return backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 2) }
+			var snapshots []*ec2.Snapshot
+			for _, id := range tc.snapshots {
+				snapshots = append(snapshots, &ec2.Snapshot{SnapshotId: aws.String(id)})
+			}
+
+			err := d.deleteAll(snapshots)
+			var failed []string
+			if err != nil {
+				var derr *DeletionError
+				if !xerrors.As(err, &derr) {
+					t.Fatalf("got: %v\nwant: *DeletionError", err)
+				}
+				failed = derr.SnapshotIDs()
+			}
+			if !reflect.DeepEqual(failed, tc.wantFailed) {
+				t.Errorf("failed got: %v\nwant: %v", failed, tc.wantFailed)
+			}
+			var deleted, skipped []string
+			for _, s := range res.Snapshots {
+				deleted = append(deleted, s.SnapshotID)
+			}
+			for _, s := range res.SkippedSnapshots {
+				skipped = append(skipped, s.SnapshotID)
+			}
+			if !reflect.DeepEqual(deleted, tc.wantDeleted) {
+				t.Errorf("deleted got: %v\nwant: %v", deleted, tc.wantDeleted)
+			}
+			if !reflect.DeepEqual(skipped, tc.wantSkipped) {
+				t.Errorf("skipped got: %v\nwant: %v", skipped, tc.wantSkipped)
+			}
+		})
+	}
+}
+
+func TestDeletion_tokenBucket(t *testing.T) {
+	b := newTokenBucket(100, 1)
+	start := time.Now()
+	for i := 0; i < 11; i++ {
+		if err := b.wait(context.Background()); err != nil {
+			t.Fatalf("got: %v\nwant: %v", err, nil)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("got: %s\nwant: at least 100ms for 10 tokens at 100/s", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := newTokenBucket(1, 1).wait(ctx); err == nil {
+		t.Errorf("got: %v\nwant: context canceled", err)
+	}
+}
@@ -0,0 +1,155 @@
+package actions
+
+import (
+	"encoding/base64"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/nest-egg/ami-replacer/config"
+	"github.com/nest-egg/ami-replacer/log"
+	"golang.org/x/xerrors"
+)
+
+var ecsClusterRegex = regexp.MustCompile(`(?m)ECS_CLUSTER=["']?([\w-]+)`)
+
+// DiscoverTargets resolves asgs matching every tag of c.AsgTags into one config per asg.
+// The ecs cluster is read from the c.ClusterTag tag of the asg, or from
+// the ECS_CLUSTER line of the launch template user data.
+func (r *Replacer) DiscoverTargets(c *config.Config) ([]*config.Config, error) {
+
+	filters, err := config.ParseTagFilters(c.AsgTags)
+	if err != nil {
+		return nil, xerrors.Errorf("Invalid asg tag: %w", err)
+	}
+
+	groups, err := r.allAsgs(asgFilters(filters))
+	if err != nil {
+		return nil, xerrors.Errorf("Failed to list asgs: %w", err)
+	}
+
+	var confs []*config.Config
+	for _, g := range groups {
+		asgname := aws.StringValue(g.AutoScalingGroupName)
+		clustername, err := r.asgCluster(g, c.ClusterTag)
+		if err != nil {
+			return nil, xerrors.Errorf("Failed to get ecs cluster of asg %s: %w", asgname, err)
+		}
+		log.Logger.Infof("Discovered asg %s in ecs cluster %s", asgname, clustername)
+
+		conf := *c
+		conf.Name = asgname
+		conf.Asgname = asgname
+		conf.Clustername = clustername
+		conf.AsgTags = nil
+		confs = append(confs, &conf)
+	}
+
+	if len(confs) == 0 {
+		return nil, xerrors.Errorf("No asg matches tags %v", c.AsgTags)
+	}
+	return confs, nil
+}
+
+// allAsgs lists asgs matching every filter, or all asgs without filters.
+func (r *Replacer) allAsgs(filters []*autoscaling.Filter) ([]*autoscaling.Group, error) {
+
+	results := []*autoscaling.Group{}
+	var nextToken *string
+
+	params := &autoscaling.DescribeAutoScalingGroupsInput{}
+	if len(filters) > 0 {
+		params.Filters = filters
+	}
+	for {
+		output, err := r.asg.AsgAPI.DescribeAutoScalingGroups(params)
+		if err != nil {
+			return nil, xerrors.Errorf("Failed to describe asg groups: %w", err)
+		}
+		results = append(results, output.AutoScalingGroups...)
+		nextToken = output.NextToken
+		if aws.StringValue(nextToken) == "" {
+			break
+		}
+		params.NextToken = nextToken
+	}
+	return results, nil
+}
+
+// asgFilters turns tag filters into DescribeAutoScalingGroups filters
+// so that asgs are filtered by the api instead of listing every asg.
+func asgFilters(tags []config.TagFilter) []*autoscaling.Filter {
+	var filters []*autoscaling.Filter
+	for _, tag := range tags {
+		if tag.AnyValue {
+			filters = append(filters, &autoscaling.Filter{
+				Name:   aws.String("tag-key"),
+				Values: []*string{aws.String(tag.Key)},
+			})
+			continue
+		}
+		filters = append(filters, &autoscaling.Filter{
+			Name:   aws.String("tag:" + tag.Key),
+			Values: []*string{aws.String(tag.Value)},
+		})
+	}
+	return filters
+}
+
+func asgTags(g *autoscaling.Group) map[string]string {
+	tags := make(map[string]string, len(g.Tags))
+	for _, t := range g.Tags {
+		tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	return tags
+}
+
+func (r *Replacer) asgCluster(g *autoscaling.Group, clusterTag string) (string, error) {
+
+	if clusterTag != "" {
+		if name := asgTags(g)[clusterTag]; name != "" {
+			return name, nil
+		}
+	}
+
+	spec := g.LaunchTemplate
+	if spec == nil && g.MixedInstancesPolicy != nil && g.MixedInstancesPolicy.LaunchTemplate != nil {
+		spec = g.MixedInstancesPolicy.LaunchTemplate.LaunchTemplateSpecification
+	}
+	if spec == nil {
+		return "", xerrors.Errorf("Asg has neither tag %s nor launch template", clusterTag)
+	}
+
+	version := aws.StringValue(spec.Version)
+	if version == "" {
+		version = "$Default"
+	}
+	params := &ec2.DescribeLaunchTemplateVersionsInput{
+		Versions: []*string{aws.String(version)},
+	}
+	if spec.LaunchTemplateId != nil {
+		params.LaunchTemplateId = spec.LaunchTemplateId
+	} else {
+		params.LaunchTemplateName = spec.LaunchTemplateName
+	}
+	output, err := r.asg.Ec2Api.DescribeLaunchTemplateVersions(params)
+	if err != nil {
+		return "", xerrors.Errorf("Failed to describe launch templates: %w", err)
+	}
+	if len(output.LaunchTemplateVersions) == 0 || output.LaunchTemplateVersions[0].LaunchTemplateData == nil {
+		return "", xerrors.New("Launch template version not found")
+	}
+
+	userdata, err := base64.StdEncoding.DecodeString(
+		aws.StringValue(output.LaunchTemplateVersions[0].LaunchTemplateData.UserData))
+	if err != nil {
+		return "", xerrors.Errorf("Failed to decode user data: %w", err)
+	}
+	m := ecsClusterRegex.FindStringSubmatch(string(userdata))
+	if m == nil {
+		return "", xerrors.Errorf("Neither tag %s nor ECS_CLUSTER in user data found", clusterTag)
+	}
+	return strings.TrimSpace(m[1]), nil
+}
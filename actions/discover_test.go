@@ -0,0 +1,105 @@
+package actions
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/nest-egg/ami-replacer/config"
+)
+
+func TestDiscover_DiscoverTargets(t *testing.T) {
+	region := "ap-northeast-1"
+	profile := "admin"
+	testCases := []struct {
+		name       string
+		asgTags    []string
+		clusterTag string
+		want       map[string]string
+		shouldErr  bool
+	}{
+		{
+			name:       "ok",
+			asgTags:    []string{"ami-replacer/managed=true"},
+			clusterTag: "ami-replacer/cluster",
+			want: map[string]string{
+				"api-asg":    "api-cluster",
+				"worker-asg": "worker-cluster",
+			},
+		},
+		{
+			name:       "any_value",
+			asgTags:    []string{"ami-replacer/cluster"},
+			clusterTag: "ami-replacer/cluster",
+			want: map[string]string{
+				"api-asg": "api-cluster",
+			},
+		},
+		{
+			name:       "no_match",
+			asgTags:    []string{"ami-replacer/managed=false"},
+			clusterTag: "ami-replacer/cluster",
+			shouldErr:  true,
+		},
+		{
+			name:       "no_cluster",
+			asgTags:    []string{"broken=true"},
+			clusterTag: "ami-replacer/cluster",
+			shouldErr:  true,
+		},
+		{
+			name:      "invalid_tag",
+			asgTags:   []string{"=true"},
+			shouldErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockreplacer := NewMockReplacer(
+				context.Background(),
+				region,
+				profile,
+			)
+			conf := &config.Config{
+				AsgTags:    tc.asgTags,
+				ClusterTag: tc.clusterTag,
+			}
+			confs, err := mockreplacer.DiscoverTargets(conf)
+			if err == nil && tc.shouldErr {
+				t.Errorf("should raise error: %v", err)
+			}
+			if err != nil && !tc.shouldErr {
+				t.Errorf("got: %v\nwant: %v", err, nil)
+			}
+			if tc.shouldErr {
+				return
+			}
+			got := map[string]string{}
+			for _, c := range confs {
+				got[c.Asgname] = c.Clustername
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got: %v\nwant: %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDiscover_asgFilters(t *testing.T) {
+	tags, err := config.ParseTagFilters([]string{"ami-replacer/managed=true", "ami-replacer/cluster"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string][]string{}
+	for _, f := range asgFilters(tags) {
+		got[aws.StringValue(f.Name)] = aws.StringValueSlice(f.Values)
+	}
+	want := map[string][]string{
+		"tag:ami-replacer/managed": {"true"},
+		"tag-key":                  {"ami-replacer/cluster"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v\nwant: %v", got, want)
+	}
+}
@@ -16,7 +16,9 @@ type cluster struct {
 	unusedInstances []string
 	freeInstances   []Instance
 	size            int
-	asg             asg
+	// batch is the number of instances drained and terminated together.
+	batch int
+	asg   asg
 }
 
 type asg struct {
@@ -39,9 +41,6 @@ func (r *Replacer) setClusterStatus(c *config.Config) (*cluster, error) {
 	num := asgSize(asginfo)
 	clusterSize := asgSize(asginfo)
 	maxnum := int(*asginfo[0].MaxSize)
-	if maxnum < num+1 {
-		return nil, xerrors.New("Max size of asg should be set to at least current size +1")
-	}
 
 	clst := &cluster{
 		name: c.Clustername,
@@ -53,6 +52,18 @@ func (r *Replacer) setClusterStatus(c *config.Config) (*cluster, error) {
 	if err != nil {
 		return nil, xerrors.Errorf("Failed to get instances to replace: %w", err)
 	}
+	// a resumed run may have surged the asg already.
+	base := num
+	if r.run != nil && r.run.ClusterSize != 0 {
+		base = r.run.ClusterSize
+	}
+	clst.batch = c.Batch(base)
+	if n := len(obsoleteInstances(ecsInstance, newestimage)); n != 0 && n < clst.batch {
+		clst.batch = n
+	}
+	if maxnum < base+clst.batch {
+		return nil, xerrors.Errorf("Max size of asg should be set to at least current size +%d", clst.batch)
+	}
 	unusedInstances, err := r.unusedInstance(clst)
 	if err != nil {
 		return nil, xerrors.Errorf("Failed to get unused instances with newest ami: %w", err)
@@ -136,14 +147,20 @@ func (r *Replacer) ecsInstanceStatus(clustername string, instances []string) (ou
 	return output, err
 }
 
-func (r *Replacer) drainInstance(inst Instance) (*ecs.UpdateContainerInstancesStateOutput, error) {
+// drainInstances drains a batch of container instances of one cluster together
+// and waits until their tasks have moved to other instances.
+func (r *Replacer) drainInstances(clustername string, insts []Instance) (*ecs.UpdateContainerInstancesStateOutput, error) {
 
+	var arns []string
+	var ids []string
+	for _, inst := range insts {
+		arns = append(arns, inst.InstanceArn)
+		ids = append(ids, inst.InstanceID)
+	}
 	params := &ecs.UpdateContainerInstancesStateInput{
-		Cluster: aws.String(inst.Cluster),
-		ContainerInstances: []*string{
-			aws.String(inst.InstanceArn),
-		},
-		Status: aws.String("DRAINING"),
+		Cluster:            aws.String(clustername),
+		ContainerInstances: aws.StringSlice(arns),
+		Status:             aws.String("DRAINING"),
 	}
 	result, err := r.asg.EcsAPI.UpdateContainerInstancesState(params)
 	if err != nil {
@@ -154,7 +171,7 @@ func (r *Replacer) drainInstance(inst Instance) (*ecs.UpdateContainerInstancesSt
 	bf := backoff.WithMaxRetries(b, 50)
 
 	counter := func() error {
-		status, err := r.clusterStatus(inst.Cluster)
+		status, err := r.clusterStatus(clustername)
 		if err != nil {
 			return xerrors.Errorf("Failed to get cluster status: %w", err)
 		}
@@ -170,7 +187,7 @@ func (r *Replacer) drainInstance(inst Instance) (*ecs.UpdateContainerInstancesSt
 		return nil, xerrors.New("Waiter has timed out")
 	}
 
-	log.Logger.Infof("ECS instances %s has been successfully drained", inst.InstanceID)
+	log.Logger.Infof("ECS instances %v have been successfully drained", ids)
 	return result, nil
 }
 
@@ -0,0 +1,196 @@
+package actions
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/nest-egg/ami-replacer/log"
+	"golang.org/x/xerrors"
+)
+
+// SkippedImage is an AMI excluded from deregistration.
+type SkippedImage struct {
+	ImageID string `json:"image_id" yaml:"image_id"`
+	Name    string `json:"name" yaml:"name"`
+	Reason  string `json:"reason" yaml:"reason"`
+	Region  string `json:"region,omitempty" yaml:"region,omitempty"`
+}
+
+// imageRefs maps image ids to the resources referencing them.
+type imageRefs map[string][]string
+
+func (refs imageRefs) add(imageid string, resource string) {
+	if imageid == "" {
+		return
+	}
+	refs[imageid] = append(refs[imageid], resource)
+}
+
+// excludeInUse splits images into images no resource references
+// and skipped images still referenced by an instance, a launch template
+// version, a launch configuration or an asg.
+func (r *Replacer) excludeInUse(images []*ec2.Image) ([]*ec2.Image, []SkippedImage, error) {
+
+	if len(images) == 0 {
+		return nil, nil, nil
+	}
+	refs, err := r.imagesInUse()
+	if err != nil {
+		return nil, nil, xerrors.Errorf("Failed to get images in use: %w", err)
+	}
+
+	var free []*ec2.Image
+	var skipped []SkippedImage
+	for _, image := range images {
+		id := aws.StringValue(image.ImageId)
+		if len(refs[id]) == 0 {
+			free = append(free, image)
+			continue
+		}
+		log.Logger.Infof("Skip image %s still in use by %v", id, refs[id])
+		skipped = append(skipped, SkippedImage{
+			ImageID: id,
+			Name:    aws.StringValue(image.Name),
+			Reason:  "in use by " + strings.Join(refs[id], ", "),
+		})
+	}
+	return free, skipped, nil
+}
+
+func (r *Replacer) imagesInUse() (imageRefs, error) {
+
+	refs := imageRefs{}
+	if err := r.instanceImages(refs); err != nil {
+		return nil, err
+	}
+	if err := r.launchTemplateImages(refs); err != nil {
+		return nil, err
+	}
+	if err := r.launchConfigurationImages(refs); err != nil {
+		return nil, err
+	}
+	if err := r.asgImages(refs); err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+func (r *Replacer) instanceImages(refs imageRefs) error {
+
+	params := &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{{
+			Name:   aws.String("instance-state-name"),
+			Values: aws.StringSlice([]string{"pending", "running", "stopping", "stopped"}),
+		}},
+	}
+	for {
+		output, err := r.asg.Ec2Api.DescribeInstances(params)
+		if err != nil {
+			return xerrors.Errorf("Failed to describe instances: %w", err)
+		}
+		for _, res := range output.Reservations {
+			for _, inst := range res.Instances {
+				refs.add(aws.StringValue(inst.ImageId), "instance "+aws.StringValue(inst.InstanceId))
+			}
+		}
+		if aws.StringValue(output.NextToken) == "" {
+			break
+		}
+		params.NextToken = output.NextToken
+	}
+	return nil
+}
+
+func (r *Replacer) launchTemplateImages(refs imageRefs) error {
+
+	params := &ec2.DescribeLaunchTemplatesInput{}
+	for {
+		output, err := r.asg.Ec2Api.DescribeLaunchTemplates(params)
+		if err != nil {
+			return xerrors.Errorf("Failed to describe launch templates: %w", err)
+		}
+		for _, lt := range output.LaunchTemplates {
+			if err := r.launchTemplateVersionImages(refs, lt.LaunchTemplateId, "$Default", "$Latest"); err != nil {
+				return err
+			}
+		}
+		if aws.StringValue(output.NextToken) == "" {
+			break
+		}
+		params.NextToken = output.NextToken
+	}
+	return nil
+}
+
+func (r *Replacer) launchTemplateVersionImages(refs imageRefs, templateID *string, versions ...string) error {
+
+	output, err := r.asg.Ec2Api.DescribeLaunchTemplateVersions(&ec2.DescribeLaunchTemplateVersionsInput{
+		LaunchTemplateId: templateID,
+		Versions:         aws.StringSlice(versions),
+	})
+	if err != nil {
+		return xerrors.Errorf("Failed to describe launch template versions: %w", err)
+	}
+	for _, v := range output.LaunchTemplateVersions {
+		if v.LaunchTemplateData == nil {
+			continue
+		}
+		refs.add(aws.StringValue(v.LaunchTemplateData.ImageId),
+			fmt.Sprintf("launch template %s version %d", aws.StringValue(templateID), aws.Int64Value(v.VersionNumber)))
+	}
+	return nil
+}
+
+func (r *Replacer) launchConfigurationImages(refs imageRefs) error {
+
+	params := &autoscaling.DescribeLaunchConfigurationsInput{}
+	for {
+		output, err := r.asg.AsgAPI.DescribeLaunchConfigurations(params)
+		if err != nil {
+			return xerrors.Errorf("Failed to describe launch configurations: %w", err)
+		}
+		for _, lc := range output.LaunchConfigurations {
+			refs.add(aws.StringValue(lc.ImageId), "launch configuration "+aws.StringValue(lc.LaunchConfigurationName))
+		}
+		if aws.StringValue(output.NextToken) == "" {
+			break
+		}
+		params.NextToken = output.NextToken
+	}
+	return nil
+}
+
+// asgImages adds images of launch template versions pinned by asgs,
+// including the launch template of mixed instances policies.
+func (r *Replacer) asgImages(refs imageRefs) error {
+
+	groups, err := r.allAsgs(nil)
+	if err != nil {
+		return xerrors.Errorf("Failed to list asgs: %w", err)
+	}
+	for _, g := range groups {
+		spec := g.LaunchTemplate
+		if spec == nil && g.MixedInstancesPolicy != nil && g.MixedInstancesPolicy.LaunchTemplate != nil {
+			spec = g.MixedInstancesPolicy.LaunchTemplate.LaunchTemplateSpecification
+		}
+		if spec == nil || spec.LaunchTemplateId == nil {
+			continue
+		}
+		version := aws.StringValue(spec.Version)
+		if version == "" || version == "$Default" || version == "$Latest" {
+			// already covered by launchTemplateImages
+			continue
+		}
+		asgRefs := imageRefs{}
+		if err := r.launchTemplateVersionImages(asgRefs, spec.LaunchTemplateId, version); err != nil {
+			return err
+		}
+		for id := range asgRefs {
+			refs.add(id, "asg "+aws.StringValue(g.AutoScalingGroupName))
+		}
+	}
+	return nil
+}
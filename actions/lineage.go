@@ -0,0 +1,93 @@
+package actions
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/nest-egg/ami-replacer/config"
+	"golang.org/x/xerrors"
+)
+
+// LineageSummary counts the images retained and deleted in one lineage.
+type LineageSummary struct {
+	Lineage  string `json:"lineage" yaml:"lineage"`
+	Retained int    `json:"retained" yaml:"retained"`
+	Deleted  int    `json:"deleted" yaml:"deleted"`
+}
+
+// lineage is a group of images retention is applied to independently.
+type lineage struct {
+	name   string
+	images []*ec2.Image
+}
+
+// groupLineages splits images by c.LineageRegex or c.LineageTag, keeping
+// their order within each lineage. Images matching neither, or every image
+// when no grouping is configured, form the lineage named "".
+func groupLineages(images []*ec2.Image, c *config.Config) ([]*lineage, error) {
+
+	name := func(*ec2.Image) string { return "" }
+	switch {
+	case c.LineageRegex != "":
+		re, err := config.ParseLineageRegex(c.LineageRegex)
+		if err != nil {
+			return nil, xerrors.Errorf("Invalid lineage regex: %w", err)
+		}
+		group := 1
+		for i, n := range re.SubexpNames() {
+			if n == "lineage" {
+				group = i
+			}
+		}
+		name = func(image *ec2.Image) string {
+			m := re.FindStringSubmatch(aws.StringValue(image.Name))
+			if m == nil {
+				return ""
+			}
+			return m[group]
+		}
+	case c.LineageTag != "":
+		name = func(image *ec2.Image) string {
+			return imageTags(image)[c.LineageTag]
+		}
+	}
+
+	var groups []*lineage
+	index := map[string]*lineage{}
+	for _, image := range images {
+		n := name(image)
+		g, ok := index[n]
+		if !ok {
+			g = &lineage{name: n}
+			index[n] = g
+			groups = append(groups, g)
+		}
+		g.images = append(g.images, image)
+	}
+	return groups, nil
+}
+
+// summarizeLineages counts the deleted images of every lineage.
+// It returns nil unless lineage grouping is configured.
+func summarizeLineages(groups []*lineage, c *config.Config, deleted []*ec2.Image) []LineageSummary {
+
+	if c.LineageRegex == "" && c.LineageTag == "" {
+		return nil
+	}
+	ids := map[string]bool{}
+	for _, image := range deleted {
+		ids[aws.StringValue(image.ImageId)] = true
+	}
+	summaries := make([]LineageSummary, 0, len(groups))
+	for _, g := range groups {
+		s := LineageSummary{Lineage: g.name}
+		for _, image := range g.images {
+			if ids[aws.StringValue(image.ImageId)] {
+				s.Deleted++
+			} else {
+				s.Retained++
+			}
+		}
+		summaries = append(summaries, s)
+	}
+	return summaries
+}
@@ -0,0 +1,127 @@
+package actions
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/nest-egg/ami-replacer/apis"
+	"github.com/nest-egg/ami-replacer/config"
+)
+
+func TestLineage_groupLineages(t *testing.T) {
+	now := time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC)
+	image := func(name string, daysAgo int, lineage string) *ec2.Image {
+		img := &ec2.Image{
+			ImageId:      aws.String("ami-" + name),
+			Name:         aws.String(name),
+			CreationDate: aws.String(now.AddDate(0, 0, -daysAgo).Format(time.RFC3339)),
+		}
+		if lineage != "" {
+			img.Tags = []*ec2.Tag{{Key: aws.String("Lineage"), Value: aws.String(lineage)}}
+		}
+		return img
+	}
+	images := []*ec2.Image{
+		image("app-api-3", 1, "api"),
+		image("app-worker-2", 2, "worker"),
+		image("app-api-2", 3, "api"),
+		image("app-batch-1", 4, ""),
+		image("app-worker-1", 5, "worker"),
+		image("app-api-1", 6, "api"),
+	}
+	sort.Sort(apis.ImageSlice(images))
+
+	testCases := []struct {
+		name         string
+		conf         config.Config
+		wantOutdated []string
+		wantGroups   []LineageSummary
+	}{
+		{
+			name:         "no_grouping",
+			conf:         config.Config{Generation: 3},
+			wantOutdated: []string{"app-api-2", "app-batch-1", "app-worker-1", "app-api-1"},
+		},
+		{
+			name:         "regex",
+			conf:         config.Config{Generation: 2, LineageRegex: `^app-(\w+)-\d+$`},
+			wantOutdated: []string{"app-api-2", "app-api-1"},
+			wantGroups: []LineageSummary{
+				{Lineage: "api", Retained: 1, Deleted: 2},
+				{Lineage: "worker", Retained: 2},
+				{Lineage: "batch", Retained: 1},
+			},
+		},
+		{
+			name:         "named_group",
+			conf:         config.Config{Generation: 2, LineageRegex: `^(app)-(?P<lineage>\w+)-\d+$`},
+			wantOutdated: []string{"app-api-2", "app-api-1"},
+			wantGroups: []LineageSummary{
+				{Lineage: "api", Retained: 1, Deleted: 2},
+				{Lineage: "worker", Retained: 2},
+				{Lineage: "batch", Retained: 1},
+			},
+		},
+		{
+			name:         "tag",
+			conf:         config.Config{Generation: 2, LineageTag: "Lineage"},
+			wantOutdated: []string{"app-api-2", "app-api-1"},
+			wantGroups: []LineageSummary{
+				{Lineage: "api", Retained: 1, Deleted: 2},
+				{Lineage: "worker", Retained: 2},
+				{Lineage: "", Retained: 1},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			groups, err := groupLineages(images, &tc.conf)
+			if err != nil {
+				t.Fatalf("got: %v\nwant: %v", err, nil)
+			}
+			var outdatedImages []*ec2.Image
+			var got []string
+			for _, g := range groups {
+				for _, image := range outdated(g.images, &tc.conf, now) {
+					outdatedImages = append(outdatedImages, image)
+					got = append(got, *image.Name)
+				}
+			}
+			if !reflect.DeepEqual(got, tc.wantOutdated) {
+				t.Errorf("got: %v\nwant: %v", got, tc.wantOutdated)
+			}
+			summaries := summarizeLineages(groups, &tc.conf, outdatedImages)
+			if !reflect.DeepEqual(summaries, tc.wantGroups) && len(summaries)+len(tc.wantGroups) != 0 {
+				t.Errorf("got: %+v\nwant: %+v", summaries, tc.wantGroups)
+			}
+		})
+	}
+}
+
+func TestLineage_RemoveAMIs(t *testing.T) {
+	mockreplacer := NewMockReplacer(
+		context.Background(),
+		"ap-northeast-1",
+		"admin",
+	)
+	res := &Result{Target: "lineage"}
+	mockreplacer.Record(res)
+	conf := &config.Config{
+		Image:        "testimage*",
+		Owner:        "owner",
+		Generation:   2,
+		LineageRegex: `^(testimage)\d*$`,
+	}
+	if err := mockreplacer.RemoveAMIs(conf); err != nil {
+		t.Fatalf("got: %v\nwant: %v", err, nil)
+	}
+	want := []LineageSummary{{Lineage: "testimage", Retained: 2, Deleted: 1}}
+	if !reflect.DeepEqual(res.Lineages, want) {
+		t.Errorf("got: %+v\nwant: %+v", res.Lineages, want)
+	}
+}
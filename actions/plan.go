@@ -0,0 +1,275 @@
+package actions
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/nest-egg/ami-replacer/config"
+	"golang.org/x/xerrors"
+)
+
+// Plan lists every action rmi, rms and rpl would take for one target.
+// Computing a plan never calls a mutating api.
+type Plan struct {
+	Target           string              `json:"target" yaml:"target"`
+	Images           []ImageSummary      `json:"images,omitempty" yaml:"images,omitempty"`
+	SkippedImages    []SkippedImage      `json:"skipped_images,omitempty" yaml:"skipped_images,omitempty"`
+	Deprecate        []ImageSummary      `json:"deprecate,omitempty" yaml:"deprecate,omitempty"`
+	Restore          []ImageSummary      `json:"restore,omitempty" yaml:"restore,omitempty"`
+	Lineages         []LineageSummary    `json:"lineages,omitempty" yaml:"lineages,omitempty"`
+	Snapshots        []SnapshotSummary   `json:"snapshots,omitempty" yaml:"snapshots,omitempty"`
+	SkippedSnapshots []SkippedSnapshot   `json:"skipped_snapshots,omitempty" yaml:"skipped_snapshots,omitempty"`
+	Replace          *PlannedReplacement `json:"replace,omitempty" yaml:"replace,omitempty"`
+}
+
+// PlannedReplacement describes how rpl would roll an ecs cluster.
+type PlannedReplacement struct {
+	Asgname     string            `json:"asgname" yaml:"asgname"`
+	Clustername string            `json:"clustername" yaml:"clustername"`
+	NewestAMI   string            `json:"newest_ami" yaml:"newest_ami"`
+	UpToDate    bool              `json:"up_to_date" yaml:"up_to_date"`
+	Size        int               `json:"size" yaml:"size"`
+	SurgeSize   int               `json:"surge_size" yaml:"surge_size"`
+	BatchSize   int               `json:"batch_size" yaml:"batch_size"`
+	Template    *PlannedTemplate  `json:"template,omitempty" yaml:"template,omitempty"`
+	Terminate   []string          `json:"terminate,omitempty" yaml:"terminate,omitempty"`
+	Drain       []PlannedInstance `json:"drain,omitempty" yaml:"drain,omitempty"`
+}
+
+// PlannedTemplate is the launch template version rpl would create with the newest AMI.
+type PlannedTemplate struct {
+	ID            string `json:"id" yaml:"id"`
+	SourceVersion string `json:"source_version" yaml:"source_version"`
+	ImageID       string `json:"image_id" yaml:"image_id"`
+	Update        string `json:"update" yaml:"update"`
+}
+
+// PlannedInstance is a container instance rpl would drain and terminate.
+type PlannedInstance struct {
+	InstanceID   string `json:"instance_id" yaml:"instance_id"`
+	ImageID      string `json:"image_id" yaml:"image_id"`
+	RunningTasks int    `json:"running_tasks" yaml:"running_tasks"`
+}
+
+// PlanAMIs fills p.Images with the AMIs rmi would deregister
+// and p.SkippedImages with the outdated AMIs rmi would keep.
+// With c.DeleteSnapshots the unused snapshots of those AMIs are added to p.Snapshots.
+func (r *Replacer) PlanAMIs(c *config.Config, p *Plan) error {
+
+	if len(c.Regions) != 0 {
+		return r.planAcrossRegions(c, p)
+	}
+
+	images, groups, err := r.outdatedAMIs(c)
+	if err != nil {
+		return xerrors.Errorf("Failed to get outdated images: %w", err)
+	}
+	images, skipped, err := r.excludeKept(c, images)
+	if err != nil {
+		return err
+	}
+	if c.Retire {
+		var all []*ec2.Image
+		for _, g := range groups {
+			all = append(all, g.images...)
+		}
+		images = p.planRetirement(c, "", all, images)
+	}
+	p.Lineages = summarizeLineages(groups, c, images)
+	for _, image := range images {
+		summary, err := r.planImage(c, image)
+		if err != nil {
+			return err
+		}
+		p.Images = append(p.Images, summary)
+		if !c.DeleteSnapshots {
+			continue
+		}
+		imageid := aws.StringValue(image.ImageId)
+		for _, ebs := range imageSnapshots(image) {
+			inuse, err := r.snapshotInUse(aws.StringValue(ebs.SnapshotId), imageid)
+			if err != nil {
+				return err
+			}
+			if !inuse {
+				p.Snapshots = append(p.Snapshots, summarizeImageSnapshot(imageid, ebs))
+			}
+		}
+	}
+	p.SkippedImages = append(p.SkippedImages, skipped...)
+	return nil
+}
+
+// planRetirement fills p.Deprecate and p.Restore as rmi --retire would,
+// and returns the images rmi --retire would deregister.
+func (p *Plan) planRetirement(c *config.Config, region string, all []*ec2.Image, candidates []*ec2.Image) []*ec2.Image {
+
+	ret := retirementOf(all, candidates, time.Now())
+	deprecateAt := time.Now().Add(c.GracePeriod).UTC().Truncate(time.Minute)
+	for _, image := range ret.deprecate {
+		summary := summarizeImage(image)
+		summary.Region = region
+		summary.DeprecationTime = deprecateAt.Format(time.RFC3339)
+		p.Deprecate = append(p.Deprecate, summary)
+	}
+	for _, image := range ret.restore {
+		summary := summarizeImage(image)
+		summary.Region = region
+		p.Restore = append(p.Restore, summary)
+	}
+	for _, image := range ret.waiting {
+		image.Region = region
+		p.SkippedImages = append(p.SkippedImages, image)
+	}
+	return ret.deregister
+}
+
+// planImage summarizes an image to deregister, along with
+// the accounts it would be unshared from with c.ForceUnshare.
+func (r *Replacer) planImage(c *config.Config, image *ec2.Image) (ImageSummary, error) {
+
+	summary := summarizeImage(image)
+	if !c.ForceUnshare {
+		return summary, nil
+	}
+	perms, err := r.launchPermissions(aws.StringValue(image.ImageId))
+	if err != nil {
+		return summary, err
+	}
+	summary.Unshared = sharedWith(perms)
+	return summary, nil
+}
+
+// PlanSnapshots fills p.Snapshots with the snapshots rms would delete, archive or recycle.
+func (r *Replacer) PlanSnapshots(c *config.Config, p *Plan) error {
+
+	snapshots, skipped, err := r.snapshotsToProcess(c)
+	if err != nil {
+		return xerrors.Errorf("Failed to search unused snapshots: %w", err)
+	}
+	action := c.Action
+	if action == "" {
+		action = config.ActionDelete
+	}
+	p.SkippedSnapshots = append(p.SkippedSnapshots, skipped...)
+	for _, snapshot := range snapshots {
+		summary := summarizeSnapshot(snapshot)
+		summary.Action = action
+		p.Snapshots = append(p.Snapshots, summary)
+	}
+	return nil
+}
+
+// PlanReplacement fills p.Replace with the instances rpl would replace.
+func (r *Replacer) PlanReplacement(c *config.Config, p *Plan) error {
+
+	p.Replace = &PlannedReplacement{
+		Asgname:     c.Asgname,
+		Clustername: c.Clustername,
+	}
+	clst, err := r.setClusterStatus(c)
+	if xerrors.Is(err, ErrAlreadyNewest) {
+		p.Replace.UpToDate = true
+		return nil
+	}
+	if err != nil {
+		return xerrors.Errorf("Failed to set cluster status: %w", err)
+	}
+
+	p.Replace.NewestAMI = clst.asg.newestami
+	p.Replace.Size = clst.size
+	p.Replace.Terminate = clst.unusedInstances
+	p.Replace.BatchSize = clst.batch
+	if c.UpdateTemplate != "" {
+		id, source, err := r.launchTemplateSource(c, clst)
+		if err != nil {
+			return err
+		}
+		if aws.StringValue(source.LaunchTemplateData.ImageId) != clst.asg.newestami {
+			p.Replace.Template = &PlannedTemplate{
+				ID:            id,
+				SourceVersion: strconv.FormatInt(aws.Int64Value(source.VersionNumber), 10),
+				ImageID:       clst.asg.newestami,
+				Update:        c.UpdateTemplate,
+			}
+		}
+	}
+	if surge := clst.batch - len(clst.freeInstances); surge > 0 {
+		p.Replace.SurgeSize = clst.size + surge
+	}
+	for _, inst := range obsoleteInstances(clst.ecsInstance, clst.asg.newestami) {
+		p.Replace.Drain = append(p.Replace.Drain, PlannedInstance{
+			InstanceID:   inst.InstanceID,
+			ImageID:      inst.ImageID,
+			RunningTasks: inst.RunningTasks,
+		})
+	}
+	return nil
+}
+
+// Plans is the plan of every target of a run.
+type Plans []*Plan
+
+// WriteTable renders plans as human readable tables.
+func (plans Plans) WriteTable(w io.Writer) error {
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, p := range plans {
+		fmt.Fprintf(tw, "# %s\n", p.Target)
+		if len(p.Images) != 0 {
+			fmt.Fprintln(tw, "DEREGISTER IMAGE\tNAME\tCREATED")
+			for _, image := range p.Images {
+				fmt.Fprintf(tw, "%s\t%s\t%s\n", regionalID(image.Region, image.ImageID), image.Name, image.CreationDate)
+				if len(image.Unshared) != 0 {
+					fmt.Fprintf(tw, "\tunshare from %s\t\n", strings.Join(image.Unshared, ", "))
+				}
+			}
+		}
+		if len(p.SkippedImages) != 0 {
+			fmt.Fprintln(tw, "KEEP IMAGE\tNAME\tREASON")
+			for _, image := range p.SkippedImages {
+				fmt.Fprintf(tw, "%s\t%s\t%s\n", regionalID(image.Region, image.ImageID), image.Name, image.Reason)
+			}
+		}
+		writeRetirement(tw, "DEPRECATE IMAGE", "RESTORE IMAGE", p.Deprecate, p.Restore)
+		writeLineages(tw, p.Lineages)
+		writeSnapshots(tw, "SNAPSHOT", p.Snapshots)
+		writeSkippedSnapshots(tw, "KEEP SNAPSHOT", p.SkippedSnapshots)
+		if rpl := p.Replace; rpl != nil {
+			switch {
+			case rpl.UpToDate:
+				fmt.Fprintf(tw, "asg %s in cluster %s already runs the newest AMI\n", rpl.Asgname, rpl.Clustername)
+			default:
+				fmt.Fprintf(tw, "asg %s in cluster %s: newest AMI %s, size %d\n", rpl.Asgname, rpl.Clustername, rpl.NewestAMI, rpl.Size)
+				if t := rpl.Template; t != nil {
+					fmt.Fprintf(tw, "CREATE TEMPLATE VERSION\t%s from %s\t%s (%s)\n", t.ID, t.SourceVersion, t.ImageID, t.Update)
+				}
+				if rpl.SurgeSize != 0 {
+					fmt.Fprintf(tw, "SURGE ASG\t%d -> %d\t\n", rpl.Size, rpl.SurgeSize)
+				}
+				for _, id := range rpl.Terminate {
+					fmt.Fprintf(tw, "TERMINATE UNUSED\t%s\t\n", id)
+				}
+				for i, inst := range rpl.Drain {
+					batch := 1
+					if rpl.BatchSize > 0 {
+						batch = i/rpl.BatchSize + 1
+					}
+					fmt.Fprintf(tw, "DRAIN AND TERMINATE\t%s\t%s (%d tasks, batch %d)\n", inst.InstanceID, inst.ImageID, inst.RunningTasks, batch)
+				}
+				fmt.Fprintf(tw, "RESTORE ASG\t%d\t\n", rpl.Size)
+			}
+		}
+		if len(p.Images) == 0 && len(p.Snapshots) == 0 && len(p.Deprecate) == 0 && len(p.Restore) == 0 && p.Replace == nil {
+			fmt.Fprintln(tw, "nothing to do")
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,228 @@
+package actions
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nest-egg/ami-replacer/config"
+)
+
+func TestPlan_PlanAMIs(t *testing.T) {
+	region := "ap-northeast-1"
+	profile := "admin"
+	testCases := []struct {
+		name      string
+		image     string
+		gen       int
+		want      int
+		shouldErr bool
+	}{
+		{
+			name:  "ok",
+			image: "testimage*",
+			gen:   2,
+			want:  1,
+		},
+		{
+			name:  "no_outdated_images",
+			image: "testimage*",
+			gen:   3,
+			want:  0,
+		},
+		{
+			name:      "exec_error_DescribeImages",
+			image:     "error*",
+			gen:       2,
+			shouldErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockreplacer := NewMockReplacer(
+				context.Background(),
+				region,
+				profile,
+			)
+			conf := &config.Config{
+				Image:      tc.image,
+				Owner:      "owner",
+				Generation: tc.gen,
+			}
+			p := &Plan{Target: tc.name}
+			err := mockreplacer.PlanAMIs(conf, p)
+			if err == nil && tc.shouldErr {
+				t.Errorf("should raise error: %v", err)
+			}
+			if len(p.Images) != tc.want {
+				t.Errorf("got: %d images\nwant: %d images", len(p.Images), tc.want)
+			}
+		})
+	}
+}
+
+func TestPlan_PlanSnapshots(t *testing.T) {
+	region := "ap-northeast-1"
+	profile := "admin"
+	testCases := []struct {
+		name      string
+		owner     string
+		shouldErr bool
+	}{
+		{
+			name:  "ok",
+			owner: "ok",
+		},
+		{
+			name:      "error",
+			owner:     "error",
+			shouldErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockreplacer := NewMockReplacer(
+				context.Background(),
+				region,
+				profile,
+			)
+			p := &Plan{Target: tc.name}
+			err := mockreplacer.PlanSnapshots(&config.Config{Owner: tc.owner}, p)
+			if err == nil && tc.shouldErr {
+				t.Errorf("should raise error: %v", err)
+			}
+			if err != nil && !tc.shouldErr {
+				t.Errorf("got: %v\nwant: %v", err, nil)
+			}
+		})
+	}
+}
+
+func TestPlan_PlanReplacement(t *testing.T) {
+	region := "ap-northeast-1"
+	profile := "admin"
+	testCases := []struct {
+		name           string
+		asgname        string
+		clustername    string
+		batchSize      int
+		batchPercent   int
+		updateTemplate string
+		wantUpToDate   bool
+		wantTemplate   *PlannedTemplate
+		wantDrain      int
+		wantBatch      int
+		wantSurge      int
+		shouldErr      bool
+	}{
+		{
+			name:         "up_to_date",
+			clustername:  "test-cluster",
+			wantUpToDate: true,
+		},
+		{
+			name:        "obsolete",
+			clustername: "obsolete-cluster",
+			wantDrain:   1,
+			wantBatch:   1,
+			wantSurge:   3,
+		},
+		{
+			name:        "batch_size",
+			clustername: "obsolete-batch-cluster",
+			batchSize:   2,
+			wantDrain:   3,
+			wantBatch:   2,
+			wantSurge:   3,
+		},
+		{
+			name:        "batch_larger_than_obsolete",
+			clustername: "obsolete-batch-cluster",
+			batchSize:   5,
+			wantDrain:   3,
+			wantBatch:   3,
+			wantSurge:   4,
+		},
+		{
+			name:         "batch_percent",
+			clustername:  "obsolete-batch-cluster",
+			batchPercent: 50,
+			wantDrain:    3,
+			wantBatch:    1,
+		},
+		{
+			name:           "update_template",
+			asgname:        "obsolete-template-asg",
+			clustername:    "obsolete-cluster",
+			updateTemplate: config.TemplatePin,
+			wantDrain:      1,
+			wantBatch:      1,
+			wantSurge:      3,
+			wantTemplate:   &PlannedTemplate{ID: "obsolete", SourceVersion: "99", ImageID: "ami-00000000000000001", Update: config.TemplatePin},
+		},
+		{
+			name:           "template_already_newest",
+			clustername:    "obsolete-cluster",
+			updateTemplate: config.TemplateDefault,
+			wantDrain:      1,
+			wantBatch:      1,
+			wantSurge:      3,
+		},
+		{
+			name:        "exec_error_EcsInstanceStatus",
+			clustername: "error-cluster2",
+			shouldErr:   true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockreplacer := NewMockReplacer(
+				context.Background(),
+				region,
+				profile,
+			)
+			asgname := tc.asgname
+			if asgname == "" {
+				asgname = "ok"
+			}
+			conf := &config.Config{
+				Asgname:        asgname,
+				Clustername:    tc.clustername,
+				Image:          "testimage*",
+				Owner:          "owner",
+				BatchSize:      tc.batchSize,
+				BatchPercent:   tc.batchPercent,
+				UpdateTemplate: tc.updateTemplate,
+			}
+			p := &Plan{Target: tc.name}
+			err := mockreplacer.PlanReplacement(conf, p)
+			if err == nil && tc.shouldErr {
+				t.Errorf("should raise error: %v", err)
+			}
+			if tc.shouldErr {
+				return
+			}
+			if p.Replace.UpToDate != tc.wantUpToDate {
+				t.Errorf("got: %v\nwant: %v", p.Replace.UpToDate, tc.wantUpToDate)
+			}
+			if len(p.Replace.Drain) != tc.wantDrain {
+				t.Errorf("got: %d instances to drain\nwant: %d", len(p.Replace.Drain), tc.wantDrain)
+			}
+			if p.Replace.BatchSize != tc.wantBatch || p.Replace.SurgeSize != tc.wantSurge {
+				t.Errorf("got: batch %d, surge %d\nwant: batch %d, surge %d", p.Replace.BatchSize, p.Replace.SurgeSize, tc.wantBatch, tc.wantSurge)
+			}
+			if !reflect.DeepEqual(p.Replace.Template, tc.wantTemplate) {
+				t.Errorf("got: %+v\nwant: %+v", p.Replace.Template, tc.wantTemplate)
+			}
+			var buf bytes.Buffer
+			if err := (Plans{p}).WriteTable(&buf); err != nil || buf.Len() == 0 {
+				t.Errorf("failed to render plan: %v", err)
+			}
+			if tc.wantTemplate != nil && !strings.Contains(buf.String(), "CREATE TEMPLATE VERSION") {
+				t.Errorf("got: %s\nwant: the launch template version to create", buf.String())
+			}
+		})
+	}
+}
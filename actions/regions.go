@@ -0,0 +1,332 @@
+package actions
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/nest-egg/ami-replacer/apis"
+	"github.com/nest-egg/ami-replacer/config"
+	"github.com/nest-egg/ami-replacer/log"
+	"golang.org/x/xerrors"
+)
+
+// regionalAMIs are the AMIs of one region of a cross-region run.
+type regionalAMIs struct {
+	region     string
+	r          *Replacer
+	images     []*ec2.Image
+	deregister []*ec2.Image
+	skipped    []SkippedImage
+	// unsafe are the images of the region in use or shared, blocking their generation everywhere.
+	unsafe []SkippedImage
+}
+
+// inRegion returns a replacer for another region recording into its own result.
+func (r *Replacer) inRegion(region string) *Replacer {
+	return &Replacer{
+		ctx:    r.ctx,
+		deploy: r.deploy,
+		asg:    r.asg.inRegion(region),
+		dryrun: r.dryrun,
+		result: &Result{Target: region},
+	}
+}
+
+// resolveRegions expands config.AllRegions into every region enabled for the account.
+func (r *Replacer) resolveRegions(regions []string) ([]string, error) {
+
+	if len(regions) != 1 || regions[0] != config.AllRegions {
+		return regions, nil
+	}
+	output, err := r.asg.Ec2Api.DescribeRegions(&ec2.DescribeRegionsInput{})
+	if err != nil {
+		return nil, xerrors.Errorf("Failed to describe regions: %w", err)
+	}
+	var all []string
+	for _, region := range output.Regions {
+		all = append(all, aws.StringValue(region.RegionName))
+	}
+	sort.Strings(all)
+	return all, nil
+}
+
+// inParallel runs fn for every region at once and returns the first error.
+func inParallel(regions []*regionalAMIs, fn func(*regionalAMIs) error) error {
+
+	errs := make([]error, len(regions))
+	var wg sync.WaitGroup
+	for i, ra := range regions {
+		wg.Add(1)
+		go func(i int, ra *regionalAMIs) {
+			defer wg.Done()
+			if err := fn(ra); err != nil {
+				errs[i] = xerrors.Errorf("%s: %w", ra.region, err)
+			}
+		}(i, ra)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generationKey identifies the copies of one image across regions: the
+// c.SourceTag tag of a copy and the image id of the source image are equal.
+// Copies are matched by name without c.SourceTag.
+func generationKey(image *ec2.Image, c *config.Config) string {
+	if c.SourceTag != "" {
+		if source := imageTags(image)[c.SourceTag]; source != "" {
+			return source
+		}
+		return aws.StringValue(image.ImageId)
+	}
+	return aws.StringValue(image.Name)
+}
+
+// amisAcrossRegions applies the retention policy of c to generations of
+// images, each generation being an image and its copies in other regions.
+// A generation is outdated in every region or in none, and pinned in every
+// region when any of its copies is pinned, in use or shared.
+func (r *Replacer) amisAcrossRegions(c *config.Config) ([]*regionalAMIs, []LineageSummary, error) {
+
+	names, err := r.resolveRegions(c.Regions)
+	if err != nil {
+		return nil, nil, err
+	}
+	filters, err := imageFilters(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	regions := make([]*regionalAMIs, 0, len(names))
+	for _, name := range names {
+		regions = append(regions, &regionalAMIs{region: name, r: r.inRegion(name)})
+	}
+	err = inParallel(regions, func(ra *regionalAMIs) error {
+		output, err := ra.r.asg.Ec2Api.DescribeImages(&ec2.DescribeImagesInput{
+			Owners:  []*string{aws.String(c.Owner)},
+			Filters: filters,
+		})
+		if err != nil {
+			return xerrors.Errorf("Failed to describe images: %w", err)
+		}
+		ra.images = output.Images
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the oldest copy, usually the source image, stands for its generation.
+	generations := map[string]*ec2.Image{}
+	pinned := map[string][]SkippedImage{}
+	for _, ra := range regions {
+		_, skipped, err := excludePinned(c, ra.images)
+		if err != nil {
+			return nil, nil, err
+		}
+		pinnedImages := map[string]SkippedImage{}
+		for _, s := range skipped {
+			s.Region = ra.region
+			pinnedImages[s.ImageID] = s
+		}
+		for _, image := range ra.images {
+			key := generationKey(image, c)
+			if g, ok := generations[key]; !ok || apis.CreationTime(image).Before(apis.CreationTime(g)) {
+				generations[key] = image
+			}
+			if s, ok := pinnedImages[aws.StringValue(image.ImageId)]; ok {
+				pinned[key] = append(pinned[key], s)
+			}
+		}
+	}
+	var representatives []*ec2.Image
+	for _, image := range generations {
+		representatives = append(representatives, image)
+	}
+	sort.Sort(apis.ImageSlice(representatives))
+	groups, err := groupLineages(representatives, c)
+	if err != nil {
+		return nil, nil, err
+	}
+	outdatedKeys := map[string]bool{}
+	var outdatedImages []*ec2.Image
+	now := time.Now()
+	for _, g := range groups {
+		for _, image := range outdated(g.images, c, now) {
+			outdatedKeys[generationKey(image, c)] = true
+			outdatedImages = append(outdatedImages, image)
+		}
+	}
+
+	err = inParallel(regions, func(ra *regionalAMIs) error {
+		var candidates []*ec2.Image
+		for _, image := range ra.images {
+			key := generationKey(image, c)
+			if !outdatedKeys[key] {
+				continue
+			}
+			if by := pinned[key]; len(by) != 0 {
+				ra.skipped = append(ra.skipped, blockedImage(image, by[0], ra.region))
+				continue
+			}
+			candidates = append(candidates, image)
+		}
+		free, unsafe, err := ra.r.excludeUnsafe(c, candidates)
+		if err != nil {
+			return err
+		}
+		for i := range unsafe {
+			unsafe[i].Region = ra.region
+		}
+		ra.deregister = free
+		ra.unsafe = unsafe
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// a generation in use or shared in one region is kept in every region.
+	blocked := map[string]SkippedImage{}
+	for _, ra := range regions {
+		unsafe := map[string]SkippedImage{}
+		for _, s := range ra.unsafe {
+			unsafe[s.ImageID] = s
+		}
+		for _, image := range ra.images {
+			key := generationKey(image, c)
+			if s, ok := unsafe[aws.StringValue(image.ImageId)]; ok {
+				if _, ok := blocked[key]; !ok {
+					blocked[key] = s
+				}
+			}
+		}
+	}
+	for _, ra := range regions {
+		var free []*ec2.Image
+		for _, image := range ra.deregister {
+			if by, ok := blocked[generationKey(image, c)]; ok {
+				ra.skipped = append(ra.skipped, blockedImage(image, by, ra.region))
+				continue
+			}
+			free = append(free, image)
+		}
+		ra.deregister = free
+		ra.skipped = append(ra.skipped, ra.unsafe...)
+	}
+
+	var deleted []*ec2.Image
+	for _, image := range outdatedImages {
+		key := generationKey(image, c)
+		if _, ok := blocked[key]; len(pinned[key]) == 0 && !ok {
+			deleted = append(deleted, image)
+		}
+	}
+	return regions, summarizeLineages(groups, c, deleted), nil
+}
+
+// blockedImage skips image of region since a copy of its generation in another region is kept for the reason of by.
+func blockedImage(image *ec2.Image, by SkippedImage, region string) SkippedImage {
+	return SkippedImage{
+		ImageID: aws.StringValue(image.ImageId),
+		Name:    aws.StringValue(image.Name),
+		Reason:  "generation " + by.Reason + " in " + by.Region,
+		Region:  region,
+	}
+}
+
+// deregisterAcrossRegions deregisters outdated generations in every region of c.Regions in parallel.
+// A failing region does not abort the others.
+func (r *Replacer) deregisterAcrossRegions(c *config.Config) error {
+
+	regions, lineages, err := r.amisAcrossRegions(c)
+	if err != nil {
+		return err
+	}
+	errs := make([]error, len(regions))
+	var wg sync.WaitGroup
+	for i, ra := range regions {
+		wg.Add(1)
+		go func(i int, ra *regionalAMIs) {
+			defer wg.Done()
+			if c.Retire {
+				_, errs[i] = ra.r.retireImages(c, ra.images, ra.deregister)
+				return
+			}
+			log.Logger.Infof("Deregister %d images in %s", len(ra.deregister), ra.region)
+			errs[i] = ra.r.deregisterImages(c, ra.deregister)
+		}(i, ra)
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, ra := range regions {
+		r.recordRegion(ra)
+		if errs[i] != nil {
+			log.Logger.Errorf("Region %s failed: %+v", ra.region, errs[i])
+			failed = append(failed, ra.region)
+		}
+	}
+	r.recordLineages(lineages)
+	if len(failed) != 0 {
+		return xerrors.Errorf("%d of %d regions failed: %v", len(failed), len(regions), failed)
+	}
+	return nil
+}
+
+// recordRegion merges the result of a regional replacer into r.result.
+func (r *Replacer) recordRegion(ra *regionalAMIs) {
+	res := ra.r.result
+	for _, image := range res.Images {
+		image.Region = ra.region
+		r.result.Images = append(r.result.Images, image)
+	}
+	for _, snapshot := range res.Snapshots {
+		snapshot.Region = ra.region
+		r.result.Snapshots = append(r.result.Snapshots, snapshot)
+	}
+	for _, image := range res.DeprecatedImages {
+		image.Region = ra.region
+		r.result.DeprecatedImages = append(r.result.DeprecatedImages, image)
+	}
+	for _, image := range res.RestoredImages {
+		image.Region = ra.region
+		r.result.RestoredImages = append(r.result.RestoredImages, image)
+	}
+	r.result.SkippedImages = append(r.result.SkippedImages, ra.skipped...)
+	for _, image := range res.SkippedImages {
+		image.Region = ra.region
+		r.result.SkippedImages = append(r.result.SkippedImages, image)
+	}
+}
+
+// planAcrossRegions fills p with the AMIs deregisterAcrossRegions would deregister.
+func (r *Replacer) planAcrossRegions(c *config.Config, p *Plan) error {
+
+	regions, lineages, err := r.amisAcrossRegions(c)
+	if err != nil {
+		return xerrors.Errorf("Failed to get outdated images: %w", err)
+	}
+	for _, ra := range regions {
+		if c.Retire {
+			ra.deregister = p.planRetirement(c, ra.region, ra.images, ra.deregister)
+		}
+		for _, image := range ra.deregister {
+			summary, err := ra.r.planImage(c, image)
+			if err != nil {
+				return err
+			}
+			summary.Region = ra.region
+			p.Images = append(p.Images, summary)
+		}
+		p.SkippedImages = append(p.SkippedImages, ra.skipped...)
+	}
+	p.Lineages = lineages
+	return nil
+}
@@ -0,0 +1,105 @@
+package actions
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/nest-egg/ami-replacer/config"
+)
+
+func TestRegions_RemoveAMIs(t *testing.T) {
+	testCases := []struct {
+		name        string
+		image       string
+		regions     []string
+		sourceTag   string
+		keepTag     string
+		wantImages  []string
+		wantSkipped []string
+	}{
+		{
+			name:       "match_by_name",
+			regions:    []string{"ap-northeast-1", "us-east-1"},
+			wantImages: []string{"ap-northeast-1/ami-apne1-1", "ap-northeast-1/ami-apne1-2", "us-east-1/ami-use1-1", "us-east-1/ami-use1-2"},
+		},
+		{
+			name:      "match_by_source_tag",
+			regions:   []string{config.AllRegions},
+			sourceTag: "SourceAMI",
+			wantImages: []string{
+				"ap-northeast-1/ami-apne1-1", "ap-northeast-1/ami-apne1-2",
+				"eu-west-1/ami-euw1-1",
+				"us-east-1/ami-use1-1", "us-east-1/ami-use1-2",
+			},
+		},
+		{
+			name:        "pinned_copy_pins_generation",
+			regions:     []string{config.AllRegions},
+			sourceTag:   "SourceAMI",
+			keepTag:     "Pinned=release",
+			wantImages:  []string{"ap-northeast-1/ami-apne1-2", "us-east-1/ami-use1-2"},
+			wantSkipped: []string{"ap-northeast-1/ami-apne1-1", "eu-west-1/ami-euw1-1", "us-east-1/ami-use1-1"},
+		},
+		{
+			name:        "shared_copy_keeps_generation",
+			image:       "shared-app-*",
+			regions:     []string{"ap-northeast-1", "us-east-1"},
+			wantImages:  []string{"ap-northeast-1/ami-shared-apne1-2"},
+			wantSkipped: []string{"ap-northeast-1/ami-shared-apne1-1", "us-east-1/ami-shared-use1-1"},
+		},
+		{
+			name:    "nothing_outdated",
+			image:   "shared-app-*",
+			regions: []string{"us-east-1"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockreplacer := NewMockReplacer(
+				context.Background(),
+				"ap-northeast-1",
+				"admin",
+			)
+			res := &Result{Target: tc.name}
+			mockreplacer.Record(res)
+			image := tc.image
+			if image == "" {
+				image = "app-*"
+			}
+			conf := &config.Config{
+				Image:      image,
+				Owner:      "owner",
+				Generation: 2,
+				Regions:    tc.regions,
+				SourceTag:  tc.sourceTag,
+				KeepTag:    tc.keepTag,
+			}
+			if err := mockreplacer.RemoveAMIs(conf); err != nil {
+				t.Fatalf("got: %v\nwant: %v", err, nil)
+			}
+			var gotImages, gotSkipped []string
+			for _, image := range res.Images {
+				gotImages = append(gotImages, regionalID(image.Region, image.ImageID))
+			}
+			for _, image := range res.SkippedImages {
+				gotSkipped = append(gotSkipped, regionalID(image.Region, image.ImageID))
+			}
+			sort.Strings(gotImages)
+			sort.Strings(gotSkipped)
+			if !reflect.DeepEqual(gotImages, tc.wantImages) {
+				t.Errorf("got: %v deregistered\nwant: %v", gotImages, tc.wantImages)
+			}
+			if !reflect.DeepEqual(gotSkipped, tc.wantSkipped) {
+				t.Errorf("got: %v skipped\nwant: %v", gotSkipped, tc.wantSkipped)
+			}
+			for _, image := range res.SkippedImages {
+				if image.Region == "ap-northeast-1" && tc.image != "" && !strings.HasSuffix(image.Reason, " in us-east-1") {
+					t.Errorf("got: %s\nwant: reason naming us-east-1", image.Reason)
+				}
+			}
+		})
+	}
+}
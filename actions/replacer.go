@@ -11,6 +11,10 @@ type Replacer struct {
 	deploy   *fsm.Deploy
 	asg      *AutoScaling
 	instance *Instance
+	dryrun   bool
+	result   *Result
+	// run records the replacement in progress for rollback.
+	run *Run
 }
 
 //Instance retains status of each asg instance.
@@ -28,13 +32,20 @@ type Instance struct {
 func NewReplacer(
 	ctx context.Context,
 	region string,
-	profile string) *Replacer {
+	profile string,
+	role AssumeRole) *Replacer {
 
-	asgroup := newAsg(region, profile)
+	asgroup := newAsg(region, profile, role)
 	deploy := fsm.NewDeploy("start")
 	return &Replacer{
 		ctx:    ctx,
 		asg:    asgroup,
 		deploy: deploy,
+		result: &Result{},
 	}
 }
+
+// Record makes the replacer record every change it makes into res.
+func (r *Replacer) Record(res *Result) {
+	r.result = res
+}
@@ -0,0 +1,289 @@
+package actions
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/nest-egg/ami-replacer/apis"
+	"github.com/nest-egg/ami-replacer/config"
+	"golang.org/x/xerrors"
+)
+
+// untagged groups snapshots without the group tag of a report.
+const untagged = "(none)"
+
+// ageBuckets are the upper bounds of the age buckets of a report, the last one being open.
+var ageBuckets = []struct {
+	name string
+	max  time.Duration
+}{
+	{"<30d", 30 * 24 * time.Hour},
+	{"30-90d", 90 * 24 * time.Hour},
+	{"90-365d", 365 * 24 * time.Hour},
+	{">365d", 0},
+}
+
+// Report estimates the monthly storage cost of the snapshots rmi and rms would delete for one target.
+type Report struct {
+	Target    string      `json:"target" yaml:"target"`
+	GroupTag  string      `json:"group_tag,omitempty" yaml:"group_tag,omitempty"`
+	Total     CostTotal   `json:"total" yaml:"total"`
+	ByOwner   []CostTotal `json:"by_owner,omitempty" yaml:"by_owner,omitempty"`
+	ByTag     []CostTotal `json:"by_tag,omitempty" yaml:"by_tag,omitempty"`
+	ByAge     []CostTotal `json:"by_age,omitempty" yaml:"by_age,omitempty"`
+	Snapshots []CostItem  `json:"snapshots,omitempty" yaml:"snapshots,omitempty"`
+}
+
+// CostItem is a snapshot counted by a report, either unused or backing an AMI to deregister.
+type CostItem struct {
+	SnapshotID  string    `json:"snapshot_id" yaml:"snapshot_id"`
+	ImageID     string    `json:"image_id,omitempty" yaml:"image_id,omitempty"`
+	Region      string    `json:"region,omitempty" yaml:"region,omitempty"`
+	Owner       string    `json:"owner" yaml:"owner"`
+	Tier        string    `json:"tier" yaml:"tier"`
+	VolumeSize  int64     `json:"volume_size" yaml:"volume_size"`
+	Created     time.Time `json:"created" yaml:"created"`
+	Tag         string    `json:"tag,omitempty" yaml:"tag,omitempty"`
+	MonthlyCost float64   `json:"monthly_cost" yaml:"monthly_cost"`
+}
+
+// CostTotal sums the snapshots of a group of a report.
+type CostTotal struct {
+	Key         string  `json:"key" yaml:"key"`
+	Snapshots   int     `json:"snapshots" yaml:"snapshots"`
+	VolumeSize  int64   `json:"volume_size" yaml:"volume_size"`
+	MonthlyCost float64 `json:"monthly_cost" yaml:"monthly_cost"`
+}
+
+func (t *CostTotal) add(item CostItem) {
+	t.Snapshots++
+	t.VolumeSize += item.VolumeSize
+	t.MonthlyCost += item.MonthlyCost
+}
+
+// ReportSnapshots adds the snapshots rms would delete to rep.
+func (r *Replacer) ReportSnapshots(c *config.Config, rep *Report) error {
+
+	snapshots, _, err := r.unusedSnapshots(c)
+	if err != nil {
+		return xerrors.Errorf("Failed to search unused snapshots: %w", err)
+	}
+	for _, snapshot := range snapshots {
+		tier := aws.StringValue(snapshot.StorageTier)
+		if tier == "" {
+			tier = ec2.StorageTierStandard
+		}
+		rep.add(c, CostItem{
+			SnapshotID: aws.StringValue(snapshot.SnapshotId),
+			Owner:      aws.StringValue(snapshot.OwnerId),
+			Tier:       tier,
+			VolumeSize: aws.Int64Value(snapshot.VolumeSize),
+			Created:    aws.TimeValue(snapshot.StartTime),
+		}, snapshotTags(snapshot))
+	}
+	return nil
+}
+
+// ReportAMIs adds the snapshots of the AMIs rmi would deregister to rep,
+// unless another image or a volume still uses them. They are counted
+// whether or not rmi deletes them with c.DeleteSnapshots.
+func (r *Replacer) ReportAMIs(c *config.Config, rep *Report) error {
+
+	if len(c.Regions) != 0 {
+		regions, _, err := r.amisAcrossRegions(c)
+		if err != nil {
+			return xerrors.Errorf("Failed to get outdated images: %w", err)
+		}
+		for _, ra := range regions {
+			if err := ra.r.reportImages(c, ra.region, ra.deregister, rep); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	images, _, err := r.outdatedAMIs(c)
+	if err != nil {
+		return xerrors.Errorf("Failed to get outdated images: %w", err)
+	}
+	images, _, err = r.excludeKept(c, images)
+	if err != nil {
+		return err
+	}
+	return r.reportImages(c, "", images, rep)
+}
+
+func (r *Replacer) reportImages(c *config.Config, region string, images []*ec2.Image, rep *Report) error {
+
+	for _, image := range images {
+		imageid := aws.StringValue(image.ImageId)
+		owner := aws.StringValue(image.OwnerId)
+		if owner == "" {
+			owner = c.Owner
+		}
+		for _, ebs := range imageSnapshots(image) {
+			inuse, err := r.snapshotInUse(aws.StringValue(ebs.SnapshotId), imageid)
+			if err != nil {
+				return err
+			}
+			if inuse {
+				continue
+			}
+			rep.add(c, CostItem{
+				SnapshotID: aws.StringValue(ebs.SnapshotId),
+				ImageID:    imageid,
+				Region:     region,
+				Owner:      owner,
+				Tier:       ec2.StorageTierStandard,
+				VolumeSize: aws.Int64Value(ebs.VolumeSize),
+				Created:    apis.CreationTime(image),
+			}, imageTags(image))
+		}
+	}
+	return nil
+}
+
+// add prices item by c and groups it by the value of the group tag among tags.
+func (rep *Report) add(c *config.Config, item CostItem, tags map[string]string) {
+	rep.GroupTag = c.GroupTag
+	if c.GroupTag != "" {
+		item.Tag = tags[c.GroupTag]
+		if item.Tag == "" {
+			item.Tag = untagged
+		}
+	}
+	item.MonthlyCost = float64(item.VolumeSize) * c.Price(item.Tier)
+	rep.Snapshots = append(rep.Snapshots, item)
+}
+
+// Summarize totals the snapshots of rep by owner, tag and age.
+func (rep *Report) Summarize() {
+	rep.summarize(time.Now())
+}
+
+func (rep *Report) summarize(now time.Time) {
+
+	rep.Total = CostTotal{Key: "total"}
+	owners := map[string]*CostTotal{}
+	tags := map[string]*CostTotal{}
+	ages := make([]CostTotal, len(ageBuckets))
+	for i, b := range ageBuckets {
+		ages[i].Key = b.name
+	}
+	for _, item := range rep.Snapshots {
+		rep.Total.add(item)
+		totalOf(owners, item.Owner).add(item)
+		if rep.GroupTag != "" {
+			totalOf(tags, item.Tag).add(item)
+		}
+		age := now.Sub(item.Created)
+		for i, b := range ageBuckets {
+			if b.max == 0 || age < b.max {
+				ages[i].add(item)
+				break
+			}
+		}
+	}
+	rep.ByOwner = sortedTotals(owners)
+	rep.ByTag = sortedTotals(tags)
+	rep.ByAge = nil
+	for _, t := range ages {
+		if t.Snapshots != 0 {
+			rep.ByAge = append(rep.ByAge, t)
+		}
+	}
+}
+
+func totalOf(totals map[string]*CostTotal, key string) *CostTotal {
+	t, ok := totals[key]
+	if !ok {
+		t = &CostTotal{Key: key}
+		totals[key] = t
+	}
+	return t
+}
+
+// sortedTotals orders totals by descending cost.
+func sortedTotals(totals map[string]*CostTotal) []CostTotal {
+	sorted := make([]CostTotal, 0, len(totals))
+	for _, t := range totals {
+		sorted = append(sorted, *t)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].MonthlyCost != sorted[j].MonthlyCost {
+			return sorted[i].MonthlyCost > sorted[j].MonthlyCost
+		}
+		return sorted[i].Key < sorted[j].Key
+	})
+	return sorted
+}
+
+// groups lists the totals of rep by dimension, ending with the overall total.
+func (rep *Report) groups() []struct {
+	dimension string
+	totals    []CostTotal
+} {
+	return []struct {
+		dimension string
+		totals    []CostTotal
+	}{
+		{"owner", rep.ByOwner},
+		{"tag:" + rep.GroupTag, rep.ByTag},
+		{"age", rep.ByAge},
+		{"total", []CostTotal{rep.Total}},
+	}
+}
+
+// Reports is the report of every target of a run.
+type Reports []*Report
+
+// WriteTable renders reports as human readable tables.
+func (reports Reports) WriteTable(w io.Writer) error {
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, rep := range reports {
+		fmt.Fprintf(tw, "# %s\n", rep.Target)
+		if rep.Total.Snapshots == 0 {
+			fmt.Fprintln(tw, "nothing to delete")
+			fmt.Fprintln(tw)
+			continue
+		}
+		fmt.Fprintln(tw, "BY\tKEY\tSNAPSHOTS\tSIZE (GiB)\tUSD/MONTH")
+		for _, g := range rep.groups() {
+			for _, t := range g.totals {
+				fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%.2f\n", g.dimension, t.Key, t.Snapshots, t.VolumeSize, t.MonthlyCost)
+			}
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
+
+// WriteCSV renders the totals of reports as csv, one row per target and group.
+func (reports Reports) WriteCSV(w io.Writer) error {
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"target", "by", "key", "snapshots", "volume_size", "monthly_cost"})
+	for _, rep := range reports {
+		for _, g := range rep.groups() {
+			for _, t := range g.totals {
+				cw.Write([]string{
+					rep.Target,
+					g.dimension,
+					t.Key,
+					strconv.Itoa(t.Snapshots),
+					strconv.FormatInt(t.VolumeSize, 10),
+					strconv.FormatFloat(t.MonthlyCost, 'f', 2, 64),
+				})
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
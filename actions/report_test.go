@@ -0,0 +1,105 @@
+package actions
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nest-egg/ami-replacer/config"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestReport_summarize(t *testing.T) {
+	now := time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC)
+	conf := &config.Config{
+		GroupTag: "Team",
+		Prices:   map[string]float64{"standard": 0.1},
+	}
+	rep := &Report{Target: "api"}
+	rep.add(conf, CostItem{SnapshotID: "snap-1", Owner: "111", Tier: "standard", VolumeSize: 10, Created: now.AddDate(0, 0, -1)}, map[string]string{"Team": "web"})
+	rep.add(conf, CostItem{SnapshotID: "snap-2", Owner: "111", Tier: "archive", VolumeSize: 100, Created: now.AddDate(0, 0, -100)}, nil)
+	rep.add(conf, CostItem{SnapshotID: "snap-3", Owner: "222", Tier: "standard", VolumeSize: 30, Created: now.AddDate(-2, 0, 0)}, map[string]string{"Team": "web"})
+	rep.summarize(now)
+
+	if want := (CostTotal{Key: "total", Snapshots: 3, VolumeSize: 140, MonthlyCost: 5.25}); rep.Total != want {
+		t.Errorf("got: %+v\nwant: %+v", rep.Total, want)
+	}
+	wantOwners := []CostTotal{
+		{Key: "222", Snapshots: 1, VolumeSize: 30, MonthlyCost: 3},
+		{Key: "111", Snapshots: 2, VolumeSize: 110, MonthlyCost: 2.25},
+	}
+	if !reflect.DeepEqual(rep.ByOwner, wantOwners) {
+		t.Errorf("got: %+v\nwant: %+v", rep.ByOwner, wantOwners)
+	}
+	wantTags := []CostTotal{
+		{Key: "web", Snapshots: 2, VolumeSize: 40, MonthlyCost: 4},
+		{Key: untagged, Snapshots: 1, VolumeSize: 100, MonthlyCost: 1.25},
+	}
+	if !reflect.DeepEqual(rep.ByTag, wantTags) {
+		t.Errorf("got: %+v\nwant: %+v", rep.ByTag, wantTags)
+	}
+	wantAges := []CostTotal{
+		{Key: "<30d", Snapshots: 1, VolumeSize: 10, MonthlyCost: 1},
+		{Key: "90-365d", Snapshots: 1, VolumeSize: 100, MonthlyCost: 1.25},
+		{Key: ">365d", Snapshots: 1, VolumeSize: 30, MonthlyCost: 3},
+	}
+	if !reflect.DeepEqual(rep.ByAge, wantAges) {
+		t.Errorf("got: %+v\nwant: %+v", rep.ByAge, wantAges)
+	}
+
+	var buf bytes.Buffer
+	if err := (Reports{rep}).WriteCSV(&buf); err != nil {
+		t.Fatalf("got: %v\nwant: %v", err, nil)
+	}
+	want := `target,by,key,snapshots,volume_size,monthly_cost
+api,owner,222,1,30,3.00
+api,owner,111,2,110,2.25
+api,tag:Team,web,2,40,4.00
+api,tag:Team,(none),1,100,1.25
+api,age,<30d,1,10,1.00
+api,age,90-365d,1,100,1.25
+api,age,>365d,1,30,3.00
+api,total,total,3,140,5.25
+`
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	out, err := yaml.Marshal(Reports{rep})
+	if err != nil {
+		t.Fatalf("got: %v\nwant: %v", err, nil)
+	}
+	for _, key := range []string{"group_tag: Team", "by_owner:", "by_tag:", "by_age:", "snapshot_id: snap-1", "volume_size: 140", "monthly_cost: 5.25"} {
+		if !strings.Contains(string(out), key) {
+			t.Errorf("got:\n%s\nwant: %q", out, key)
+		}
+	}
+}
+
+func TestReport_ReportAMIs(t *testing.T) {
+	mockreplacer := NewMockReplacer(
+		context.Background(),
+		"ap-northeast-1",
+		"admin",
+	)
+	conf := &config.Config{
+		Image:      "testimage*",
+		Owner:      "owner",
+		Generation: 2,
+	}
+	rep := &Report{Target: "infra"}
+	if err := mockreplacer.ReportAMIs(conf, rep); err != nil {
+		t.Fatalf("got: %v\nwant: %v", err, nil)
+	}
+	rep.Summarize()
+	// snapshot1 of the outdated image is still used by a volume.
+	if len(rep.Snapshots) != 1 || rep.Snapshots[0].SnapshotID != "snap-free" || rep.Snapshots[0].ImageID != "ami-00000000000000003" {
+		t.Fatalf("got: %+v\nwant: snap-free of ami-00000000000000003", rep.Snapshots)
+	}
+	if want := (CostTotal{Key: "total", Snapshots: 1, VolumeSize: 8, MonthlyCost: 0.4}); rep.Total != want {
+		t.Errorf("got: %+v\nwant: %+v", rep.Total, want)
+	}
+}
@@ -0,0 +1,287 @@
+package actions
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/nest-egg/ami-replacer/config"
+	"github.com/nest-egg/ami-replacer/fsm"
+)
+
+// Result is the outcome of a command against one target.
+type Result struct {
+	Target              string             `json:"target" yaml:"target"`
+	Account             string             `json:"account,omitempty" yaml:"account,omitempty"`
+	Skipped             bool               `json:"skipped,omitempty" yaml:"skipped,omitempty"`
+	Error               string             `json:"error,omitempty" yaml:"error,omitempty"`
+	Started             time.Time          `json:"started" yaml:"started"`
+	ElapsedSeconds      float64            `json:"elapsed_seconds" yaml:"elapsed_seconds"`
+	Images              []ImageSummary     `json:"deregistered_images,omitempty" yaml:"deregistered_images,omitempty"`
+	SkippedImages       []SkippedImage     `json:"skipped_images,omitempty" yaml:"skipped_images,omitempty"`
+	DeprecatedImages    []ImageSummary     `json:"deprecated_images,omitempty" yaml:"deprecated_images,omitempty"`
+	RestoredImages      []ImageSummary     `json:"restored_images,omitempty" yaml:"restored_images,omitempty"`
+	Lineages            []LineageSummary   `json:"lineages,omitempty" yaml:"lineages,omitempty"`
+	Snapshots           []SnapshotSummary  `json:"deleted_snapshots,omitempty" yaml:"deleted_snapshots,omitempty"`
+	SkippedSnapshots    []SkippedSnapshot  `json:"skipped_snapshots,omitempty" yaml:"skipped_snapshots,omitempty"`
+	Instances           []ReplacedInstance `json:"replaced_instances,omitempty" yaml:"replaced_instances,omitempty"`
+	TerminatedInstances []string           `json:"terminated_instances,omitempty" yaml:"terminated_instances,omitempty"`
+	// RunID names the record of a replacement, to roll it back with the rollback command.
+	RunID      string `json:"run_id,omitempty" yaml:"run_id,omitempty"`
+	RolledBack bool   `json:"rolled_back,omitempty" yaml:"rolled_back,omitempty"`
+	// LaunchTemplate is the launch template version created with the newest AMI, as id:version.
+	LaunchTemplate string `json:"launch_template,omitempty" yaml:"launch_template,omitempty"`
+	// Transitions is the history of the states of a replacement.
+	Transitions []fsm.Transition `json:"transitions,omitempty" yaml:"transitions,omitempty"`
+
+	Err     error         `json:"-" yaml:"-"`
+	Elapsed time.Duration `json:"-" yaml:"-"`
+}
+
+// ImageSummary describes an AMI.
+type ImageSummary struct {
+	ImageID      string   `json:"image_id" yaml:"image_id"`
+	Name         string   `json:"name" yaml:"name"`
+	CreationDate string   `json:"creation_date" yaml:"creation_date"`
+	Region       string   `json:"region,omitempty" yaml:"region,omitempty"`
+	Unshared     []string `json:"unshared_from,omitempty" yaml:"unshared_from,omitempty"`
+	// DeprecationTime is when a retired image becomes deprecated and may be deregistered.
+	DeprecationTime string `json:"deprecation_time,omitempty" yaml:"deprecation_time,omitempty"`
+}
+
+// SnapshotSummary describes an EBS snapshot.
+type SnapshotSummary struct {
+	SnapshotID string    `json:"snapshot_id" yaml:"snapshot_id"`
+	VolumeSize int64     `json:"volume_size" yaml:"volume_size"`
+	StartTime  time.Time `json:"start_time" yaml:"start_time"`
+	ImageID    string    `json:"image_id,omitempty" yaml:"image_id,omitempty"`
+	Region     string    `json:"region,omitempty" yaml:"region,omitempty"`
+	// Action is what rms did or would do with the snapshot: delete, archive or recycle.
+	Action string `json:"action,omitempty" yaml:"action,omitempty"`
+}
+
+// ReplacedInstance is a container instance replaced with the newest AMI.
+type ReplacedInstance struct {
+	InstanceID string `json:"instance_id" yaml:"instance_id"`
+	OldAMI     string `json:"old_ami" yaml:"old_ami"`
+	NewAMI     string `json:"new_ami" yaml:"new_ami"`
+}
+
+// Results is the result of every target of a run.
+type Results []*Result
+
+func summarizeImage(image *ec2.Image) ImageSummary {
+	return ImageSummary{
+		ImageID:      aws.StringValue(image.ImageId),
+		Name:         aws.StringValue(image.Name),
+		CreationDate: aws.StringValue(image.CreationDate),
+	}
+}
+
+func summarizeSnapshot(snapshot *ec2.Snapshot) SnapshotSummary {
+	return SnapshotSummary{
+		SnapshotID: aws.StringValue(snapshot.SnapshotId),
+		VolumeSize: aws.Int64Value(snapshot.VolumeSize),
+		StartTime:  aws.TimeValue(snapshot.StartTime),
+	}
+}
+
+// source returns the start time of the snapshot,
+// or the image it was deleted with.
+func (s SnapshotSummary) source() string {
+	if s.ImageID != "" {
+		return s.ImageID
+	}
+	return s.StartTime.Format(time.RFC3339)
+}
+
+func summarizeImageSnapshot(imageid string, ebs *ec2.EbsBlockDevice) SnapshotSummary {
+	return SnapshotSummary{
+		SnapshotID: aws.StringValue(ebs.SnapshotId),
+		VolumeSize: aws.Int64Value(ebs.VolumeSize),
+		ImageID:    imageid,
+		Action:     config.ActionDelete,
+	}
+}
+
+func (res *Result) finish(err error) {
+	res.Elapsed = time.Since(res.Started)
+	res.ElapsedSeconds = res.Elapsed.Seconds()
+	res.Err = err
+	if err != nil {
+		res.Error = err.Error()
+	}
+}
+
+// WriteTable renders results as human readable tables.
+func (results Results) WriteTable(w io.Writer) error {
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, res := range results {
+		switch {
+		case res.Skipped:
+			fmt.Fprintf(tw, "# %s: SKIPPED\n", res.Target)
+		case res.Err != nil:
+			fmt.Fprintf(tw, "# %s: FAILED (%s) %s\n", res.Target, res.Elapsed.Round(time.Second), res.Error)
+		default:
+			fmt.Fprintf(tw, "# %s: OK (%s)\n", res.Target, res.Elapsed.Round(time.Second))
+		}
+		if len(res.Images) != 0 {
+			fmt.Fprintln(tw, "DEREGISTERED IMAGE\tNAME\tCREATED")
+			for _, image := range res.Images {
+				fmt.Fprintf(tw, "%s\t%s\t%s\n", regionalID(image.Region, image.ImageID), image.Name, image.CreationDate)
+				if len(image.Unshared) != 0 {
+					fmt.Fprintf(tw, "\tunshared from %s\t\n", strings.Join(image.Unshared, ", "))
+				}
+			}
+		}
+		if len(res.SkippedImages) != 0 {
+			fmt.Fprintln(tw, "SKIPPED IMAGE\tNAME\tREASON")
+			for _, image := range res.SkippedImages {
+				fmt.Fprintf(tw, "%s\t%s\t%s\n", regionalID(image.Region, image.ImageID), image.Name, image.Reason)
+			}
+		}
+		writeRetirement(tw, "DEPRECATED IMAGE", "RESTORED IMAGE", res.DeprecatedImages, res.RestoredImages)
+		writeLineages(tw, res.Lineages)
+		writeSnapshots(tw, "PROCESSED SNAPSHOT", res.Snapshots)
+		writeSkippedSnapshots(tw, "SKIPPED SNAPSHOT", res.SkippedSnapshots)
+		for _, id := range res.TerminatedInstances {
+			fmt.Fprintf(tw, "TERMINATED UNUSED\t%s\t\n", id)
+		}
+		if res.LaunchTemplate != "" {
+			fmt.Fprintf(tw, "LAUNCH TEMPLATE\t%s\t\n", res.LaunchTemplate)
+		}
+		if len(res.Instances) != 0 {
+			fmt.Fprintln(tw, "REPLACED INSTANCE\tOLD AMI\tNEW AMI")
+			for _, inst := range res.Instances {
+				fmt.Fprintf(tw, "%s\t%s\t%s\n", inst.InstanceID, inst.OldAMI, inst.NewAMI)
+			}
+		}
+		if len(res.Transitions) != 0 {
+			fmt.Fprintln(tw, "STATE\tFROM\tAT")
+			for _, t := range res.Transitions {
+				fmt.Fprintf(tw, "%s\t%s\t%s\n", t.To, t.From, t.At.Format(time.RFC3339))
+			}
+		}
+		switch {
+		case res.RolledBack:
+			fmt.Fprintf(tw, "ROLLED BACK\t%s\t\n", res.RunID)
+		case res.RunID != "":
+			fmt.Fprintf(tw, "RUN\t%s\t\n", res.RunID)
+		}
+		fmt.Fprintln(tw)
+	}
+	if accounts := results.Accounts(); len(accounts) > 1 {
+		fmt.Fprintln(tw, "ACCOUNT\tTARGETS\tFAILED\tIMAGES\tSNAPSHOTS\tINSTANCES")
+		for _, a := range accounts {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\n", a.Account, a.Targets, a.Failed, a.Images, a.Snapshots, a.Instances)
+		}
+	}
+	return tw.Flush()
+}
+
+// AccountSummary totals the results of every target in one account.
+type AccountSummary struct {
+	Account   string
+	Targets   int
+	Failed    int
+	Images    int
+	Snapshots int
+	Instances int
+}
+
+// Accounts totals results per account, in the order accounts first appear.
+func (results Results) Accounts() []AccountSummary {
+
+	var accounts []AccountSummary
+	index := map[string]int{}
+	for _, res := range results {
+		i, ok := index[res.Account]
+		if !ok {
+			i = len(accounts)
+			index[res.Account] = i
+			accounts = append(accounts, AccountSummary{Account: res.Account})
+		}
+		a := &accounts[i]
+		a.Targets++
+		if res.Skipped || res.Err != nil {
+			a.Failed++
+		}
+		a.Images += len(res.Images)
+		a.Snapshots += len(res.Snapshots)
+		a.Instances += len(res.Instances)
+	}
+	return accounts
+}
+
+// accountOf names the account of a target by the account id of its role,
+// or by its profile when no role is assumed.
+func accountOf(c *config.Config) string {
+	if account := config.RoleAccount(c.RoleArn); account != "" {
+		return account
+	}
+	return c.Profile
+}
+
+// regionalID qualifies the id of a resource with its region in cross-region runs.
+func regionalID(region string, id string) string {
+	if region == "" {
+		return id
+	}
+	return region + "/" + id
+}
+
+func writeRetirement(w io.Writer, deprecatedHeader string, restoredHeader string, deprecated []ImageSummary, restored []ImageSummary) {
+	if len(deprecated) != 0 {
+		fmt.Fprintf(w, "%s\tNAME\tDEREGISTER AFTER\n", deprecatedHeader)
+		for _, image := range deprecated {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", regionalID(image.Region, image.ImageID), image.Name, image.DeprecationTime)
+		}
+	}
+	if len(restored) != 0 {
+		fmt.Fprintf(w, "%s\tNAME\tCREATED\n", restoredHeader)
+		for _, image := range restored {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", regionalID(image.Region, image.ImageID), image.Name, image.CreationDate)
+		}
+	}
+}
+
+func writeLineages(w io.Writer, lineages []LineageSummary) {
+	if len(lineages) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "LINEAGE\tRETAINED\tDELETED")
+	for _, l := range lineages {
+		name := l.Lineage
+		if name == "" {
+			name = "(none)"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\n", name, l.Retained, l.Deleted)
+	}
+}
+
+// writeSnapshots renders snapshots rms acts on under header, with the action taken on each.
+func writeSnapshots(w io.Writer, header string, snapshots []SnapshotSummary) {
+	if len(snapshots) == 0 {
+		return
+	}
+	fmt.Fprintln(w, header+"\tACTION\tSIZE (GiB)\tSTARTED / IMAGE")
+	for _, s := range snapshots {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", regionalID(s.Region, s.SnapshotID), s.Action, s.VolumeSize, s.source())
+	}
+}
+
+// writeSkippedSnapshots renders snapshots spared by rms under header.
+func writeSkippedSnapshots(w io.Writer, header string, skipped []SkippedSnapshot) {
+	if len(skipped) == 0 {
+		return
+	}
+	fmt.Fprintln(w, header+"\tREASON\t")
+	for _, s := range skipped {
+		fmt.Fprintf(w, "%s\t%s\t\n", s.SnapshotID, s.Reason)
+	}
+}
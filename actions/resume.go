@@ -0,0 +1,200 @@
+package actions
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/nest-egg/ami-replacer/config"
+	"github.com/nest-egg/ami-replacer/log"
+	"golang.org/x/xerrors"
+)
+
+// The steps of a replacement, in order. The state of a run holds the last one completed.
+const (
+	stepRecorded = "recorded"
+	stepCleaned  = "cleaned"
+	stepSurged   = "surged"
+	stepSwapped  = "swapped"
+	stepDone     = "done"
+)
+
+var steps = []string{stepRecorded, stepCleaned, stepSurged, stepSwapped, stepDone}
+
+// The steps of the replacement of a drained instance.
+const (
+	instanceDraining    = "draining"
+	instanceTerminating = "terminating"
+	instanceReplaced    = "replaced"
+)
+
+func stepIndex(step string) int {
+	for i, s := range steps {
+		if s == step {
+			return i
+		}
+	}
+	return -1
+}
+
+// reached reports whether the run has completed step, which a resumed run skips.
+func (run *Run) reached(step string) bool {
+	return run != nil && stepIndex(run.State.Current) >= stepIndex(step)
+}
+
+// progressOf returns the progress of inst, added if the run has not drained it yet.
+func (run *Run) progressOf(inst Instance) *InstanceProgress {
+	for i := range run.Progress {
+		if run.Progress[i].InstanceArn == inst.InstanceArn {
+			return &run.Progress[i]
+		}
+	}
+	run.Progress = append(run.Progress, InstanceProgress{
+		InstanceID:  inst.InstanceID,
+		InstanceArn: inst.InstanceArn,
+		OldAMI:      inst.ImageID,
+	})
+	return &run.Progress[len(run.Progress)-1]
+}
+
+// LatestRun returns the last run of rpl against asgname recorded in dir.
+func LatestRun(dir string, asgname string) (*Run, error) {
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, xerrors.Errorf("Failed to list runs: %w", err)
+	}
+	var latest *Run
+	for _, path := range paths {
+		run, err := LoadRun(dir, strings.TrimSuffix(filepath.Base(path), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		if run.Asg.Name != asgname {
+			continue
+		}
+		if latest == nil || run.Started.After(latest.Started) {
+			latest = run
+		}
+	}
+	if latest == nil {
+		return nil, xerrors.Errorf("No run of asg %s in %s", asgname, dir)
+	}
+	return latest, nil
+}
+
+// resumeRun makes the replacer continue the last run against c.Asgname
+// instead of recording a new one.
+func (r *Replacer) resumeRun(c *config.Config) error {
+
+	if c.StateDir == "" {
+		return xerrors.New("No state dir to resume a run from")
+	}
+	run, err := LatestRun(c.StateDir, c.Asgname)
+	if err != nil {
+		return err
+	}
+	switch {
+	case run.RolledBack:
+		return xerrors.Errorf("Run %s has been rolled back", run.ID)
+	case run.State.Success:
+		return xerrors.Errorf("Run %s has already finished", run.ID)
+	}
+	log.Logger.Infof("Resume run %s after step %s, %d of %d drained instances replaced", run.ID, run.State.Current, run.State.RUNNUM, run.State.STOPNUM)
+	r.run = run
+	r.result.RunID = run.ID
+	return nil
+}
+
+// checkpoint saves the run once step is completed.
+func (r *Replacer) checkpoint(step string) error {
+
+	if r.run == nil || r.dryrun {
+		return nil
+	}
+	r.run.State.Last = r.run.State.Current
+	r.run.State.Current = step
+	r.run.State.Success = step == stepDone
+	if err := r.run.save(); err != nil {
+		return xerrors.Errorf("Failed to save run after step %s: %w", step, err)
+	}
+	return nil
+}
+
+// track saves the step the replacement of every instance of batch has reached.
+func (r *Replacer) track(batch []Instance, step string) error {
+
+	if r.run == nil || r.dryrun {
+		return nil
+	}
+	for _, inst := range batch {
+		r.run.progressOf(inst).Step = step
+	}
+	r.run.State.STOPNUM = len(r.run.Progress)
+	r.run.State.RUNNUM = 0
+	for _, p := range r.run.Progress {
+		if p.Step == instanceReplaced {
+			r.run.State.RUNNUM++
+		}
+	}
+	return r.run.save()
+}
+
+// finishDrained completes the batches a resumed run drained without seeing them replaced.
+// Drained instances are no longer listed among the cluster instances to replace.
+func (r *Replacer) finishDrained(clst *cluster) error {
+
+	if r.run == nil {
+		return nil
+	}
+	status, err := r.clusterStatus(clst.name)
+	if err != nil {
+		return xerrors.Errorf("Failed to get cluster status: %w", err)
+	}
+	statuses := map[string]string{}
+	for _, st := range status.ContainerInstances {
+		statuses[aws.StringValue(st.ContainerInstanceArn)] = aws.StringValue(st.Status)
+	}
+	var drained []Instance
+	for _, p := range r.run.Progress {
+		if p.Step == instanceReplaced {
+			continue
+		}
+		inst := Instance{
+			InstanceID:  p.InstanceID,
+			InstanceArn: p.InstanceArn,
+			ImageID:     p.OldAMI,
+			Cluster:     clst.name,
+		}
+		switch statuses[p.InstanceArn] {
+		case "":
+			// terminated before the run stopped.
+			if err := r.track([]Instance{inst}, instanceReplaced); err != nil {
+				return xerrors.Errorf("Failed to record replaced instances: %w", err)
+			}
+			r.recordReplaced([]Instance{inst}, clst.asg.newestami)
+		case "DRAINING":
+			drained = append(drained, inst)
+		}
+		// active instances were never drained and are replaced with the others.
+	}
+	if len(drained) == 0 {
+		return nil
+	}
+	log.Logger.Infof("Finish replacing %d instances drained by run %s", len(drained), r.run.ID)
+	if err := r.swapBatch(drained, clst.asg); err != nil {
+		return xerrors.Errorf("Failed to replace instances: %w", err)
+	}
+	r.recordReplaced(drained, clst.asg.newestami)
+	return nil
+}
+
+func (r *Replacer) recordReplaced(batch []Instance, newestami string) {
+	for _, inst := range batch {
+		r.result.Instances = append(r.result.Instances, ReplacedInstance{
+			InstanceID: inst.InstanceID,
+			OldAMI:     inst.ImageID,
+			NewAMI:     newestami,
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package actions
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nest-egg/ami-replacer/fsm"
+)
+
+func TestResume_LatestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ami-replacer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	started := time.Date(2019, 4, 1, 12, 30, 0, 0, time.UTC)
+	for _, run := range []*Run{
+		{Asg: AsgSnapshot{Name: "api-asg"}, Started: started},
+		{Asg: AsgSnapshot{Name: "api-asg"}, Started: started.Add(time.Hour)},
+		{Asg: AsgSnapshot{Name: "web-asg"}, Started: started.Add(2 * time.Hour)},
+	} {
+		run.ID = NewRunID(run.Asg.Name, run.Started)
+		run.path = filepath.Join(dir, run.ID+".json")
+		if err := run.save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := LatestRun(dir, "api-asg")
+	if err != nil {
+		t.Fatalf("got: %v\nwant: %v", err, nil)
+	}
+	if want := "20190401T133000-api-asg"; got.ID != want {
+		t.Errorf("got: %s\nwant: %s", got.ID, want)
+	}
+	if _, err := LatestRun(dir, "unknown"); err == nil {
+		t.Errorf("should raise error: %v", err)
+	}
+}
+
+func TestResume_reached(t *testing.T) {
+	testCases := []struct {
+		name string
+		run  *Run
+		step string
+		want bool
+	}{
+		{
+			name: "no_run",
+			step: stepCleaned,
+		},
+		{
+			name: "recorded",
+			run:  &Run{State: fsm.State{Current: stepRecorded}},
+			step: stepCleaned,
+		},
+		{
+			name: "same_step",
+			run:  &Run{State: fsm.State{Current: stepSurged}},
+			step: stepSurged,
+			want: true,
+		},
+		{
+			name: "later_step",
+			run:  &Run{State: fsm.State{Current: stepSwapped}},
+			step: stepCleaned,
+			want: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.run.reached(tc.step); got != tc.want {
+				t.Errorf("got: %v\nwant: %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResume_finishDrained(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ami-replacer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mockreplacer := NewMockReplacer(
+		context.Background(),
+		"ap-northeast-1",
+		"admin",
+	)
+	res := &Result{}
+	mockreplacer.Record(res)
+	mockreplacer.run = &Run{
+		ID:    "20190401T123000-asg",
+		State: fsm.State{Current: stepSurged},
+		Progress: []InstanceProgress{
+			{InstanceID: "instance0", InstanceArn: "arn0", OldAMI: "ami-old", Step: instanceReplaced},
+			{InstanceID: "instance-gone", InstanceArn: "arn-gone", OldAMI: "ami-old", Step: instanceTerminating},
+			{InstanceID: "instance1", InstanceArn: "arn1", OldAMI: "ami-old", Step: instanceDraining},
+		},
+		path: filepath.Join(dir, "20190401T123000-asg.json"),
+	}
+	clst := &cluster{name: "cluster", asg: asg{name: "asg", newestami: "ami-new"}}
+	if err := mockreplacer.finishDrained(clst); err != nil {
+		t.Fatalf("got: %v\nwant: %v", err, nil)
+	}
+
+	wantReplaced := []ReplacedInstance{{InstanceID: "instance-gone", OldAMI: "ami-old", NewAMI: "ami-new"}}
+	if !reflect.DeepEqual(res.Instances, wantReplaced) {
+		t.Errorf("got: %+v\nwant: %+v", res.Instances, wantReplaced)
+	}
+	saved, err := LoadRun(dir, "20190401T123000-asg")
+	if err != nil {
+		t.Fatalf("got: %v\nwant: %v", err, nil)
+	}
+	var got []string
+	for _, p := range saved.Progress {
+		got = append(got, p.InstanceID+" "+p.Step)
+	}
+	// instance1 is still active, it was never drained.
+	want := []string{"instance0 replaced", "instance-gone replaced", "instance1 draining"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v\nwant: %v", got, want)
+	}
+	if saved.State.RUNNUM != 2 || saved.State.STOPNUM != 3 {
+		t.Errorf("got: %+v\nwant: runnum 2 and stopnum 3", saved.State)
+	}
+}
@@ -0,0 +1,174 @@
+package actions
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/nest-egg/ami-replacer/config"
+	"github.com/nest-egg/ami-replacer/log"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// retireStageTag tracks the retirement stage of images rmi --retire deprecated.
+	retireStageTag = "ami-replacer/retire-stage"
+	// stageDeprecated is the stage of images deprecated and waiting for deregistration.
+	stageDeprecated = "deprecated"
+)
+
+// retirement classifies images of a staged retirement.
+type retirement struct {
+	// deprecate are outdated images not deprecated yet.
+	deprecate []*ec2.Image
+	// deregister are deprecated images whose grace period has passed.
+	deregister []*ec2.Image
+	// waiting are deprecated images within their grace period.
+	waiting []SkippedImage
+	// restore are images deprecated by an earlier run which are no longer outdated.
+	restore []*ec2.Image
+}
+
+// retirementOf stages candidates, the outdated images safe to deregister, among all images.
+// Images an earlier run deprecated are restored unless they are still candidates,
+// so a retirement caught within the grace period is undone by fixing the retention policy.
+func retirementOf(all []*ec2.Image, candidates []*ec2.Image, now time.Time) retirement {
+
+	var ret retirement
+	isCandidate := map[string]bool{}
+	for _, image := range candidates {
+		isCandidate[aws.StringValue(image.ImageId)] = true
+		deprecation, deprecated := deprecationTime(image)
+		switch {
+		case !deprecated:
+			ret.deprecate = append(ret.deprecate, image)
+		case !now.Before(deprecation):
+			ret.deregister = append(ret.deregister, image)
+		default:
+			ret.waiting = append(ret.waiting, SkippedImage{
+				ImageID: aws.StringValue(image.ImageId),
+				Name:    aws.StringValue(image.Name),
+				Reason:  "deprecated, deregistered after " + deprecation.Format(time.RFC3339),
+			})
+		}
+	}
+	for _, image := range all {
+		if isCandidate[aws.StringValue(image.ImageId)] {
+			continue
+		}
+		if imageTags(image)[retireStageTag] == stageDeprecated {
+			ret.restore = append(ret.restore, image)
+		}
+	}
+	return ret
+}
+
+// deprecationTime returns when an image rmi --retire deprecated becomes deprecated.
+// Images deprecated by hand, or whose deprecation was disabled, are not staged.
+func deprecationTime(image *ec2.Image) (time.Time, bool) {
+	if imageTags(image)[retireStageTag] != stageDeprecated {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, aws.StringValue(image.DeprecationTime))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// retireAMIs is the staged counterpart of deregisterAMI.
+func (r *Replacer) retireAMIs(c *config.Config) error {
+
+	images, groups, err := r.outdatedAMIs(c)
+	if err != nil {
+		return err
+	}
+	candidates, skipped, err := r.excludeKept(c, images)
+	if err != nil {
+		return err
+	}
+	r.result.SkippedImages = append(r.result.SkippedImages, skipped...)
+	var all []*ec2.Image
+	for _, g := range groups {
+		all = append(all, g.images...)
+	}
+	ret, err := r.retireImages(c, all, candidates)
+	if err != nil {
+		return err
+	}
+	r.recordLineages(summarizeLineages(groups, c, ret.deregister))
+	return nil
+}
+
+// retireImages deprecates, deregisters and restores images as staged by retirementOf.
+func (r *Replacer) retireImages(c *config.Config, all []*ec2.Image, candidates []*ec2.Image) (retirement, error) {
+
+	ret := retirementOf(all, candidates, time.Now())
+	r.result.SkippedImages = append(r.result.SkippedImages, ret.waiting...)
+
+	deprecateAt := time.Now().Add(c.GracePeriod).UTC().Truncate(time.Minute)
+	for _, image := range ret.deprecate {
+		if err := r.deprecate(image, deprecateAt); err != nil {
+			return ret, err
+		}
+		summary := summarizeImage(image)
+		summary.DeprecationTime = deprecateAt.Format(time.RFC3339)
+		r.result.DeprecatedImages = append(r.result.DeprecatedImages, summary)
+	}
+	if err := r.deregisterImages(c, ret.deregister); err != nil {
+		return ret, err
+	}
+	for _, image := range ret.restore {
+		if err := r.restore(image); err != nil {
+			return ret, err
+		}
+		r.result.RestoredImages = append(r.result.RestoredImages, summarizeImage(image))
+	}
+	return ret, nil
+}
+
+func (r *Replacer) deprecate(image *ec2.Image, deprecateAt time.Time) error {
+
+	_, err := r.asg.Ec2Api.EnableImageDeprecation(&ec2.EnableImageDeprecationInput{
+		DryRun:      aws.Bool(r.dryrun),
+		ImageId:     image.ImageId,
+		DeprecateAt: aws.Time(deprecateAt),
+	})
+	if err != nil {
+		return xerrors.Errorf("Failed to deprecate image %s: %w", aws.StringValue(image.ImageId), err)
+	}
+	_, err = r.asg.Ec2Api.CreateTags(&ec2.CreateTagsInput{
+		DryRun:    aws.Bool(r.dryrun),
+		Resources: []*string{image.ImageId},
+		Tags: []*ec2.Tag{{
+			Key:   aws.String(retireStageTag),
+			Value: aws.String(stageDeprecated),
+		}},
+	})
+	if err != nil {
+		return xerrors.Errorf("Failed to tag image %s: %w", aws.StringValue(image.ImageId), err)
+	}
+	log.Logger.Infof("Deprecated image %s, deregistered after %s", aws.StringValue(image.ImageId), deprecateAt.Format(time.RFC3339))
+	return nil
+}
+
+func (r *Replacer) restore(image *ec2.Image) error {
+
+	_, err := r.asg.Ec2Api.DisableImageDeprecation(&ec2.DisableImageDeprecationInput{
+		DryRun:  aws.Bool(r.dryrun),
+		ImageId: image.ImageId,
+	})
+	if err != nil {
+		return xerrors.Errorf("Failed to restore image %s: %w", aws.StringValue(image.ImageId), err)
+	}
+	_, err = r.asg.Ec2Api.DeleteTags(&ec2.DeleteTagsInput{
+		DryRun:    aws.Bool(r.dryrun),
+		Resources: []*string{image.ImageId},
+		Tags:      []*ec2.Tag{{Key: aws.String(retireStageTag)}},
+	})
+	if err != nil {
+		return xerrors.Errorf("Failed to untag image %s: %w", aws.StringValue(image.ImageId), err)
+	}
+	log.Logger.Infof("Restored image %s no longer outdated", aws.StringValue(image.ImageId))
+	return nil
+}
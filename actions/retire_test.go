@@ -0,0 +1,76 @@
+package actions
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nest-egg/ami-replacer/config"
+)
+
+func TestRetire_RemoveAMIs(t *testing.T) {
+	mockreplacer := NewMockReplacer(
+		context.Background(),
+		"ap-northeast-1",
+		"admin",
+	)
+	res := &Result{Target: "retire"}
+	mockreplacer.Record(res)
+	conf := &config.Config{
+		Image:       "retire*",
+		Owner:       "owner",
+		Generation:  3,
+		Retire:      true,
+		GracePeriod: 14 * 24 * time.Hour,
+	}
+	if err := mockreplacer.RemoveAMIs(conf); err != nil {
+		t.Fatalf("got: %v\nwant: %v", err, nil)
+	}
+
+	ids := func(images []ImageSummary) []string {
+		var ids []string
+		for _, image := range images {
+			ids = append(ids, image.ImageID)
+		}
+		return ids
+	}
+	if got, want := ids(res.DeprecatedImages), []string{"ami-retire-0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v deprecated\nwant: %v", got, want)
+	}
+	if got, want := ids(res.Images), []string{"ami-retire-1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v deregistered\nwant: %v", got, want)
+	}
+	if got, want := ids(res.RestoredImages), []string{"ami-retire-4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v restored\nwant: %v", got, want)
+	}
+	if len(res.SkippedImages) != 1 || res.SkippedImages[0].ImageID != "ami-retire-2" {
+		t.Errorf("got: %+v skipped\nwant: ami-retire-2 within its grace period", res.SkippedImages)
+	}
+	deprecation, err := time.Parse(time.RFC3339, res.DeprecatedImages[0].DeprecationTime)
+	if err != nil || deprecation.Before(time.Now().Add(13*24*time.Hour)) {
+		t.Errorf("got: deprecation time %s\nwant: about 14 days from now", res.DeprecatedImages[0].DeprecationTime)
+	}
+}
+
+func TestRetire_PlanAMIs(t *testing.T) {
+	mockreplacer := NewMockReplacer(
+		context.Background(),
+		"ap-northeast-1",
+		"admin",
+	)
+	conf := &config.Config{
+		Image:      "retire*",
+		Owner:      "owner",
+		Generation: 3,
+		Retire:     true,
+	}
+	p := &Plan{Target: "retire"}
+	if err := mockreplacer.PlanAMIs(conf, p); err != nil {
+		t.Fatalf("got: %v\nwant: %v", err, nil)
+	}
+	if len(p.Images) != 1 || len(p.Deprecate) != 1 || len(p.Restore) != 1 || len(p.SkippedImages) != 1 {
+		t.Errorf("got: %d deregister, %d deprecate, %d restore, %d skipped\nwant: 1 each",
+			len(p.Images), len(p.Deprecate), len(p.Restore), len(p.SkippedImages))
+	}
+}
@@ -0,0 +1,300 @@
+package actions
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/nest-egg/ami-replacer/config"
+	"github.com/nest-egg/ami-replacer/fsm"
+	"github.com/nest-egg/ami-replacer/log"
+	"golang.org/x/xerrors"
+)
+
+// Run records a replacement so that it can be rolled back,
+// by rpl itself when it fails or later with the rollback command.
+// The external id of the role is a secret and is taken from --external-id or --config again instead.
+type Run struct {
+	ID          string    `json:"id"`
+	Target      string    `json:"target"`
+	Region      string    `json:"region"`
+	Profile     string    `json:"profile"`
+	RoleArn     string    `json:"role_arn,omitempty"`
+	Clustername string    `json:"clustername"`
+	Started     time.Time `json:"started"`
+	// Asg is the configuration of the asg before the replacement.
+	Asg AsgSnapshot `json:"asg"`
+	// ClusterSize is the size the cluster is restored to once every instance is replaced.
+	ClusterSize int    `json:"cluster_size"`
+	NewestAMI   string `json:"newest_ami"`
+	// State holds the last step of the replacement completed, to resume from.
+	State fsm.State `json:"state"`
+	// Template is the launch template version created with the newest AMI, if any.
+	Template *TemplateUpdate `json:"template,omitempty"`
+	// Progress lists the container instances rpl drained and how far their replacement went.
+	Progress   []InstanceProgress `json:"progress,omitempty"`
+	RolledBack bool               `json:"rolled_back,omitempty"`
+
+	path string
+}
+
+// AsgSnapshot is the part of an asg configuration a rollback restores.
+type AsgSnapshot struct {
+	Name                             string   `json:"name"`
+	DesiredCapacity                  int64    `json:"desired_capacity"`
+	MinSize                          int64    `json:"min_size"`
+	NewInstancesProtectedFromScaleIn bool     `json:"new_instances_protected_from_scale_in"`
+	Instances                        []string `json:"instances"`
+	ProtectedInstances               []string `json:"protected_instances,omitempty"`
+	// LaunchTemplate is nil for asgs launching from a launch configuration or a mixed instances policy.
+	LaunchTemplate *LaunchTemplateVersion `json:"launch_template,omitempty"`
+}
+
+// LaunchTemplateVersion pins the launch template an asg launches instances from.
+type LaunchTemplateVersion struct {
+	ID      string `json:"id"`
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version"`
+}
+
+// InstanceProgress is the replacement of a container instance drained by a run.
+type InstanceProgress struct {
+	InstanceID  string `json:"instance_id"`
+	InstanceArn string `json:"instance_arn"`
+	OldAMI      string `json:"old_ami,omitempty"`
+	// Step is instanceDraining, instanceTerminating or instanceReplaced.
+	Step string `json:"step"`
+}
+
+// NewRunID names a run of rpl against an asg.
+func NewRunID(asgname string, started time.Time) string {
+	return started.UTC().Format("20060102T150405") + "-" + asgname
+}
+
+// LoadRun reads the record of a run from dir.
+func LoadRun(dir string, id string) (*Run, error) {
+
+	path := filepath.Join(dir, id+".json")
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, xerrors.Errorf("Failed to read run %s: %w", id, err)
+	}
+	run := &Run{}
+	if err := json.Unmarshal(out, run); err != nil {
+		return nil, xerrors.Errorf("Failed to parse run %s: %w", id, err)
+	}
+	run.path = path
+	return run, nil
+}
+
+// save writes the run next to a temporary file first, so that an interrupted
+// write never leaves a broken record. Runs without a state dir are not saved.
+func (run *Run) save() error {
+
+	if run.path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(run.path), 0700); err != nil {
+		return xerrors.Errorf("Failed to create state dir: %w", err)
+	}
+	out, err := json.MarshalIndent(run, "", "  ")
+	if err != nil {
+		return xerrors.Errorf("Failed to encode run: %w", err)
+	}
+	tmp := run.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, out, 0600); err != nil {
+		return xerrors.Errorf("Failed to write run: %w", err)
+	}
+	if err := os.Rename(tmp, run.path); err != nil {
+		return xerrors.Errorf("Failed to write run: %w", err)
+	}
+	return nil
+}
+
+// recordRun snapshots the asg of clst before it is changed.
+func (r *Replacer) recordRun(c *config.Config, clst *cluster) error {
+
+	asginfo, err := r.asgInfo(clst.asg.name)
+	if err != nil {
+		return xerrors.Errorf("Failed to get asg info: %w", err)
+	}
+	if len(asginfo) == 0 {
+		return xerrors.Errorf("asg %s not found", clst.asg.name)
+	}
+	group := asginfo[0]
+	snapshot := AsgSnapshot{
+		Name:                             clst.asg.name,
+		DesiredCapacity:                  aws.Int64Value(group.DesiredCapacity),
+		MinSize:                          aws.Int64Value(group.MinSize),
+		NewInstancesProtectedFromScaleIn: aws.BoolValue(group.NewInstancesProtectedFromScaleIn),
+	}
+	for _, inst := range group.Instances {
+		id := aws.StringValue(inst.InstanceId)
+		snapshot.Instances = append(snapshot.Instances, id)
+		if aws.BoolValue(inst.ProtectedFromScaleIn) {
+			snapshot.ProtectedInstances = append(snapshot.ProtectedInstances, id)
+		}
+	}
+	if lt := group.LaunchTemplate; lt != nil {
+		snapshot.LaunchTemplate = &LaunchTemplateVersion{
+			ID:      aws.StringValue(lt.LaunchTemplateId),
+			Name:    aws.StringValue(lt.LaunchTemplateName),
+			Version: aws.StringValue(lt.Version),
+		}
+	}
+
+	started := time.Now()
+	run := &Run{
+		ID:          NewRunID(clst.asg.name, started),
+		Target:      c.Name,
+		Region:      c.Region,
+		Profile:     c.Profile,
+		RoleArn:     c.RoleArn,
+		Clustername: clst.name,
+		Started:     started,
+		Asg:         snapshot,
+		ClusterSize: clst.size,
+		NewestAMI:   clst.asg.newestami,
+		State:       fsm.State{Current: stepRecorded},
+	}
+	if c.StateDir != "" {
+		run.path = filepath.Join(c.StateDir, run.ID+".json")
+	}
+	if err := run.save(); err != nil {
+		return err
+	}
+	r.run = run
+	r.result.RunID = run.ID
+	return nil
+}
+
+// Rollback undoes a replacement: it reactivates the container instances
+// the run drained and that are still draining, terminates the instances launched
+// since the run started that did not join the cluster, and restores the sizes,
+// scale in protection and launch template of the asg, as well as the launch template
+// version the run created.
+func (r *Replacer) Rollback(run *Run) error {
+
+	log.Logger.Infof("Roll back run %s of asg %s", run.ID, run.Asg.Name)
+	status, err := r.clusterStatus(run.Clustername)
+	if err != nil {
+		return xerrors.Errorf("Failed to get cluster status: %w", err)
+	}
+	drained := map[string]bool{}
+	for _, inst := range run.Progress {
+		drained[inst.InstanceArn] = true
+	}
+	joined := map[string]bool{}
+	var reactivate []string
+	for _, st := range status.ContainerInstances {
+		arn := aws.StringValue(st.ContainerInstanceArn)
+		switch {
+		case aws.StringValue(st.Status) == "DRAINING" && drained[arn]:
+			reactivate = append(reactivate, arn)
+		case aws.StringValue(st.Status) == "ACTIVE" && aws.BoolValue(st.AgentConnected):
+			joined[aws.StringValue(st.Ec2InstanceId)] = true
+		}
+	}
+	if len(reactivate) != 0 {
+		log.Logger.Infof("Reactivate drained container instances: %v", reactivate)
+		_, err := r.asg.EcsAPI.UpdateContainerInstancesState(&ecs.UpdateContainerInstancesStateInput{
+			Cluster:            aws.String(run.Clustername),
+			ContainerInstances: aws.StringSlice(reactivate),
+			Status:             aws.String("ACTIVE"),
+		})
+		if err != nil {
+			return xerrors.Errorf("Failed to reactivate container instances: %w", err)
+		}
+	}
+
+	asginfo, err := r.asgInfo(run.Asg.Name)
+	if err != nil {
+		return xerrors.Errorf("Failed to get asg info: %w", err)
+	}
+	if len(asginfo) == 0 {
+		return xerrors.Errorf("asg %s not found", run.Asg.Name)
+	}
+	group := asginfo[0]
+
+	// the min size goes first, so that terminating instances can lower the desired capacity.
+	restore := &autoscaling.UpdateAutoScalingGroupInput{
+		AutoScalingGroupName:             aws.String(run.Asg.Name),
+		MinSize:                          aws.Int64(run.Asg.MinSize),
+		NewInstancesProtectedFromScaleIn: aws.Bool(run.Asg.NewInstancesProtectedFromScaleIn),
+	}
+	if lt := run.Asg.LaunchTemplate; lt != nil {
+		restore.LaunchTemplate = &autoscaling.LaunchTemplateSpecification{
+			LaunchTemplateId: aws.String(lt.ID),
+			Version:          aws.String(lt.Version),
+		}
+	}
+	if _, err := r.asg.AsgAPI.UpdateAutoScalingGroup(restore); err != nil {
+		return xerrors.Errorf("Failed to restore asg %s: %w", run.Asg.Name, err)
+	}
+	if run.Template != nil {
+		if err := r.restoreLaunchTemplate(run.Template); err != nil {
+			return err
+		}
+	}
+
+	original := map[string]bool{}
+	for _, id := range run.Asg.Instances {
+		original[id] = true
+	}
+	present := map[string]bool{}
+	excess := aws.Int64Value(group.DesiredCapacity) - run.Asg.DesiredCapacity
+	for _, inst := range group.Instances {
+		id := aws.StringValue(inst.InstanceId)
+		present[id] = true
+		if original[id] || joined[id] {
+			continue
+		}
+		// faulty instances beyond the original size go away, the others are replaced.
+		decrement := excess > 0
+		if decrement {
+			excess--
+		}
+		log.Logger.Infof("Terminate instance %s which has not joined cluster %s", id, run.Clustername)
+		_, err := r.asg.AsgAPI.TerminateInstanceInAutoScalingGroup(&autoscaling.TerminateInstanceInAutoScalingGroupInput{
+			InstanceId:                     aws.String(id),
+			ShouldDecrementDesiredCapacity: aws.Bool(decrement),
+		})
+		if err != nil {
+			return xerrors.Errorf("Failed to terminate instance %s: %w", id, err)
+		}
+	}
+
+	if _, err := r.updateDesiredCapacity(run.Asg.Name, run.Asg.DesiredCapacity); err != nil {
+		return xerrors.Errorf("Failed to restore asg %s: %w", run.Asg.Name, err)
+	}
+	for _, id := range run.Asg.ProtectedInstances {
+		if !present[id] {
+			continue
+		}
+		if _, err := r.setScaleinProtection(id, run.Asg.Name); err != nil {
+			return xerrors.Errorf("Failed to restore scale in protection of %s: %w", id, err)
+		}
+	}
+
+	run.RolledBack = true
+	if err := run.save(); err != nil {
+		return err
+	}
+	log.Logger.Infof("Successfully rolled back run %s", run.ID)
+	return nil
+}
+
+func (r *Replacer) updateDesiredCapacity(asgname string, desired int64) (*autoscaling.UpdateAutoScalingGroupOutput, error) {
+
+	log.Logger.Infof("Update asg %s desired capacity to %d", asgname, desired)
+	params := &autoscaling.UpdateAutoScalingGroupInput{
+		AutoScalingGroupName: aws.String(asgname),
+		DesiredCapacity:      aws.Int64(desired),
+	}
+	return r.asg.AsgAPI.UpdateAutoScalingGroup(params)
+}
@@ -0,0 +1,111 @@
+package actions
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestRollback_LoadRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ami-replacer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	started := time.Date(2019, 4, 1, 12, 30, 0, 0, time.UTC)
+	id := NewRunID("api-asg", started)
+	if want := "20190401T123000-api-asg"; id != want {
+		t.Errorf("got: %s\nwant: %s", id, want)
+	}
+	run := &Run{
+		ID:          id,
+		Region:      "ap-northeast-1",
+		Profile:     "admin",
+		Clustername: "api-cluster",
+		Started:     started,
+		Asg: AsgSnapshot{
+			Name:            "api-asg",
+			DesiredCapacity: 2,
+			MinSize:         2,
+			Instances:       []string{"i-0", "i-1"},
+			LaunchTemplate:  &LaunchTemplateVersion{ID: "lt-0", Version: "7"},
+		},
+		Progress: []InstanceProgress{{InstanceID: "i-0", InstanceArn: "arn0", Step: instanceDraining}},
+		path:     filepath.Join(dir, id+".json"),
+	}
+	if err := run.save(); err != nil {
+		t.Fatalf("got: %v\nwant: %v", err, nil)
+	}
+	got, err := LoadRun(dir, id)
+	if err != nil {
+		t.Fatalf("got: %v\nwant: %v", err, nil)
+	}
+	if !reflect.DeepEqual(got, run) {
+		t.Errorf("got: %+v\nwant: %+v", got, run)
+	}
+	if _, err := LoadRun(dir, "unknown"); err == nil {
+		t.Errorf("should raise error: %v", err)
+	}
+}
+
+func TestRollback_Rollback(t *testing.T) {
+	mockreplacer := NewMockReplacer(
+		context.Background(),
+		"ap-northeast-1",
+		"admin",
+	)
+	run := &Run{
+		ID:          "20190401T123000-ok",
+		Clustername: "during-deploy",
+		Asg: AsgSnapshot{
+			Name:               "ok",
+			DesiredCapacity:    2,
+			MinSize:            2,
+			Instances:          []string{"i-00000000000000000", "i-gone"},
+			ProtectedInstances: []string{"i-00000000000000000", "i-gone"},
+			LaunchTemplate:     &LaunchTemplateVersion{ID: "lt-00000000000000000", Version: "7"},
+		},
+		Progress: []InstanceProgress{{InstanceID: "instance2", InstanceArn: "arn2", Step: instanceDraining}},
+		Template: &TemplateUpdate{ID: "lt-00000000000000000", Version: "100", DefaultVersion: "99"},
+	}
+	if err := mockreplacer.Rollback(run); err != nil {
+		t.Fatalf("got: %v\nwant: %v", err, nil)
+	}
+	if !run.RolledBack {
+		t.Errorf("got: %v\nwant: %v", run.RolledBack, true)
+	}
+
+	ecsapi := mockreplacer.asg.EcsAPI.(*mockECSiface)
+	if want := []string{"arn2"}; !reflect.DeepEqual(ecsapi.reactivated, want) {
+		t.Errorf("got: %v\nwant: %v", ecsapi.reactivated, want)
+	}
+	ec2api := mockreplacer.asg.Ec2Api.(*mockEC2iface)
+	wantTemplates := []string{"default lt-00000000000000000 99", "delete lt-00000000000000000 100"}
+	if !reflect.DeepEqual(ec2api.templates, wantTemplates) {
+		t.Errorf("got: %v\nwant: %v", ec2api.templates, wantTemplates)
+	}
+	asgapi := mockreplacer.asg.AsgAPI.(*mockASGiface)
+	if want := []string{"i-00000000000000001 decrement=true"}; !reflect.DeepEqual(asgapi.terminated, want) {
+		t.Errorf("got: %v\nwant: %v", asgapi.terminated, want)
+	}
+	if want := []string{"i-00000000000000000"}; !reflect.DeepEqual(asgapi.protected, want) {
+		t.Errorf("got: %v\nwant: %v", asgapi.protected, want)
+	}
+	if len(asgapi.updates) != 2 {
+		t.Fatalf("got: %d updates\nwant: %d", len(asgapi.updates), 2)
+	}
+	restore, resize := asgapi.updates[0], asgapi.updates[1]
+	if aws.Int64Value(restore.MinSize) != 2 || aws.StringValue(restore.LaunchTemplate.Version) != "7" {
+		t.Errorf("got: %v\nwant: min size 2 and launch template version 7", restore)
+	}
+	if aws.Int64Value(resize.DesiredCapacity) != 2 {
+		t.Errorf("got: %v\nwant: desired capacity 2", resize)
+	}
+}
@@ -0,0 +1,101 @@
+package actions
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nest-egg/ami-replacer/config"
+	"github.com/nest-egg/ami-replacer/log"
+	"golang.org/x/xerrors"
+)
+
+// RunOptions controls how targets are processed.
+type RunOptions struct {
+	Concurrency int
+	FailFast    bool
+}
+
+// RunTargets runs fn against every target with at most opts.Concurrency
+// targets in flight. A failing target does not abort the others unless
+// opts.FailFast is set, in which case targets not yet started are skipped.
+// Results are returned in the order of confs.
+func RunTargets(confs []*config.Config, opts RunOptions, fn func(*config.Config, *Result) error) Results {
+
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	results := make(Results, len(confs))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed bool
+
+	for i, conf := range confs {
+		sem <- struct{}{}
+		mu.Lock()
+		abort := failed && opts.FailFast
+		mu.Unlock()
+		if abort {
+			<-sem
+			results[i] = &Result{Target: conf.Name, Account: accountOf(conf), Skipped: true}
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, conf *config.Config) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			res := &Result{
+				Target:  conf.Name,
+				Account: accountOf(conf),
+				Started: time.Now(),
+			}
+			err := fn(conf, res)
+			res.finish(err)
+			results[i] = res
+			if err != nil {
+				log.Logger.Errorf("Target %s failed: %+v", conf.Name, err)
+				mu.Lock()
+				failed = true
+				mu.Unlock()
+			}
+		}(i, conf)
+	}
+	wg.Wait()
+	return results
+}
+
+// Summarize logs one line per target and returns an error
+// when any target failed or was skipped.
+func Summarize(results Results) error {
+
+	var failed, skipped int
+	for _, res := range results {
+		switch {
+		case res.Skipped:
+			skipped++
+			log.Logger.Infof("%-30s SKIPPED", res.Target)
+		case res.Err != nil:
+			failed++
+			log.Logger.Infof("%-30s FAILED  (%s) %v", res.Target, res.Elapsed.Round(time.Second), res.Err)
+		default:
+			log.Logger.Infof("%-30s OK      (%s)", res.Target, res.Elapsed.Round(time.Second))
+		}
+	}
+	log.Logger.Infof("%d targets: %d succeeded, %d failed, %d skipped",
+		len(results), len(results)-failed-skipped, failed, skipped)
+	if accounts := results.Accounts(); len(accounts) > 1 {
+		for _, a := range accounts {
+			log.Logger.Infof("account %s: %d targets, %d failed, %d images, %d snapshots, %d instances",
+				a.Account, a.Targets, a.Failed, a.Images, a.Snapshots, a.Instances)
+		}
+	}
+
+	if failed != 0 || skipped != 0 {
+		return xerrors.Errorf("%d of %d targets failed", failed, len(results))
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package actions
+
+import (
+	"context"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nest-egg/ami-replacer/config"
+	"golang.org/x/xerrors"
+)
+
+func TestRunner_RunTargets(t *testing.T) {
+	testCases := []struct {
+		name        string
+		targets     []string
+		concurrency int
+		failFast    bool
+		wantFailed  int
+		wantSkipped int
+	}{
+		{
+			name:        "ok",
+			targets:     []string{"a", "b", "c", "d"},
+			concurrency: 2,
+		},
+		{
+			name:        "failure does not abort other targets",
+			targets:     []string{"a", "fail", "c", "d"},
+			concurrency: 1,
+			wantFailed:  1,
+		},
+		{
+			name:        "fail fast",
+			targets:     []string{"a", "fail", "c", "d"},
+			concurrency: 1,
+			failFast:    true,
+			wantFailed:  1,
+			wantSkipped: 2,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var confs []*config.Config
+			for _, name := range tc.targets {
+				confs = append(confs, &config.Config{Name: name})
+			}
+			var running, maxRunning int32
+			results := RunTargets(confs, RunOptions{Concurrency: tc.concurrency, FailFast: tc.failFast}, func(c *config.Config, res *Result) error {
+				n := atomic.AddInt32(&running, 1)
+				defer atomic.AddInt32(&running, -1)
+				for {
+					m := atomic.LoadInt32(&maxRunning)
+					if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+						break
+					}
+				}
+				if c.Name == "fail" {
+					return xerrors.New("failed")
+				}
+				return nil
+			})
+
+			var failed, skipped int
+			for i, res := range results {
+				if res.Target != tc.targets[i] {
+					t.Errorf("got: %s\nwant: %s", res.Target, tc.targets[i])
+				}
+				if res.Err != nil {
+					failed++
+				}
+				if res.Skipped {
+					skipped++
+				}
+			}
+			if failed != tc.wantFailed || skipped != tc.wantSkipped {
+				t.Errorf("got: %d failed %d skipped\nwant: %d failed %d skipped", failed, skipped, tc.wantFailed, tc.wantSkipped)
+			}
+			if int(maxRunning) > tc.concurrency {
+				t.Errorf("got: %d targets in flight\nwant: at most %d", maxRunning, tc.concurrency)
+			}
+			if err := Summarize(results); (err != nil) != (tc.wantFailed != 0) {
+				t.Errorf("unexpected summary error: %v", err)
+			}
+		})
+	}
+}
+
+func TestRunner_Accounts(t *testing.T) {
+	confs := []*config.Config{
+		{Name: "tools", Profile: "admin"},
+		{Name: "prod-api", Profile: "admin", RoleArn: "arn:aws:iam::111111111111:role/ami-replacer"},
+		{Name: "prod-worker", Profile: "admin", RoleArn: "arn:aws:iam::111111111111:role/ami-replacer"},
+		{Name: "staging", Profile: "admin", RoleArn: "arn:aws:iam::222222222222:role/ami-replacer", ExternalID: "ext"},
+	}
+	results := RunTargets(confs, RunOptions{Concurrency: 2}, func(c *config.Config, res *Result) error {
+		if c.Name == "prod-worker" {
+			return xerrors.New("failed")
+		}
+		res.Images = append(res.Images, ImageSummary{ImageID: "ami-" + c.Name})
+		return nil
+	})
+	want := []AccountSummary{
+		{Account: "admin", Targets: 1, Images: 1},
+		{Account: "111111111111", Targets: 2, Failed: 1, Images: 1},
+		{Account: "222222222222", Targets: 1, Images: 1},
+	}
+	if got := results.Accounts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %+v\nwant: %+v", got, want)
+	}
+}
+
+func TestRunner_RemoveAMIsUpToDate(t *testing.T) {
+	confs := []*config.Config{
+		{Name: "outdated", Image: "testimage*", Owner: "owner", Generation: 2},
+		{Name: "up-to-date", Image: "testimage*", Owner: "owner", Generation: 3},
+		{Name: "last", Image: "testimage*", Owner: "owner", Generation: 2},
+	}
+	results := RunTargets(confs, RunOptions{Concurrency: 1, FailFast: true}, func(c *config.Config, res *Result) error {
+		mockreplacer := NewMockReplacer(context.Background(), "ap-northeast-1", "admin")
+		mockreplacer.Record(res)
+		return mockreplacer.RemoveAMIs(c)
+	})
+	var got []int
+	for _, res := range results {
+		if res.Err != nil || res.Skipped {
+			t.Errorf("got: %s failed with %v, skipped %v\nwant: success", res.Target, res.Err, res.Skipped)
+		}
+		got = append(got, len(res.Images))
+	}
+	if want := []int{1, 0, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v deregistered images\nwant: %v", got, want)
+	}
+	if err := Summarize(results); err != nil {
+		t.Errorf("got: %v\nwant: %v", err, nil)
+	}
+}
@@ -0,0 +1,102 @@
+package actions
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/nest-egg/ami-replacer/config"
+	"github.com/nest-egg/ami-replacer/log"
+	"golang.org/x/xerrors"
+)
+
+// publicImage names the launch permission of the "all" group of public images.
+const publicImage = "public"
+
+// launchPermissions returns the launch permissions granted to other accounts.
+func (r *Replacer) launchPermissions(imageid string) ([]*ec2.LaunchPermission, error) {
+
+	output, err := r.asg.Ec2Api.DescribeImageAttribute(&ec2.DescribeImageAttributeInput{
+		Attribute: aws.String(ec2.ImageAttributeNameLaunchPermission),
+		ImageId:   aws.String(imageid),
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("Failed to describe launch permissions of image %s: %w", imageid, err)
+	}
+	return output.LaunchPermissions, nil
+}
+
+// sharedWith lists the accounts, organizations and organizational units of launch permissions,
+// and "public" for the "all" group.
+func sharedWith(perms []*ec2.LaunchPermission) []string {
+	var accounts []string
+	for _, perm := range perms {
+		switch {
+		case perm.UserId != nil:
+			accounts = append(accounts, aws.StringValue(perm.UserId))
+		case perm.OrganizationArn != nil:
+			accounts = append(accounts, aws.StringValue(perm.OrganizationArn))
+		case perm.OrganizationalUnitArn != nil:
+			accounts = append(accounts, aws.StringValue(perm.OrganizationalUnitArn))
+		case aws.StringValue(perm.Group) == ec2.PermissionGroupAll:
+			accounts = append(accounts, publicImage)
+		}
+	}
+	return accounts
+}
+
+// excludeShared skips images shared with other accounts, organizations or organizational units or made public,
+// since deregistering them breaks their consumers. With c.ForceUnshare
+// every image is kept, and deregisterImages revokes the permissions first.
+func (r *Replacer) excludeShared(c *config.Config, images []*ec2.Image) ([]*ec2.Image, []SkippedImage, error) {
+
+	if c.ForceUnshare {
+		return images, nil, nil
+	}
+	var free []*ec2.Image
+	var skipped []SkippedImage
+	for _, image := range images {
+		id := aws.StringValue(image.ImageId)
+		perms, err := r.launchPermissions(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		accounts := sharedWith(perms)
+		if len(accounts) == 0 {
+			free = append(free, image)
+			continue
+		}
+		log.Logger.Infof("Skip image %s shared with %v", id, accounts)
+		skipped = append(skipped, SkippedImage{
+			ImageID: id,
+			Name:    aws.StringValue(image.Name),
+			Reason:  "shared with " + strings.Join(accounts, ", ") + ", use --force-unshare to revoke",
+		})
+	}
+	return free, skipped, nil
+}
+
+// unshare revokes every launch permission of image and returns the accounts it was shared with.
+func (r *Replacer) unshare(imageid string) ([]string, error) {
+
+	perms, err := r.launchPermissions(imageid)
+	if err != nil {
+		return nil, err
+	}
+	if len(perms) == 0 {
+		return nil, nil
+	}
+	_, err = r.asg.Ec2Api.ModifyImageAttribute(&ec2.ModifyImageAttributeInput{
+		DryRun:  aws.Bool(r.dryrun),
+		ImageId: aws.String(imageid),
+		LaunchPermission: &ec2.LaunchPermissionModifications{
+			Remove: perms,
+		},
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("Failed to revoke launch permissions of image %s: %w", imageid, err)
+	}
+	accounts := sharedWith(perms)
+	log.Logger.Infof("Revoked launch permissions of image %s from %v", imageid, accounts)
+	return accounts, nil
+}
@@ -0,0 +1,114 @@
+package actions
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nest-egg/ami-replacer/config"
+)
+
+func TestSharing_RemoveAMIs(t *testing.T) {
+	testCases := []struct {
+		name         string
+		image        string
+		forceUnshare bool
+		wantImages   []string
+		wantUnshared [][]string
+		wantSkipped  map[string]string
+	}{
+		{
+			name: "refuse_shared",
+			wantSkipped: map[string]string{
+				"ami-shared-2": "shared with 111111111111, 222222222222",
+				"ami-public-1": "shared with public",
+			},
+		},
+		{
+			name:         "force_unshare",
+			forceUnshare: true,
+			wantImages:   []string{"ami-shared-2", "ami-public-1"},
+			wantUnshared: [][]string{{"111111111111", "222222222222"}, {"public"}},
+		},
+		{
+			name:  "refuse_organization",
+			image: "org-shared*",
+			wantSkipped: map[string]string{
+				"ami-org-2": "shared with arn:aws:organizations::111111111111:organization/o-example",
+				"ami-ou-1":  "shared with arn:aws:organizations::111111111111:ou/o-example/ou-example",
+			},
+		},
+		{
+			name:         "force_unshare_organization",
+			image:        "org-shared*",
+			forceUnshare: true,
+			wantImages:   []string{"ami-org-2", "ami-ou-1"},
+			wantUnshared: [][]string{
+				{"arn:aws:organizations::111111111111:organization/o-example"},
+				{"arn:aws:organizations::111111111111:ou/o-example/ou-example"},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockreplacer := NewMockReplacer(
+				context.Background(),
+				"ap-northeast-1",
+				"admin",
+			)
+			res := &Result{Target: tc.name}
+			mockreplacer.Record(res)
+			if tc.image == "" {
+				tc.image = "shared*"
+			}
+			conf := &config.Config{
+				Image:        tc.image,
+				Owner:        "owner",
+				Generation:   2,
+				ForceUnshare: tc.forceUnshare,
+			}
+			if err := mockreplacer.RemoveAMIs(conf); err != nil {
+				t.Fatalf("got: %v\nwant: %v", err, nil)
+			}
+			var gotImages []string
+			var gotUnshared [][]string
+			for _, image := range res.Images {
+				gotImages = append(gotImages, image.ImageID)
+				gotUnshared = append(gotUnshared, image.Unshared)
+			}
+			if !reflect.DeepEqual(gotImages, tc.wantImages) || !reflect.DeepEqual(gotUnshared, tc.wantUnshared) {
+				t.Errorf("got: %v unshared from %v\nwant: %v unshared from %v", gotImages, gotUnshared, tc.wantImages, tc.wantUnshared)
+			}
+			if len(res.SkippedImages) != len(tc.wantSkipped) {
+				t.Fatalf("got: %d skipped\nwant: %d", len(res.SkippedImages), len(tc.wantSkipped))
+			}
+			for _, image := range res.SkippedImages {
+				if !strings.Contains(image.Reason, tc.wantSkipped[image.ImageID]) {
+					t.Errorf("got: %s skipped for %q\nwant: %q", image.ImageID, image.Reason, tc.wantSkipped[image.ImageID])
+				}
+			}
+		})
+	}
+}
+
+func TestSharing_PlanAMIs(t *testing.T) {
+	mockreplacer := NewMockReplacer(
+		context.Background(),
+		"ap-northeast-1",
+		"admin",
+	)
+	conf := &config.Config{
+		Image:        "shared*",
+		Owner:        "owner",
+		Generation:   2,
+		ForceUnshare: true,
+	}
+	p := &Plan{Target: "shared"}
+	if err := mockreplacer.PlanAMIs(conf, p); err != nil {
+		t.Fatalf("got: %v\nwant: %v", err, nil)
+	}
+	if len(p.Images) != 2 || !reflect.DeepEqual(p.Images[1].Unshared, []string{"public"}) {
+		t.Errorf("got: %+v\nwant: ami-public-1 unshared from public", p.Images)
+	}
+}
@@ -0,0 +1,105 @@
+package actions
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/nest-egg/ami-replacer/config"
+	"golang.org/x/xerrors"
+)
+
+// Tags and description prefixes AWS Backup and Data Lifecycle Manager put on their snapshots.
+const (
+	backupTag         = "aws:backup:source-resource"
+	backupDescription = "This snapshot is created by the AWS Backup service"
+	dlmPolicyTag      = "aws:dlm:lifecycle-policy-id"
+	dlmManagedTag     = "dlm:managed"
+	dlmDescription    = "Created for policy: "
+)
+
+// SkippedSnapshot is a snapshot excluded from deletion.
+type SkippedSnapshot struct {
+	SnapshotID string `json:"snapshot_id" yaml:"snapshot_id"`
+	Reason     string `json:"reason" yaml:"reason"`
+}
+
+// snapshotFilter selects the snapshots rms may delete by c.SnapshotTags,
+// c.ExcludeTags, c.Description and c.MinAge.
+type snapshotFilter struct {
+	tags        []config.TagFilter
+	excludeTags []config.TagFilter
+	description *regexp.Regexp
+	minAge      time.Duration
+}
+
+func newSnapshotFilter(c *config.Config) (*snapshotFilter, error) {
+
+	tags, err := config.ParseTagFilters(c.SnapshotTags)
+	if err != nil {
+		return nil, xerrors.Errorf("Invalid snapshot tag: %w", err)
+	}
+	excludeTags, err := config.ParseTagFilters(c.ExcludeTags)
+	if err != nil {
+		return nil, xerrors.Errorf("Invalid exclude tag: %w", err)
+	}
+	f := &snapshotFilter{tags: tags, excludeTags: excludeTags, minAge: c.MinAge}
+	if c.Description != "" {
+		f.description, err = regexp.Compile(c.Description)
+		if err != nil {
+			return nil, xerrors.Errorf("Invalid description regex: %w", err)
+		}
+	}
+	return f, nil
+}
+
+// match reports whether snapshot is selected, and why it is kept otherwise.
+// Snapshots merely not selected have no reason, only managed and excluded ones do.
+func (f *snapshotFilter) match(snapshot *ec2.Snapshot, now time.Time) (bool, string) {
+
+	if by := managedBy(snapshot); by != "" {
+		return false, "managed by " + by
+	}
+	tags := snapshotTags(snapshot)
+	for _, tag := range f.excludeTags {
+		if tag.Match(tags) {
+			return false, "excluded by tag " + tag.String()
+		}
+	}
+	if !config.MatchAll(f.tags, tags) {
+		return false, ""
+	}
+	if f.description != nil && !f.description.MatchString(aws.StringValue(snapshot.Description)) {
+		return false, ""
+	}
+	if f.minAge > 0 && now.Sub(aws.TimeValue(snapshot.StartTime)) < f.minAge {
+		return false, ""
+	}
+	return true, ""
+}
+
+// managedBy names the service managing snapshot, AWS Backup or Data Lifecycle Manager,
+// or returns "". Deleting their snapshots would break their retention and restore points.
+func managedBy(snapshot *ec2.Snapshot) string {
+	tags := snapshotTags(snapshot)
+	description := aws.StringValue(snapshot.Description)
+	if _, ok := tags[backupTag]; ok || strings.HasPrefix(description, backupDescription) {
+		return "AWS Backup"
+	}
+	_, policy := tags[dlmPolicyTag]
+	_, managed := tags[dlmManagedTag]
+	if policy || managed || strings.HasPrefix(description, dlmDescription) {
+		return "Data Lifecycle Manager"
+	}
+	return ""
+}
+
+func snapshotTags(snapshot *ec2.Snapshot) map[string]string {
+	tags := make(map[string]string, len(snapshot.Tags))
+	for _, tag := range snapshot.Tags {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return tags
+}
@@ -0,0 +1,157 @@
+package actions
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/nest-egg/ami-replacer/config"
+)
+
+func TestSnapfilter_managedBy(t *testing.T) {
+	testCases := []struct {
+		name     string
+		snapshot *ec2.Snapshot
+		want     string
+	}{
+		{
+			name:     "unmanaged",
+			snapshot: &ec2.Snapshot{Description: aws.String("Created by CreateImage")},
+		},
+		{
+			name: "backup_tag",
+			snapshot: &ec2.Snapshot{Tags: []*ec2.Tag{{
+				Key:   aws.String("aws:backup:source-resource"),
+				Value: aws.String("vol-0123"),
+			}}},
+			want: "AWS Backup",
+		},
+		{
+			name:     "backup_description",
+			snapshot: &ec2.Snapshot{Description: aws.String("This snapshot is created by the AWS Backup service.")},
+			want:     "AWS Backup",
+		},
+		{
+			name: "dlm_tag",
+			snapshot: &ec2.Snapshot{Tags: []*ec2.Tag{{
+				Key:   aws.String("dlm:managed"),
+				Value: aws.String("true"),
+			}}},
+			want: "Data Lifecycle Manager",
+		},
+		{
+			name:     "dlm_description",
+			snapshot: &ec2.Snapshot{Description: aws.String("Created for policy: policy-0123 schedule: Daily")},
+			want:     "Data Lifecycle Manager",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := managedBy(tc.snapshot); got != tc.want {
+				t.Errorf("got: %q\nwant: %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSnapfilter_match(t *testing.T) {
+	now := time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC)
+	snapshot := &ec2.Snapshot{
+		SnapshotId:  aws.String("snap-1"),
+		Description: aws.String("Created by CreateImage(i-0123) for ami-0123"),
+		StartTime:   aws.Time(now.AddDate(0, 0, -10)),
+		Tags:        []*ec2.Tag{{Key: aws.String("Team"), Value: aws.String("infra")}},
+	}
+	testCases := []struct {
+		name       string
+		conf       config.Config
+		want       bool
+		wantReason string
+	}{
+		{
+			name: "no_filter",
+			want: true,
+		},
+		{
+			name: "old_enough",
+			conf: config.Config{MinAge: 7 * 24 * time.Hour},
+			want: true,
+		},
+		{
+			name: "too_young",
+			conf: config.Config{MinAge: 30 * 24 * time.Hour},
+		},
+		{
+			name: "tag",
+			conf: config.Config{SnapshotTags: []string{"Team=infra"}},
+			want: true,
+		},
+		{
+			name: "other_tag",
+			conf: config.Config{SnapshotTags: []string{"Team=web"}},
+		},
+		{
+			name:       "exclude_tag",
+			conf:       config.Config{ExcludeTags: []string{"Team"}},
+			wantReason: "excluded by tag Team",
+		},
+		{
+			name: "description",
+			conf: config.Config{Description: `^Created by CreateImage`},
+			want: true,
+		},
+		{
+			name: "other_description",
+			conf: config.Config{Description: `^Copied for`},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := newSnapshotFilter(&tc.conf)
+			if err != nil {
+				t.Fatalf("got: %v\nwant: %v", err, nil)
+			}
+			got, reason := f.match(snapshot, now)
+			if got != tc.want || reason != tc.wantReason {
+				t.Errorf("got: %v %q\nwant: %v %q", got, reason, tc.want, tc.wantReason)
+			}
+		})
+	}
+}
+
+func TestSnapfilter_RemoveSnapShots(t *testing.T) {
+	mockreplacer := NewMockReplacer(
+		context.Background(),
+		"ap-northeast-1",
+		"admin",
+	)
+	res := &Result{Target: "filtered"}
+	mockreplacer.Record(res)
+	conf := &config.Config{
+		Owner:        "filtered",
+		MinAge:       30 * 24 * time.Hour,
+		SnapshotTags: []string{"Team=infra"},
+		ExcludeTags:  []string{"Retain=true"},
+	}
+	if err := mockreplacer.RemoveSnapShots(conf); err != nil {
+		t.Fatalf("got: %v\nwant: %v", err, nil)
+	}
+	var deleted []string
+	for _, s := range res.Snapshots {
+		deleted = append(deleted, s.SnapshotID)
+	}
+	if want := []string{"snap-free-old"}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("got: %v\nwant: %v", deleted, want)
+	}
+	want := []SkippedSnapshot{
+		{SnapshotID: "snap-free-backup", Reason: "managed by AWS Backup"},
+		{SnapshotID: "snap-free-dlm", Reason: "managed by Data Lifecycle Manager"},
+		{SnapshotID: "snap-free-excluded", Reason: "excluded by tag Retain=true"},
+	}
+	if !reflect.DeepEqual(res.SkippedSnapshots, want) {
+		t.Errorf("got: %+v\nwant: %+v", res.SkippedSnapshots, want)
+	}
+}
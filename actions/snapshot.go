@@ -2,10 +2,13 @@ package actions
 
 import (
 	"sort"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/nest-egg/ami-replacer/apis"
+	"github.com/nest-egg/ami-replacer/config"
+	"github.com/nest-egg/ami-replacer/log"
 	"golang.org/x/xerrors"
 )
 
@@ -29,7 +32,7 @@ func (r *Replacer) newestAMI(owner string, image string) (imageid string, err er
 func (r *Replacer) deleteSnapshot(snapshotid string) (result *ec2.DeleteSnapshotOutput, err error) {
 
 	params := &ec2.DeleteSnapshotInput{
-		DryRun:     aws.Bool(dryrun),
+		DryRun:     aws.Bool(r.dryrun),
 		SnapshotId: aws.String(snapshotid),
 	}
 	output, err := r.asg.Ec2Api.DeleteSnapshot(params)
@@ -64,6 +67,133 @@ func (r *Replacer) searchSnapshot(ownerid string) (result []*ec2.Snapshot, err e
 	return results, nil
 }
 
+// unusedSnapshots returns the snapshots of ownerid selected by c which no
+// image or volume uses, and the managed or excluded snapshots it spares.
+func (r *Replacer) unusedSnapshots(c *config.Config) ([]*ec2.Snapshot, []SkippedSnapshot, error) {
+
+	filter, err := newSnapshotFilter(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	result, err := r.searchSnapshot(c.Owner)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("Failed to search snapshots: %w", err)
+	}
+	sort.Sort(apis.VolumeSlice(result))
+
+	var candidates []*ec2.Snapshot
+	var skipped []SkippedSnapshot
+	now := time.Now()
+	for _, snapshot := range result {
+		id := aws.StringValue(snapshot.SnapshotId)
+		ok, reason := filter.match(snapshot, now)
+		if reason != "" {
+			log.Logger.Debugf("Skip snapshot %s %s", id, reason)
+			skipped = append(skipped, SkippedSnapshot{SnapshotID: id, Reason: reason})
+		}
+		if ok {
+			candidates = append(candidates, snapshot)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, skipped, nil
+	}
+	refs, err := r.referencedSnapshots(c.Owner)
+	if err != nil {
+		return nil, nil, err
+	}
+	var unused []*ec2.Snapshot
+	for _, snapshot := range candidates {
+		if !refs[aws.StringValue(snapshot.SnapshotId)] {
+			unused = append(unused, snapshot)
+		}
+	}
+	return unused, skipped, nil
+}
+
+// referencedSnapshots collects the snapshots used by the images of owner, the images
+// shared with the account and every volume of the region. Paging through them once
+// takes a few calls, where snapshotInUse takes two per snapshot.
+func (r *Replacer) referencedSnapshots(owner string) (map[string]bool, error) {
+
+	refs := map[string]bool{}
+	queries := []*ec2.DescribeImagesInput{
+		{Owners: []*string{aws.String(owner)}},
+		{ExecutableUsers: []*string{aws.String("self")}},
+	}
+	for _, params := range queries {
+		params.IncludeDeprecated = aws.Bool(true)
+		params.IncludeDisabled = aws.Bool(true)
+		params.MaxResults = aws.Int64(1000)
+		for {
+			output, err := r.asg.Ec2Api.DescribeImages(params)
+			if err != nil {
+				return nil, xerrors.Errorf("Failed to describe images: %w", err)
+			}
+			for _, image := range output.Images {
+				for _, ebs := range imageSnapshots(image) {
+					refs[aws.StringValue(ebs.SnapshotId)] = true
+				}
+			}
+			if aws.StringValue(output.NextToken) == "" {
+				break
+			}
+			params.NextToken = output.NextToken
+		}
+	}
+
+	params := &ec2.DescribeVolumesInput{MaxResults: aws.Int64(1000)}
+	for {
+		output, err := r.asg.Ec2Api.DescribeVolumes(params)
+		if err != nil {
+			return nil, xerrors.Errorf("Failed to describe volumes: %w", err)
+		}
+		for _, volume := range output.Volumes {
+			if id := aws.StringValue(volume.SnapshotId); id != "" {
+				refs[id] = true
+			}
+		}
+		if aws.StringValue(output.NextToken) == "" {
+			break
+		}
+		params.NextToken = output.NextToken
+	}
+	log.Logger.Debugf("%d snapshots are used by images or volumes", len(refs))
+	return refs, nil
+}
+
+// snapshotInUse reports whether a volume or an image other than
+// ignoreImage was created from the snapshot.
+func (r *Replacer) snapshotInUse(snapshotid string, ignoreImage string) (bool, error) {
+
+	snaps, err := r.imageExists(snapshotid)
+	if err != nil {
+		return false, xerrors.Errorf("Failed to get existing image: %w", err)
+	}
+	for _, image := range snaps.Images {
+		if aws.StringValue(image.ImageId) != ignoreImage {
+			return true, nil
+		}
+	}
+	volumes, err := r.volumeExists(snapshotid)
+	if err != nil {
+		return false, xerrors.Errorf("Failed to get existing volume: %w", err)
+	}
+	return len(volumes) != 0, nil
+}
+
+// imageSnapshots returns the ebs snapshots of the block device mappings of image.
+func imageSnapshots(image *ec2.Image) []*ec2.EbsBlockDevice {
+	var snapshots []*ec2.EbsBlockDevice
+	for _, bdm := range image.BlockDeviceMappings {
+		if bdm.Ebs == nil || aws.StringValue(bdm.Ebs.SnapshotId) == "" {
+			continue
+		}
+		snapshots = append(snapshots, bdm.Ebs)
+	}
+	return snapshots
+}
+
 func (r *Replacer) volumeExists(snapshotid string) (result []*ec2.Volume, err error) {
 
 	results := []*ec2.Volume{}
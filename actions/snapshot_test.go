@@ -2,7 +2,11 @@ package actions
 
 import (
 	"context"
+	"fmt"
 	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/nest-egg/ami-replacer/config"
 )
 
 func TestSnapshot_GetNewestAMI(t *testing.T) {
@@ -187,3 +191,59 @@ func TestSnapshot_ImageExists(t *testing.T) {
 
 	}
 }
+
+func TestSnapshot_unusedSnapshots(t *testing.T) {
+	testCases := []struct {
+		name       string
+		owner      string
+		wantUnused int
+	}{
+		{
+			name:  "in_use",
+			owner: "owner",
+		},
+		{
+			name:       "paged",
+			owner:      mockSweepOwner,
+			wantUnused: 2500,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockreplacer := NewMockReplacer(
+				context.Background(),
+				"ap-northeast-1",
+				"admin",
+			)
+			unused, _, err := mockreplacer.unusedSnapshots(&config.Config{Owner: tc.owner})
+			if err != nil {
+				t.Fatalf("got: %v\nwant: %v", err, nil)
+			}
+			if len(unused) != tc.wantUnused {
+				t.Errorf("got: %d\nwant: %d", len(unused), tc.wantUnused)
+			}
+			for _, snapshot := range unused {
+				var i int
+				fmt.Sscanf(aws.StringValue(snapshot.SnapshotId), "snap-sweep-%d", &i)
+				if i%4 != 3 {
+					t.Errorf("got: %s\nwant: unused snapshot", aws.StringValue(snapshot.SnapshotId))
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSnapshot_unusedSnapshots(b *testing.B) {
+	mockreplacer := NewMockReplacer(
+		context.Background(),
+		"ap-northeast-1",
+		"admin",
+	)
+	conf := &config.Config{Owner: mockSweepOwner}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := mockreplacer.unusedSnapshots(conf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package actions
+
+import (
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/nest-egg/ami-replacer/config"
+	"github.com/nest-egg/ami-replacer/log"
+	"golang.org/x/xerrors"
+)
+
+// TemplateUpdate is a launch template version rpl created with the newest AMI.
+type TemplateUpdate struct {
+	ID      string `json:"id"`
+	Version string `json:"version"`
+	// DefaultVersion is the default version before the new one replaced it, restored by a rollback.
+	DefaultVersion string `json:"default_version,omitempty"`
+}
+
+// updateLaunchTemplate creates a version of the launch template of the asg launching the newest AMI,
+// copied from the version the asg launches, and makes the asg launch it as c.UpdateTemplate tells.
+// A resumed run keeps the version it created.
+func (r *Replacer) updateLaunchTemplate(c *config.Config, clst *cluster) error {
+
+	if c.UpdateTemplate == "" || (r.run != nil && r.run.Template != nil) {
+		return nil
+	}
+	id, source, err := r.launchTemplateSource(c, clst)
+	if err != nil {
+		return err
+	}
+	sourceVersion := strconv.FormatInt(aws.Int64Value(source.VersionNumber), 10)
+	if aws.StringValue(source.LaunchTemplateData.ImageId) == clst.asg.newestami {
+		log.Logger.Infof("Version %s of launch template %s already launches %s", sourceVersion, id, clst.asg.newestami)
+		return nil
+	}
+	if r.dryrun {
+		log.Logger.Infof("Would create a version of launch template %s from version %s with %s", id, sourceVersion, clst.asg.newestami)
+		return nil
+	}
+
+	created, err := r.asg.Ec2Api.CreateLaunchTemplateVersion(&ec2.CreateLaunchTemplateVersionInput{
+		LaunchTemplateId:   aws.String(id),
+		SourceVersion:      aws.String(sourceVersion),
+		VersionDescription: aws.String("ami-replacer: " + clst.asg.newestami),
+		LaunchTemplateData: &ec2.RequestLaunchTemplateData{
+			ImageId: aws.String(clst.asg.newestami),
+		},
+	})
+	if err != nil {
+		return xerrors.Errorf("Failed to create launch template version: %w", err)
+	}
+	update := &TemplateUpdate{
+		ID:      id,
+		Version: strconv.FormatInt(aws.Int64Value(created.LaunchTemplateVersion.VersionNumber), 10),
+	}
+	log.Logger.Infof("Created version %s of launch template %s with %s", update.Version, id, clst.asg.newestami)
+	r.result.LaunchTemplate = id + ":" + update.Version
+
+	switch c.UpdateTemplate {
+	case config.TemplateDefault:
+		templates, err := r.asg.Ec2Api.DescribeLaunchTemplates(&ec2.DescribeLaunchTemplatesInput{
+			LaunchTemplateIds: aws.StringSlice([]string{id}),
+		})
+		if err != nil {
+			return xerrors.Errorf("Failed to describe launch templates: %w", err)
+		}
+		if len(templates.LaunchTemplates) != 0 {
+			update.DefaultVersion = strconv.FormatInt(aws.Int64Value(templates.LaunchTemplates[0].DefaultVersionNumber), 10)
+		}
+		if err := r.recordTemplate(update); err != nil {
+			return err
+		}
+		_, err = r.asg.Ec2Api.ModifyLaunchTemplate(&ec2.ModifyLaunchTemplateInput{
+			LaunchTemplateId: aws.String(id),
+			DefaultVersion:   aws.String(update.Version),
+		})
+		if err != nil {
+			return xerrors.Errorf("Failed to set the default version of launch template %s: %w", id, err)
+		}
+	case config.TemplatePin:
+		if err := r.recordTemplate(update); err != nil {
+			return err
+		}
+		_, err := r.asg.AsgAPI.UpdateAutoScalingGroup(&autoscaling.UpdateAutoScalingGroupInput{
+			AutoScalingGroupName: aws.String(clst.asg.name),
+			LaunchTemplate: &autoscaling.LaunchTemplateSpecification{
+				LaunchTemplateId: aws.String(id),
+				Version:          aws.String(update.Version),
+			},
+		})
+		if err != nil {
+			return xerrors.Errorf("Failed to pin asg %s to version %s: %w", clst.asg.name, update.Version, err)
+		}
+	}
+	return nil
+}
+
+// launchTemplateSource returns the launch template of the asg and the version the asg launches,
+// which the version created by updateLaunchTemplate is copied from.
+func (r *Replacer) launchTemplateSource(c *config.Config, clst *cluster) (string, *ec2.LaunchTemplateVersion, error) {
+
+	asginfo, err := r.asgInfo(clst.asg.name)
+	if err != nil {
+		return "", nil, xerrors.Errorf("Failed to get asg info: %w", err)
+	}
+	lt := asginfo[0].LaunchTemplate
+	if lt == nil {
+		return "", nil, xerrors.Errorf("asg %s does not launch from a launch template", clst.asg.name)
+	}
+	id := aws.StringValue(lt.LaunchTemplateId)
+	version := aws.StringValue(lt.Version)
+	if c.UpdateTemplate == config.TemplateDefault && version != "$Default" && version != "$Latest" {
+		return "", nil, xerrors.Errorf("asg %s is pinned to version %s of launch template %s, update it with pin instead", clst.asg.name, version, id)
+	}
+
+	output, err := r.asg.Ec2Api.DescribeLaunchTemplateVersions(&ec2.DescribeLaunchTemplateVersionsInput{
+		LaunchTemplateId: aws.String(id),
+		Versions:         aws.StringSlice([]string{version}),
+	})
+	if err != nil {
+		return "", nil, xerrors.Errorf("Failed to describe launch templates: %w", err)
+	}
+	if len(output.LaunchTemplateVersions) == 0 {
+		return "", nil, xerrors.Errorf("version %s of launch template %s not found", version, id)
+	}
+	return id, output.LaunchTemplateVersions[0], nil
+}
+
+// recordTemplate saves the launch template version created by the run before the asg launches it.
+func (r *Replacer) recordTemplate(update *TemplateUpdate) error {
+
+	if r.run == nil {
+		return nil
+	}
+	r.run.Template = update
+	if err := r.run.save(); err != nil {
+		return xerrors.Errorf("Failed to record launch template version: %w", err)
+	}
+	return nil
+}
+
+// restoreLaunchTemplate restores the default version of the launch template
+// and deletes the version created by the run, so that $Latest goes back as well.
+func (r *Replacer) restoreLaunchTemplate(update *TemplateUpdate) error {
+
+	if update.DefaultVersion != "" {
+		log.Logger.Infof("Restore default version %s of launch template %s", update.DefaultVersion, update.ID)
+		_, err := r.asg.Ec2Api.ModifyLaunchTemplate(&ec2.ModifyLaunchTemplateInput{
+			LaunchTemplateId: aws.String(update.ID),
+			DefaultVersion:   aws.String(update.DefaultVersion),
+		})
+		if err != nil {
+			return xerrors.Errorf("Failed to restore the default version of launch template %s: %w", update.ID, err)
+		}
+	}
+	log.Logger.Infof("Delete version %s of launch template %s", update.Version, update.ID)
+	output, err := r.asg.Ec2Api.DeleteLaunchTemplateVersions(&ec2.DeleteLaunchTemplateVersionsInput{
+		LaunchTemplateId: aws.String(update.ID),
+		Versions:         aws.StringSlice([]string{update.Version}),
+	})
+	if err != nil {
+		return xerrors.Errorf("Failed to delete version %s of launch template %s: %w", update.Version, update.ID, err)
+	}
+	for _, failed := range output.UnsuccessfullyDeletedLaunchTemplateVersions {
+		if failed.ResponseError != nil {
+			log.Logger.Warnf("Version %d of launch template %s was not deleted: %s", aws.Int64Value(failed.VersionNumber), update.ID, aws.StringValue(failed.ResponseError.Message))
+		}
+	}
+	return nil
+}
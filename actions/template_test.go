@@ -0,0 +1,148 @@
+package actions
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/nest-egg/ami-replacer/config"
+)
+
+func TestTemplate_updateLaunchTemplate(t *testing.T) {
+	testCases := []struct {
+		name          string
+		update        string
+		newestami     string
+		dryrun        bool
+		run           *Run
+		wantTemplates []string
+		wantUpdate    *TemplateUpdate
+		wantPinned    string
+	}{
+		{
+			name:      "default",
+			update:    config.TemplateDefault,
+			newestami: "ami-new",
+			run:       &Run{},
+			wantTemplates: []string{
+				"create lt-00000000000000000 from 99 with ami-new",
+				"default lt-00000000000000000 100",
+			},
+			wantUpdate: &TemplateUpdate{ID: "lt-00000000000000000", Version: "100", DefaultVersion: "99"},
+		},
+		{
+			name:          "pin",
+			update:        config.TemplatePin,
+			newestami:     "ami-new",
+			run:           &Run{},
+			wantTemplates: []string{"create lt-00000000000000000 from 99 with ami-new"},
+			wantUpdate:    &TemplateUpdate{ID: "lt-00000000000000000", Version: "100"},
+			wantPinned:    "100",
+		},
+		{
+			name:      "already_newest",
+			update:    config.TemplateDefault,
+			newestami: "ami-00000000000000001",
+			run:       &Run{},
+		},
+		{
+			name:      "dry_run",
+			update:    config.TemplateDefault,
+			newestami: "ami-new",
+			dryrun:    true,
+		},
+		{
+			name:       "resumed",
+			update:     config.TemplatePin,
+			newestami:  "ami-new",
+			run:        &Run{Template: &TemplateUpdate{ID: "lt-00000000000000000", Version: "100"}},
+			wantUpdate: &TemplateUpdate{ID: "lt-00000000000000000", Version: "100"},
+		},
+		{
+			name:      "disabled",
+			newestami: "ami-new",
+			run:       &Run{},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockreplacer := NewMockReplacer(
+				context.Background(),
+				"ap-northeast-1",
+				"admin",
+			)
+			mockreplacer.dryrun = tc.dryrun
+			mockreplacer.run = tc.run
+			clst := &cluster{name: "cluster", asg: asg{name: "ok", newestami: tc.newestami}}
+			conf := &config.Config{UpdateTemplate: tc.update}
+			if err := mockreplacer.updateLaunchTemplate(conf, clst); err != nil {
+				t.Fatalf("got: %v\nwant: %v", err, nil)
+			}
+
+			ec2api := mockreplacer.asg.Ec2Api.(*mockEC2iface)
+			if !reflect.DeepEqual(ec2api.templates, tc.wantTemplates) {
+				t.Errorf("got: %v\nwant: %v", ec2api.templates, tc.wantTemplates)
+			}
+			if tc.run != nil && !reflect.DeepEqual(tc.run.Template, tc.wantUpdate) {
+				t.Errorf("got: %+v\nwant: %+v", tc.run.Template, tc.wantUpdate)
+			}
+			asgapi := mockreplacer.asg.AsgAPI.(*mockASGiface)
+			var pinned string
+			for _, u := range asgapi.updates {
+				if u.LaunchTemplate != nil {
+					pinned = aws.StringValue(u.LaunchTemplate.Version)
+				}
+			}
+			if pinned != tc.wantPinned {
+				t.Errorf("got: %q\nwant: %q", pinned, tc.wantPinned)
+			}
+		})
+	}
+}
+
+func TestTemplate_obsoleteAfterUpdate(t *testing.T) {
+	mockreplacer := NewMockReplacer(
+		context.Background(),
+		"ap-northeast-1",
+		"admin",
+	)
+	newest := "ami-00000000000000001"
+
+	// once the default version launches the newest AMI, the version the asg reports resolves to it.
+	details, err := mockreplacer.asg.AsgAPI.DescribeAutoScalingInstances(&autoscaling.DescribeAutoScalingInstancesInput{
+		InstanceIds: aws.StringSlice([]string{"instance-with-obsolete-image"}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt := details.AutoScalingInstances[0].LaunchTemplate
+	versions, err := mockreplacer.asg.Ec2Api.DescribeLaunchTemplateVersions(&ec2.DescribeLaunchTemplateVersionsInput{
+		LaunchTemplateId: lt.LaunchTemplateId,
+		Versions:         []*string{lt.Version},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := aws.StringValue(versions.LaunchTemplateVersions[0].LaunchTemplateData.ImageId); got != newest {
+		t.Fatalf("got: %s\nwant: %s", got, newest)
+	}
+
+	imageid, err := mockreplacer.Ami("instance-with-obsolete-image")
+	if err != nil {
+		t.Fatalf("got: %v\nwant: %v", err, nil)
+	}
+	if want := "ami-00000000000000002"; imageid != want {
+		t.Errorf("got: %s\nwant: %s", imageid, want)
+	}
+	clst := &cluster{name: "obsolete-batch-cluster", asg: asg{name: "ok", newestami: newest}}
+	instances, err := mockreplacer.ecsInstance(clst)
+	if err != nil {
+		t.Fatalf("got: %v\nwant: %v", err, nil)
+	}
+	if got := len(obsoleteInstances(instances, newest)); got != 3 {
+		t.Errorf("got: %d\nwant: %d", got, 3)
+	}
+}
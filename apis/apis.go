@@ -1,6 +1,8 @@
 package apis
 
 import (
+	"time"
+
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
@@ -9,6 +11,8 @@ import (
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"github.com/aws/aws-sdk-go/service/ecs"
 	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/recyclebin"
+	"github.com/aws/aws-sdk-go/service/recyclebin/recyclebiniface"
 )
 
 //TargetAMI retains machine image name to delete.
@@ -65,6 +69,18 @@ func NewECSAPI(session *session.Session, region string) ecsiface.ECSAPI {
 
 }
 
+//NewRecycleBinAPI creates new recycle bin api
+func NewRecycleBinAPI(session *session.Session, region string) recyclebiniface.RecycleBinAPI {
+
+	rbin := recyclebin.New(session,
+		&aws.Config{
+			Region: aws.String(region),
+		},
+	)
+	return rbin
+
+}
+
 // sort.Interface implementation for imageSlice
 func (is ImageSlice) Len() int {
 	return len(is)
@@ -75,7 +91,17 @@ func (is ImageSlice) Swap(i, j int) {
 }
 
 func (is ImageSlice) Less(i, j int) bool {
-	return *is[i].CreationDate > *is[j].CreationDate
+	return CreationTime(is[i]).After(CreationTime(is[j]))
+}
+
+//CreationTime parses the creation date of image.
+//It returns the zero time when the date is missing or malformed.
+func CreationTime(image *ec2.Image) time.Time {
+	t, err := time.Parse(time.RFC3339, aws.StringValue(image.CreationDate))
+	if err != nil {
+		return time.Time{}
+	}
+	return t
 }
 
 func (is VolumeSlice) Len() int {
@@ -87,7 +113,7 @@ func (is VolumeSlice) Swap(i, j int) {
 }
 
 func (is VolumeSlice) Less(i, j int) bool {
-	itime := *is[i].StartTime
-	jtime := *is[j].StartTime
+	itime := aws.TimeValue(is[i].StartTime)
+	jtime := aws.TimeValue(is[j].StartTime)
 	return itime.After(jtime)
 }
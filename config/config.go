@@ -1,30 +1,328 @@
 package config
 
 import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
 	"github.com/urfave/cli"
+	"golang.org/x/xerrors"
 )
 
 // Config represents command configuration.
 type Config struct {
+	Name        string
+	Region      string
+	Profile     string
+	RoleArn     string
+	ExternalID  string
 	Image       string
 	Owner       string
 	Asgname     string
 	Clustername string
+	AsgTags     []string
+	ClusterTag  string
 	Dryrun      bool
 	Debug       bool
 	Generation  int
+	KeepDays    int
+	MaxAge      time.Duration
+	// DeleteSnapshots deletes the snapshots of deregistered images.
+	DeleteSnapshots bool
+	// Retire deprecates outdated images first and deregisters them
+	// once GracePeriod has passed since the deprecation.
+	Retire      bool
+	GracePeriod time.Duration
+	// ForceUnshare revokes launch permissions of shared images before deregistering them.
+	ForceUnshare bool
+	// Tags selects images having every tag, in addition to the name filter.
+	Tags []string
+	// SnapshotTags selects the snapshots rms deletes having every tag.
+	SnapshotTags []string
+	// ExcludeTags spares snapshots having any of the tags from rms.
+	ExcludeTags []string
+	// MinAge spares snapshots younger than this from rms.
+	MinAge time.Duration
+	// Description limits rms to snapshots whose description matches this regex.
+	Description string
+	// Workers is the number of snapshots rms deletes at once.
+	Workers int
+	// RateLimit caps snapshot deletions per second, or not at all when zero.
+	RateLimit float64
+	// Action is what rms does with unused snapshots: ActionDelete, ActionArchive or ActionRecycle.
+	Action string
+	// Prices overrides DefaultPrices per storage tier in reports.
+	Prices map[string]float64
+	// GroupTag totals reports by the value of this tag.
+	GroupTag string
+	// KeepTag pins images having the tag, whatever their age and generation.
+	KeepTag string
+	// LineageRegex groups images by its first capture group of the image name,
+	// or by the capture group named "lineage".
+	LineageRegex string
+	// LineageTag groups images by the value of the tag.
+	LineageTag string
+	// Regions sweeps AMIs of every region, or of every enabled region for "all".
+	Regions []string
+	// SourceTag matches copies of an image across regions by this tag holding
+	// the source image id. Copies are matched by name without it.
+	SourceTag string
+	// BatchSize is the number of instances rpl replaces together, one when zero.
+	BatchSize int
+	// BatchPercent is the percentage of the asg rpl replaces together, instead of BatchSize.
+	BatchPercent int
+	// StateDir holds the records of rpl runs, to roll them back later.
+	StateDir string
+	// NoRollback leaves a failed replacement as it is instead of rolling it back.
+	NoRollback bool
+	// Resume continues the last unfinished rpl run of the asg from its last completed step.
+	Resume bool
+	// UpdateTemplate makes rpl create a launch template version with the newest AMI first:
+	// TemplateDefault or TemplatePin, nothing when empty.
+	UpdateTemplate string
+}
+
+func (c *Config) validate() error {
+	if err := c.validateRetention(); err != nil {
+		return err
+	}
+	if err := c.validateTags(); err != nil {
+		return err
+	}
+	if err := ValidateRegions(c.Regions); err != nil {
+		return xerrors.Errorf("regions: %w", err)
+	}
+	if err := ValidateRole(c.RoleArn, c.ExternalID); err != nil {
+		return err
+	}
+	if _, err := regexp.Compile(c.Description); err != nil {
+		return xerrors.Errorf("description: %w", err)
+	}
+	if err := ValidateBatch(c.BatchSize, c.BatchPercent); err != nil {
+		return err
+	}
+	if c.Workers < 0 {
+		return xerrors.Errorf("workers: must not be negative, got %d", c.Workers)
+	}
+	if c.RateLimit < 0 {
+		return xerrors.Errorf("rate: must not be negative, got %v", c.RateLimit)
+	}
+	if err := ValidateAction(c.Action); err != nil {
+		return xerrors.Errorf("action: %w", err)
+	}
+	if err := ValidateUpdateTemplate(c.UpdateTemplate); err != nil {
+		return xerrors.Errorf("update-template: %w", err)
+	}
+	if err := ValidatePrices(c.Prices); err != nil {
+		return xerrors.Errorf("price: %w", err)
+	}
+	return c.validateLineage()
+}
+
+// ValidateBatch checks the batch size and percentage of rpl, of which only one may be set.
+func ValidateBatch(size int, percent int) error {
+	if size < 0 {
+		return xerrors.Errorf("batch-size: must not be negative, got %d", size)
+	}
+	if percent < 0 || percent > 100 {
+		return xerrors.Errorf("batch-percent: must be between 0 and 100, got %d", percent)
+	}
+	if size != 0 && percent != 0 {
+		return xerrors.New("batch-size and batch-percent are mutually exclusive")
+	}
+	return nil
+}
+
+// ValidateBatchSize checks a batch size given by --batch-size or a target.
+func ValidateBatchSize(size int) error {
+	if size < 1 {
+		return xerrors.Errorf("must be at least 1, got %d", size)
+	}
+	return nil
+}
+
+// ValidateBatchPercent checks a batch percentage given by --batch-percent or a target.
+func ValidateBatchPercent(percent int) error {
+	if percent < 1 || percent > 100 {
+		return xerrors.Errorf("must be between 1 and 100, got %d", percent)
+	}
+	return nil
+}
+
+// ValidateWorkers checks the number of snapshots rms handles at once given by --workers or a target.
+func ValidateWorkers(workers int) error {
+	if workers < 1 {
+		return xerrors.Errorf("must be at least 1, got %d", workers)
+	}
+	return nil
+}
+
+// Batch returns the number of instances rpl replaces together in an asg of size instances.
+// BatchPercent rounds up, so a batch always holds at least one instance.
+func (c *Config) Batch(size int) int {
+	batch := c.BatchSize
+	if c.BatchPercent != 0 {
+		batch = (size*c.BatchPercent + 99) / 100
+	}
+	if batch < 1 {
+		batch = 1
+	}
+	return batch
+}
+
+// Actions rms takes on unused snapshots.
+const (
+	// ActionDelete deletes snapshots for good.
+	ActionDelete = "delete"
+	// ActionArchive moves snapshots to the archive storage tier.
+	ActionArchive = "archive"
+	// ActionRecycle deletes snapshots retained by a Recycle Bin rule, which can still be recovered.
+	ActionRecycle = "recycle"
+)
+
+// ValidateAction checks an rms action, "" standing for ActionDelete.
+func ValidateAction(action string) error {
+	switch action {
+	case "", ActionDelete, ActionArchive, ActionRecycle:
+		return nil
+	}
+	return xerrors.Errorf("unknown action %q: expected delete, archive or recycle", action)
+}
+
+// How rpl makes the asg launch the launch template version it creates.
+const (
+	// TemplateDefault makes the new version the default version of the launch template.
+	TemplateDefault = "default"
+	// TemplatePin pins the asg to the new version.
+	TemplatePin = "pin"
+)
+
+// ValidateUpdateTemplate checks how rpl updates the launch template, "" leaving it as it is.
+func ValidateUpdateTemplate(update string) error {
+	switch update {
+	case "", TemplateDefault, TemplatePin:
+		return nil
+	}
+	return xerrors.Errorf("unknown launch template update %q: expected default or pin", update)
+}
+
+// validateLineage checks the lineage grouping of images.
+func (c *Config) validateLineage() error {
+	if c.LineageRegex != "" && c.LineageTag != "" {
+		return xerrors.New("lineage-regex and lineage-tag are mutually exclusive")
+	}
+	if c.LineageRegex != "" {
+		if _, err := ParseLineageRegex(c.LineageRegex); err != nil {
+			return xerrors.Errorf("lineage-regex: %w", err)
+		}
+	}
+	return nil
+}
+
+// ParseLineageRegex compiles a lineage regex, which needs a capture group.
+func ParseLineageRegex(s string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid regex %q: %w", s, err)
+	}
+	if re.NumSubexp() == 0 {
+		return nil, xerrors.Errorf("regex %q has no capture group", s)
+	}
+	return re, nil
+}
+
+// validateTags checks the tag filters and the keep tag.
+func (c *Config) validateTags() error {
+	if _, err := ParseTagFilters(c.Tags); err != nil {
+		return xerrors.Errorf("tag: %w", err)
+	}
+	if _, err := ParseTagFilters(c.SnapshotTags); err != nil {
+		return xerrors.Errorf("snapshot-tag: %w", err)
+	}
+	if _, err := ParseTagFilters(c.ExcludeTags); err != nil {
+		return xerrors.Errorf("exclude-tag: %w", err)
+	}
+	if c.KeepTag != "" {
+		if _, err := ParseTagFilter(c.KeepTag); err != nil {
+			return xerrors.Errorf("keep-tag: %w", err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateRetention() error {
+	if c.Generation < 1 {
+		return xerrors.Errorf("gen: must be at least 1, got %d", c.Generation)
+	}
+	if c.KeepDays < 0 {
+		return xerrors.Errorf("keep-days: must not be negative, got %d", c.KeepDays)
+	}
+	if c.MaxAge > 0 && time.Duration(c.KeepDays)*24*time.Hour > c.MaxAge {
+		return xerrors.Errorf("keep-days: %d days must not exceed max-age %s", c.KeepDays, c.MaxAge)
+	}
+	return nil
+}
+
+// DefaultGeneration is the default of --gen, for commands without the flag.
+const DefaultGeneration = 2
+
+// DefaultStateDir is where rpl records its runs without --state-dir.
+var DefaultStateDir = func() string {
+	return filepath.Join(os.Getenv("HOME"), ".ami-replacer", "runs")
+}
+
+// StateDir returns the directory given by --state-dir, or DefaultStateDir.
+func StateDir(ctx *cli.Context) string {
+	if dir := ctx.GlobalString("state-dir"); dir != "" {
+		return dir
+	}
+	return DefaultStateDir()
 }
 
 //SetConfig set current args to config
 func SetConfig(ctx *cli.Context) *Config {
 	conf := &Config{
-		Asgname:     ctx.String("asgname"),
-		Image:       ctx.String("image"),
-		Clustername: ctx.String("clustername"),
-		Owner:       ctx.String("owner"),
-		Dryrun:      ctx.Bool("dry-run"),
-		Debug:       ctx.Bool("verbose"),
-		Generation:  ctx.Int("gen"),
+		Region:          ctx.GlobalString("region"),
+		Profile:         ctx.GlobalString("profile"),
+		RoleArn:         ctx.GlobalString("role-arn"),
+		ExternalID:      ctx.GlobalString("external-id"),
+		Asgname:         ctx.String("asgname"),
+		Image:           ctx.String("image"),
+		Clustername:     ctx.String("clustername"),
+		AsgTags:         ctx.StringSlice("asg-tag"),
+		ClusterTag:      ctx.String("cluster-tag"),
+		BatchSize:       ctx.Int("batch-size"),
+		BatchPercent:    ctx.Int("batch-percent"),
+		StateDir:        StateDir(ctx),
+		NoRollback:      ctx.Bool("no-rollback"),
+		Resume:          ctx.Bool("resume"),
+		UpdateTemplate:  ctx.String("update-template"),
+		Owner:           ctx.String("owner"),
+		Dryrun:          ctx.Bool("dry-run"),
+		Debug:           ctx.Bool("verbose"),
+		Generation:      ctx.Int("gen"),
+		KeepDays:        ctx.Int("keep-days"),
+		DeleteSnapshots: ctx.Bool("delete-snapshots"),
+		ForceUnshare:    ctx.Bool("force-unshare"),
+		Retire:          ctx.Bool("retire"),
+		Tags:            ctx.StringSlice("tag"),
+		SnapshotTags:    ctx.StringSlice("snapshot-tag"),
+		ExcludeTags:     ctx.StringSlice("exclude-tag"),
+		Description:     ctx.String("description"),
+		Workers:         ctx.Int("workers"),
+		RateLimit:       ctx.Float64("rate"),
+		GroupTag:        ctx.String("group-tag"),
+		Action:          ctx.String("action"),
+		KeepTag:         ctx.String("keep-tag"),
+		LineageRegex:    ctx.String("lineage-regex"),
+		LineageTag:      ctx.String("lineage-tag"),
+		Regions:         ParseRegions(ctx.String("regions")),
+		SourceTag:       ctx.String("source-tag"),
+	}
+	// rms and rpl have no --gen, which targets of a config file may still set.
+	if conf.Generation == 0 && !isSet(ctx, "gen", "g") {
+		conf.Generation = DefaultGeneration
 	}
 	return conf
 }
@@ -0,0 +1,49 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfig_validate(t *testing.T) {
+	testCases := []struct {
+		name   string
+		conf   Config
+		errKey string
+	}{
+		{
+			name: "ok",
+			conf: Config{Generation: 2, KeepDays: 30, MaxAge: 90 * 24 * time.Hour},
+		},
+		{
+			name:   "gen_zero",
+			conf:   Config{Generation: 0},
+			errKey: "gen",
+		},
+		{
+			name:   "negative_keep_days",
+			conf:   Config{Generation: 2, KeepDays: -1},
+			errKey: "keep-days",
+		},
+		{
+			name:   "batch_size_and_percent",
+			conf:   Config{Generation: 2, BatchSize: 2, BatchPercent: 50},
+			errKey: "batch-size and batch-percent",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.conf.validate()
+			if tc.errKey == "" {
+				if err != nil {
+					t.Errorf("got: %v\nwant: %v", err, nil)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), tc.errKey) {
+				t.Errorf("got: %v\nwant: error starting with %q", err, tc.errKey)
+			}
+		})
+	}
+}
@@ -0,0 +1,566 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+
+	"github.com/urfave/cli"
+	"golang.org/x/xerrors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// File represents a declarative config file.
+// JSON files are accepted as well since JSON is a subset of YAML.
+type File struct {
+	Defaults Target   `yaml:"defaults"`
+	Targets  []Target `yaml:"targets"`
+}
+
+// Target describes one replacement target of a config file.
+// Keys are named after the corresponding command line flags.
+type Target struct {
+	Name            string             `yaml:"name"`
+	Region          string             `yaml:"region"`
+	Profile         string             `yaml:"profile"`
+	RoleArn         string             `yaml:"role-arn"`
+	ExternalID      string             `yaml:"external-id"`
+	Image           string             `yaml:"image"`
+	Owner           string             `yaml:"owner"`
+	Asgname         string             `yaml:"asgname"`
+	Clustername     string             `yaml:"clustername"`
+	AsgTags         []string           `yaml:"asg-tag"`
+	ClusterTag      string             `yaml:"cluster-tag"`
+	BatchSize       *int               `yaml:"batch-size"`
+	BatchPercent    *int               `yaml:"batch-percent"`
+	NoRollback      *bool              `yaml:"no-rollback"`
+	UpdateTemplate  string             `yaml:"update-template"`
+	Generation      *int               `yaml:"gen"`
+	KeepDays        *int               `yaml:"keep-days"`
+	MaxAge          string             `yaml:"max-age"`
+	Dryrun          *bool              `yaml:"dry-run"`
+	DeleteSnapshots *bool              `yaml:"delete-snapshots"`
+	ForceUnshare    *bool              `yaml:"force-unshare"`
+	Retire          *bool              `yaml:"retire"`
+	GracePeriod     string             `yaml:"grace-period"`
+	Tags            []string           `yaml:"tag"`
+	SnapshotTags    []string           `yaml:"snapshot-tag"`
+	ExcludeTags     []string           `yaml:"exclude-tag"`
+	MinAge          string             `yaml:"min-age"`
+	Description     string             `yaml:"description"`
+	Workers         *int               `yaml:"workers"`
+	RateLimit       *float64           `yaml:"rate"`
+	Prices          map[string]float64 `yaml:"price"`
+	GroupTag        string             `yaml:"group-tag"`
+	Action          string             `yaml:"action"`
+	KeepTag         string             `yaml:"keep-tag"`
+	LineageRegex    string             `yaml:"lineage-regex"`
+	LineageTag      string             `yaml:"lineage-tag"`
+	Regions         []string           `yaml:"regions"`
+	SourceTag       string             `yaml:"source-tag"`
+}
+
+// LoadFile reads and validates the config file at path.
+func LoadFile(path string) (*File, error) {
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, xerrors.Errorf("Failed to read config file: %w", err)
+	}
+	f := &File{}
+	if err := yaml.UnmarshalStrict(out, f); err != nil {
+		return nil, xerrors.Errorf("Failed to parse config file %s: %w", path, err)
+	}
+	if err := f.Validate(); err != nil {
+		return nil, xerrors.Errorf("Invalid config file %s: %w", path, err)
+	}
+	return f, nil
+}
+
+// Validate checks every target of the config file.
+// Errors point at the offending key, e.g. "targets[1].gen".
+func (f *File) Validate() error {
+	if len(f.Targets) == 0 {
+		return xerrors.New("targets: at least one target is required")
+	}
+	if err := f.Defaults.validate("defaults"); err != nil {
+		return err
+	}
+	names := map[string]int{}
+	for i, t := range f.Targets {
+		key := fmt.Sprintf("targets[%d]", i)
+		if err := t.validate(key); err != nil {
+			return err
+		}
+		if t.Name == "" {
+			continue
+		}
+		if j, ok := names[t.Name]; ok {
+			return xerrors.Errorf("%s.name: duplicate target name %q (also used by targets[%d])", key, t.Name, j)
+		}
+		names[t.Name] = i
+	}
+	return nil
+}
+
+func (t *Target) validate(key string) error {
+	if t.Region != "" && !IsValidRegion(t.Region) {
+		return xerrors.Errorf("%s.region: invalid region %q", key, t.Region)
+	}
+	if t.Generation != nil && *t.Generation < 1 {
+		return xerrors.Errorf("%s.gen: must be at least 1, got %d", key, *t.Generation)
+	}
+	if t.KeepDays != nil && *t.KeepDays < 0 {
+		return xerrors.Errorf("%s.keep-days: must not be negative, got %d", key, *t.KeepDays)
+	}
+	if t.MaxAge != "" {
+		if _, err := ParseAge(t.MaxAge); err != nil {
+			return xerrors.Errorf("%s.max-age: %w", key, err)
+		}
+	}
+	if t.GracePeriod != "" {
+		if _, err := ParseAge(t.GracePeriod); err != nil {
+			return xerrors.Errorf("%s.grace-period: %w", key, err)
+		}
+	}
+	for i, tag := range t.AsgTags {
+		if _, err := ParseTagFilter(tag); err != nil {
+			return xerrors.Errorf("%s.asg-tag[%d]: %w", key, i, err)
+		}
+	}
+	for i, tag := range t.Tags {
+		if _, err := ParseTagFilter(tag); err != nil {
+			return xerrors.Errorf("%s.tag[%d]: %w", key, i, err)
+		}
+	}
+	for i, tag := range t.SnapshotTags {
+		if _, err := ParseTagFilter(tag); err != nil {
+			return xerrors.Errorf("%s.snapshot-tag[%d]: %w", key, i, err)
+		}
+	}
+	for i, tag := range t.ExcludeTags {
+		if _, err := ParseTagFilter(tag); err != nil {
+			return xerrors.Errorf("%s.exclude-tag[%d]: %w", key, i, err)
+		}
+	}
+	if t.MinAge != "" {
+		if _, err := ParseAge(t.MinAge); err != nil {
+			return xerrors.Errorf("%s.min-age: %w", key, err)
+		}
+	}
+	if _, err := regexp.Compile(t.Description); err != nil {
+		return xerrors.Errorf("%s.description: %w", key, err)
+	}
+	if t.BatchSize != nil {
+		if err := ValidateBatchSize(*t.BatchSize); err != nil {
+			return xerrors.Errorf("%s.batch-size: %w", key, err)
+		}
+	}
+	if t.BatchPercent != nil {
+		if err := ValidateBatchPercent(*t.BatchPercent); err != nil {
+			return xerrors.Errorf("%s.batch-percent: %w", key, err)
+		}
+	}
+	if t.BatchSize != nil && t.BatchPercent != nil {
+		return xerrors.Errorf("%s: batch-size and batch-percent are mutually exclusive", key)
+	}
+	if t.Workers != nil {
+		if err := ValidateWorkers(*t.Workers); err != nil {
+			return xerrors.Errorf("%s.workers: %w", key, err)
+		}
+	}
+	if t.RateLimit != nil && *t.RateLimit < 0 {
+		return xerrors.Errorf("%s.rate: must not be negative, got %v", key, *t.RateLimit)
+	}
+	if err := ValidatePrices(t.Prices); err != nil {
+		return xerrors.Errorf("%s.price: %w", key, err)
+	}
+	if err := ValidateAction(t.Action); err != nil {
+		return xerrors.Errorf("%s.action: %w", key, err)
+	}
+	if err := ValidateUpdateTemplate(t.UpdateTemplate); err != nil {
+		return xerrors.Errorf("%s.update-template: %w", key, err)
+	}
+	if t.KeepTag != "" {
+		if _, err := ParseTagFilter(t.KeepTag); err != nil {
+			return xerrors.Errorf("%s.keep-tag: %w", key, err)
+		}
+	}
+	if t.LineageRegex != "" {
+		if _, err := ParseLineageRegex(t.LineageRegex); err != nil {
+			return xerrors.Errorf("%s.lineage-regex: %w", key, err)
+		}
+	}
+	if err := ValidateRegions(t.Regions); err != nil {
+		return xerrors.Errorf("%s.regions: %w", key, err)
+	}
+	if t.RoleArn != "" {
+		if err := ValidateRole(t.RoleArn, ""); err != nil {
+			return xerrors.Errorf("%s.%v", key, err)
+		}
+	}
+	if t.LineageRegex != "" && t.LineageTag != "" {
+		return xerrors.Errorf("%s: lineage-regex and lineage-tag are mutually exclusive", key)
+	}
+	if len(t.AsgTags) != 0 && t.Asgname != "" {
+		return xerrors.Errorf("%s: asgname and asg-tag are mutually exclusive", key)
+	}
+	if (t.Asgname == "") != (t.Clustername == "") && key != "defaults" {
+		return xerrors.Errorf("%s: asgname and clustername must be set together", key)
+	}
+	return nil
+}
+
+// LoadConfigs builds one Config per target of the file given by --config.
+// Flags set on the command line override file values, and file values
+// override flag defaults. Without --config the command line is the only target.
+func LoadConfigs(ctx *cli.Context) ([]*Config, error) {
+	base := SetConfig(ctx)
+	if s := ctx.String("max-age"); s != "" {
+		age, err := ParseAge(s)
+		if err != nil {
+			return nil, xerrors.Errorf("--max-age: %w", err)
+		}
+		base.MaxAge = age
+	}
+	if s := ctx.String("grace-period"); s != "" {
+		grace, err := ParseAge(s)
+		if err != nil {
+			return nil, xerrors.Errorf("--grace-period: %w", err)
+		}
+		base.GracePeriod = grace
+	}
+	if s := ctx.String("min-age"); s != "" {
+		age, err := ParseAge(s)
+		if err != nil {
+			return nil, xerrors.Errorf("--min-age: %w", err)
+		}
+		base.MinAge = age
+	}
+	// flags left at zero are unset, like targets omitting them, but must be valid once given.
+	if isSet(ctx, "batch-size") {
+		if err := ValidateBatchSize(base.BatchSize); err != nil {
+			return nil, xerrors.Errorf("--batch-size: %w", err)
+		}
+	}
+	if isSet(ctx, "batch-percent") {
+		if err := ValidateBatchPercent(base.BatchPercent); err != nil {
+			return nil, xerrors.Errorf("--batch-percent: %w", err)
+		}
+	}
+	if isSet(ctx, "workers") {
+		if err := ValidateWorkers(base.Workers); err != nil {
+			return nil, xerrors.Errorf("--workers: %w", err)
+		}
+	}
+	if prices := ctx.StringSlice("price"); len(prices) != 0 {
+		parsed, err := ParsePrices(prices)
+		if err != nil {
+			return nil, xerrors.Errorf("--price: %w", err)
+		}
+		base.Prices = parsed
+	}
+	path := ctx.GlobalString("config")
+	if path == "" {
+		base.Name = "default"
+		if err := base.validate(); err != nil {
+			return nil, xerrors.Errorf("Invalid flags: %w", err)
+		}
+		return []*Config{base}, nil
+	}
+
+	f, err := LoadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	confs := make([]*Config, 0, len(f.Targets))
+	for i, t := range f.Targets {
+		conf := *base
+		f.Defaults.apply(&conf)
+		t.apply(&conf)
+		if conf.Name == "" {
+			conf.Name = fmt.Sprintf("targets[%d]", i)
+		}
+		overrideFlags(ctx, base, &conf)
+		if err := conf.validate(); err != nil {
+			return nil, xerrors.Errorf("Invalid config of %s: %w", conf.Name, err)
+		}
+		confs = append(confs, &conf)
+	}
+	return confs, nil
+}
+
+// TargetExternalID returns the external id a target ran with, which runs of rpl do not record:
+// --external-id, or the external-id of the target named name in --config, or of its defaults.
+func TargetExternalID(ctx *cli.Context, name string) (string, error) {
+	if ctx.GlobalIsSet("external-id") {
+		return ctx.GlobalString("external-id"), nil
+	}
+	path := ctx.GlobalString("config")
+	if path == "" {
+		return "", nil
+	}
+	f, err := LoadFile(path)
+	if err != nil {
+		return "", err
+	}
+	externalID := f.Defaults.ExternalID
+	for i, t := range f.Targets {
+		if t.Name == name || (t.Name == "" && fmt.Sprintf("targets[%d]", i) == name) {
+			if t.ExternalID != "" {
+				externalID = t.ExternalID
+			}
+			break
+		}
+	}
+	return externalID, nil
+}
+
+func (t *Target) apply(conf *Config) {
+	if t.Name != "" {
+		conf.Name = t.Name
+	}
+	if t.Region != "" {
+		conf.Region = t.Region
+	}
+	if t.Profile != "" {
+		conf.Profile = t.Profile
+	}
+	if t.RoleArn != "" {
+		conf.RoleArn = t.RoleArn
+	}
+	if t.ExternalID != "" {
+		conf.ExternalID = t.ExternalID
+	}
+	if t.Image != "" {
+		conf.Image = t.Image
+	}
+	if t.Owner != "" {
+		conf.Owner = t.Owner
+	}
+	if t.Asgname != "" {
+		conf.Asgname = t.Asgname
+	}
+	if t.Clustername != "" {
+		conf.Clustername = t.Clustername
+	}
+	if len(t.AsgTags) != 0 {
+		conf.AsgTags = t.AsgTags
+	}
+	if t.ClusterTag != "" {
+		conf.ClusterTag = t.ClusterTag
+	}
+	// batch-size and batch-percent replace each other.
+	if t.BatchSize != nil {
+		conf.BatchSize, conf.BatchPercent = *t.BatchSize, 0
+	}
+	if t.BatchPercent != nil {
+		conf.BatchSize, conf.BatchPercent = 0, *t.BatchPercent
+	}
+	if t.NoRollback != nil {
+		conf.NoRollback = *t.NoRollback
+	}
+	if t.UpdateTemplate != "" {
+		conf.UpdateTemplate = t.UpdateTemplate
+	}
+	if t.Generation != nil {
+		conf.Generation = *t.Generation
+	}
+	if t.KeepDays != nil {
+		conf.KeepDays = *t.KeepDays
+	}
+	if t.MaxAge != "" {
+		// validated by LoadFile
+		conf.MaxAge, _ = ParseAge(t.MaxAge)
+	}
+	if t.Dryrun != nil {
+		conf.Dryrun = *t.Dryrun
+	}
+	if t.DeleteSnapshots != nil {
+		conf.DeleteSnapshots = *t.DeleteSnapshots
+	}
+	if t.ForceUnshare != nil {
+		conf.ForceUnshare = *t.ForceUnshare
+	}
+	if t.Retire != nil {
+		conf.Retire = *t.Retire
+	}
+	if t.GracePeriod != "" {
+		// validated by LoadFile
+		conf.GracePeriod, _ = ParseAge(t.GracePeriod)
+	}
+	if len(t.Tags) != 0 {
+		conf.Tags = t.Tags
+	}
+	if len(t.SnapshotTags) != 0 {
+		conf.SnapshotTags = t.SnapshotTags
+	}
+	if len(t.ExcludeTags) != 0 {
+		conf.ExcludeTags = t.ExcludeTags
+	}
+	if t.MinAge != "" {
+		// validated by LoadFile
+		conf.MinAge, _ = ParseAge(t.MinAge)
+	}
+	if t.Description != "" {
+		conf.Description = t.Description
+	}
+	if t.Workers != nil {
+		conf.Workers = *t.Workers
+	}
+	if t.RateLimit != nil {
+		conf.RateLimit = *t.RateLimit
+	}
+	if len(t.Prices) != 0 {
+		// targets add to the prices of defaults, copied not to leak into other targets.
+		prices := make(map[string]float64, len(conf.Prices)+len(t.Prices))
+		for tier, price := range conf.Prices {
+			prices[tier] = price
+		}
+		for tier, price := range t.Prices {
+			prices[tier] = price
+		}
+		conf.Prices = prices
+	}
+	if t.GroupTag != "" {
+		conf.GroupTag = t.GroupTag
+	}
+	if t.Action != "" {
+		conf.Action = t.Action
+	}
+	if t.KeepTag != "" {
+		conf.KeepTag = t.KeepTag
+	}
+	if t.LineageRegex != "" {
+		conf.LineageRegex = t.LineageRegex
+		conf.LineageTag = ""
+	}
+	if t.LineageTag != "" {
+		conf.LineageTag = t.LineageTag
+		conf.LineageRegex = ""
+	}
+	if len(t.Regions) != 0 {
+		conf.Regions = t.Regions
+	}
+	if t.SourceTag != "" {
+		conf.SourceTag = t.SourceTag
+	}
+}
+
+func overrideFlags(ctx *cli.Context, base *Config, conf *Config) {
+	if ctx.GlobalIsSet("region") || ctx.GlobalIsSet("r") {
+		conf.Region = base.Region
+	}
+	if ctx.GlobalIsSet("profile") || ctx.GlobalIsSet("p") {
+		conf.Profile = base.Profile
+	}
+	if ctx.GlobalIsSet("role-arn") {
+		conf.RoleArn = base.RoleArn
+	}
+	if ctx.GlobalIsSet("external-id") {
+		conf.ExternalID = base.ExternalID
+	}
+	if isSet(ctx, "image", "i") {
+		conf.Image = base.Image
+	}
+	if isSet(ctx, "owner", "o") {
+		conf.Owner = base.Owner
+	}
+	if isSet(ctx, "asgname", "a") {
+		conf.Asgname = base.Asgname
+	}
+	if isSet(ctx, "clustername", "c") {
+		conf.Clustername = base.Clustername
+	}
+	if isSet(ctx, "asg-tag") {
+		conf.AsgTags = base.AsgTags
+	}
+	if isSet(ctx, "cluster-tag") {
+		conf.ClusterTag = base.ClusterTag
+	}
+	if isSet(ctx, "batch-size", "batch-percent") {
+		conf.BatchSize, conf.BatchPercent = base.BatchSize, base.BatchPercent
+	}
+	if isSet(ctx, "no-rollback") {
+		conf.NoRollback = base.NoRollback
+	}
+	if isSet(ctx, "update-template") {
+		conf.UpdateTemplate = base.UpdateTemplate
+	}
+	if isSet(ctx, "gen", "g") {
+		conf.Generation = base.Generation
+	}
+	if isSet(ctx, "keep-days") {
+		conf.KeepDays = base.KeepDays
+	}
+	if isSet(ctx, "max-age") {
+		conf.MaxAge = base.MaxAge
+	}
+	if isSet(ctx, "dry-run", "d") {
+		conf.Dryrun = base.Dryrun
+	}
+	if isSet(ctx, "delete-snapshots") {
+		conf.DeleteSnapshots = base.DeleteSnapshots
+	}
+	if isSet(ctx, "force-unshare") {
+		conf.ForceUnshare = base.ForceUnshare
+	}
+	if isSet(ctx, "retire") {
+		conf.Retire = base.Retire
+	}
+	if isSet(ctx, "grace-period") {
+		conf.GracePeriod = base.GracePeriod
+	}
+	if isSet(ctx, "tag") {
+		conf.Tags = base.Tags
+	}
+	if isSet(ctx, "snapshot-tag") {
+		conf.SnapshotTags = base.SnapshotTags
+	}
+	if isSet(ctx, "exclude-tag") {
+		conf.ExcludeTags = base.ExcludeTags
+	}
+	if isSet(ctx, "min-age") {
+		conf.MinAge = base.MinAge
+	}
+	if isSet(ctx, "description") {
+		conf.Description = base.Description
+	}
+	if isSet(ctx, "workers") {
+		conf.Workers = base.Workers
+	}
+	if isSet(ctx, "rate") {
+		conf.RateLimit = base.RateLimit
+	}
+	if isSet(ctx, "price") {
+		conf.Prices = base.Prices
+	}
+	if isSet(ctx, "group-tag") {
+		conf.GroupTag = base.GroupTag
+	}
+	if isSet(ctx, "action") {
+		conf.Action = base.Action
+	}
+	if isSet(ctx, "keep-tag") {
+		conf.KeepTag = base.KeepTag
+	}
+	if isSet(ctx, "regions") {
+		conf.Regions = base.Regions
+	}
+	if isSet(ctx, "source-tag") {
+		conf.SourceTag = base.SourceTag
+	}
+	if isSet(ctx, "lineage-regex", "lineage-tag") {
+		conf.LineageRegex = base.LineageRegex
+		conf.LineageTag = base.LineageTag
+	}
+}
+
+func isSet(ctx *cli.Context, names ...string) bool {
+	for _, name := range names {
+		if ctx.IsSet(name) {
+			return true
+		}
+	}
+	return false
+}
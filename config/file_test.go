@@ -0,0 +1,273 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+func TestFile_LoadFile(t *testing.T) {
+	testCases := []struct {
+		name    string
+		file    string
+		content string
+		errKey  string
+	}{
+		{
+			name: "yaml",
+			file: "ok.yaml",
+			content: `
+defaults:
+  owner: "123456789012"
+  gen: 3
+targets:
+  - name: api
+    image: api-*
+    asgname: api-asg
+    clustername: api-cluster
+  - name: worker
+    region: us-east-1
+    image: worker-*
+    keep-days: 30
+    max-age: 90d
+    dry-run: true
+`,
+		},
+		{
+			name:    "json",
+			file:    "ok.json",
+			content: `{"targets": [{"name": "api", "image": "api-*", "gen": 2}]}`,
+		},
+		{
+			name:    "no_targets",
+			file:    "empty.yaml",
+			content: "defaults:\n  owner: self\n",
+			errKey:  "targets:",
+		},
+		{
+			name:    "unknown_key",
+			file:    "unknown.yaml",
+			content: "targets:\n  - name: api\n    generation: 2\n",
+			errKey:  "field generation not found",
+		},
+		{
+			name:    "lineage_regex_without_group",
+			file:    "lineage.yaml",
+			content: "targets:\n  - name: api\n    lineage-regex: 'app-\\w+'\n",
+			errKey:  "targets[0].lineage-regex",
+		},
+		{
+			name:    "invalid_keep_tag",
+			file:    "keep.yaml",
+			content: "defaults:\n  keep-tag: =true\ntargets:\n  - name: api\n",
+			errKey:  "defaults.keep-tag",
+		},
+		{
+			name:    "all_regions_combined",
+			file:    "regions.yaml",
+			content: "targets:\n  - name: api\n    regions: [all, us-east-1]\n",
+			errKey:  "targets[0].regions",
+		},
+		{
+			name:    "invalid_min_age",
+			file:    "min-age.yaml",
+			content: "targets:\n  - name: api\n    min-age: soon\n",
+			errKey:  "targets[0].min-age",
+		},
+		{
+			name:    "invalid_description",
+			file:    "description.yaml",
+			content: "targets:\n  - name: api\n    description: '('\n",
+			errKey:  "targets[0].description",
+		},
+		{
+			name:    "invalid_snapshot_tag",
+			file:    "snapshot-tag.yaml",
+			content: "targets:\n  - name: api\n    snapshot-tag: [=infra]\n",
+			errKey:  "targets[0].snapshot-tag[0]",
+		},
+		{
+			name:    "zero_workers",
+			file:    "workers.yaml",
+			content: "defaults:\n  workers: 0\ntargets:\n  - name: api\n",
+			errKey:  "defaults.workers",
+		},
+		{
+			name:    "unknown_price_tier",
+			file:    "price.yaml",
+			content: "targets:\n  - name: api\n    price:\n      glacier: 0.004\n",
+			errKey:  "targets[0].price",
+		},
+		{
+			name:    "unknown_action",
+			file:    "action.yaml",
+			content: "defaults:\n  action: shred\ntargets:\n  - name: api\n",
+			errKey:  "defaults.action",
+		},
+		{
+			name:    "unknown_update_template",
+			file:    "template.yaml",
+			content: "targets:\n  - name: api\n    update-template: latest\n",
+			errKey:  "targets[0].update-template",
+		},
+		{
+			name:    "batch_size_and_percent",
+			file:    "batch.yaml",
+			content: "targets:\n  - name: api\n    batch-size: 2\n    batch-percent: 25\n",
+			errKey:  "targets[0]",
+		},
+		{
+			name:    "invalid_batch_percent",
+			file:    "batch.yaml",
+			content: "defaults:\n  batch-percent: 150\ntargets:\n  - name: api\n",
+			errKey:  "defaults.batch-percent",
+		},
+		{
+			name:    "invalid_role_arn",
+			file:    "role.yaml",
+			content: "targets:\n  - name: prod\n    role-arn: arn:aws:iam::123:role/x\n",
+			errKey:  "targets[0].role-arn",
+		},
+		{
+			name:    "invalid_gen",
+			file:    "gen.yaml",
+			content: "targets:\n  - name: api\n  - name: worker\n    gen: 0\n",
+			errKey:  "targets[1].gen",
+		},
+		{
+			name:    "invalid_region",
+			file:    "region.yaml",
+			content: "defaults:\n  region: moon-1\ntargets:\n  - name: api\n",
+			errKey:  "defaults.region",
+		},
+		{
+			name:    "invalid_max_age",
+			file:    "age.yaml",
+			content: "targets:\n  - name: api\n    max-age: 3 months\n",
+			errKey:  "targets[0].max-age",
+		},
+		{
+			name:    "negative_keep_days",
+			file:    "keep.yaml",
+			content: "defaults:\n  keep-days: -1\ntargets:\n  - name: api\n",
+			errKey:  "defaults.keep-days",
+		},
+		{
+			name:    "duplicate_name",
+			file:    "dup.yaml",
+			content: "targets:\n  - name: api\n  - name: api\n",
+			errKey:  "targets[1].name",
+		},
+		{
+			name:    "asg_without_cluster",
+			file:    "asg.yaml",
+			content: "targets:\n  - name: api\n    asgname: api-asg\n",
+			errKey:  "targets[0]: asgname and clustername",
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "ami-replacer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, tc.file)
+			if err := ioutil.WriteFile(path, []byte(tc.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadFile(path)
+			if tc.errKey == "" && err != nil {
+				t.Errorf("got: %v\nwant: %v", err, nil)
+			}
+			if tc.errKey != "" && (err == nil || !strings.Contains(err.Error(), tc.errKey)) {
+				t.Errorf("got: %v\nwant error containing: %s", err, tc.errKey)
+			}
+		})
+	}
+}
+
+func TestFile_TargetExternalID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ami-replacer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "targets.yaml")
+	content := `
+defaults:
+  role-arn: arn:aws:iam::111111111111:role/ami-replacer
+  external-id: shared
+targets:
+  - name: prod
+    external-id: prod-secret
+  - name: staging
+`
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name   string
+		target string
+		config string
+		flag   string
+		want   string
+	}{
+		{
+			name:   "target",
+			target: "prod",
+			config: path,
+			want:   "prod-secret",
+		},
+		{
+			name:   "defaults",
+			target: "staging",
+			config: path,
+			want:   "shared",
+		},
+		{
+			name:   "flag",
+			target: "prod",
+			config: path,
+			flag:   "flag-secret",
+			want:   "flag-secret",
+		},
+		{
+			name:   "no_config",
+			target: "default",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			global := flag.NewFlagSet("global", flag.ContinueOnError)
+			global.String("config", "", "")
+			global.String("external-id", "", "")
+			args := []string{}
+			if tc.config != "" {
+				args = append(args, "--config", tc.config)
+			}
+			if tc.flag != "" {
+				args = append(args, "--external-id", tc.flag)
+			}
+			if err := global.Parse(args); err != nil {
+				t.Fatal(err)
+			}
+			ctx := cli.NewContext(nil, flag.NewFlagSet("rollback", flag.ContinueOnError), cli.NewContext(nil, global, nil))
+			got, err := TargetExternalID(ctx, tc.target)
+			if err != nil {
+				t.Fatalf("got: %v\nwant: %v", err, nil)
+			}
+			if got != tc.want {
+				t.Errorf("got: %q\nwant: %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// DefaultPrices are the USD per GB-month of EBS snapshot storage tiers in us-east-1.
+var DefaultPrices = map[string]float64{
+	"standard": 0.05,
+	"archive":  0.0125,
+}
+
+// ParsePrices parses "tier=price" pairs, e.g. "archive=0.0125".
+func ParsePrices(prices []string) (map[string]float64, error) {
+	parsed := make(map[string]float64, len(prices))
+	for _, s := range prices {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 {
+			return nil, xerrors.Errorf("invalid price %q: expected tier=price", s)
+		}
+		price, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid price %q: %w", s, err)
+		}
+		parsed[strings.TrimSpace(kv[0])] = price
+	}
+	if err := ValidatePrices(parsed); err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
+
+// ValidatePrices checks every price is of a known tier and not negative.
+func ValidatePrices(prices map[string]float64) error {
+	for tier, price := range prices {
+		if _, ok := DefaultPrices[tier]; !ok {
+			return xerrors.Errorf("unknown storage tier %q: expected standard or archive", tier)
+		}
+		if price < 0 {
+			return xerrors.Errorf("price of %s must not be negative, got %v", tier, price)
+		}
+	}
+	return nil
+}
+
+// Price returns the USD per GB-month of a snapshot storage tier.
+func (c *Config) Price(tier string) float64 {
+	if price, ok := c.Prices[tier]; ok {
+		return price
+	}
+	return DefaultPrices[tier]
+}
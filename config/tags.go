@@ -0,0 +1,76 @@
+package config
+
+import (
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// TagFilter matches a resource tag by key and, unless AnyValue is set, by value.
+type TagFilter struct {
+	Key      string
+	Value    string
+	AnyValue bool
+}
+
+// ParseTagFilter parses "key=value", or "key" to match any value of key.
+func ParseTagFilter(s string) (TagFilter, error) {
+	kv := strings.SplitN(s, "=", 2)
+	key := strings.TrimSpace(kv[0])
+	if key == "" {
+		return TagFilter{}, xerrors.Errorf("invalid tag %q: expected key=value", s)
+	}
+	if len(kv) == 1 {
+		return TagFilter{Key: key, AnyValue: true}, nil
+	}
+	return TagFilter{Key: key, Value: kv[1]}, nil
+}
+
+// ParseTagFilters parses every tag with ParseTagFilter.
+func ParseTagFilters(tags []string) ([]TagFilter, error) {
+	filters := make([]TagFilter, 0, len(tags))
+	for _, tag := range tags {
+		f, err := ParseTagFilter(tag)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+// Match reports whether tags satisfies the filter.
+func (f TagFilter) Match(tags map[string]string) bool {
+	v, ok := tags[f.Key]
+	if !ok {
+		return false
+	}
+	return f.AnyValue || v == f.Value
+}
+
+// MatchAll reports whether tags satisfies every filter.
+func MatchAll(filters []TagFilter, tags map[string]string) bool {
+	for _, f := range filters {
+		if !f.Match(tags) {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchAny reports whether tags satisfies at least one filter.
+func MatchAny(filters []TagFilter, tags map[string]string) bool {
+	for _, f := range filters {
+		if f.Match(tags) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f TagFilter) String() string {
+	if f.AnyValue {
+		return f.Key
+	}
+	return f.Key + "=" + f.Value
+}
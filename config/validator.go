@@ -5,7 +5,9 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/xerrors"
 )
@@ -27,8 +29,82 @@ func ParseRegion(i string) (interface{}, error) {
 
 //IsValidRegion validates given region
 func IsValidRegion(i string) bool {
-	reg, _ := regexp.Compile("^(us|eu|ap|sa|ca)\\-\\w+\\-\\d+$")
-	return reg.MatchString(i)
+	return regionRegex.MatchString(i)
+}
+
+// AllRegions selects every region enabled for the account.
+const AllRegions = "all"
+
+// ParseRegions splits a comma separated list of regions.
+func ParseRegions(s string) []string {
+	var regions []string
+	for _, region := range strings.Split(s, ",") {
+		if region = strings.TrimSpace(region); region != "" {
+			regions = append(regions, region)
+		}
+	}
+	return regions
+}
+
+// ValidateRegions checks every region, or that AllRegions is given alone.
+func ValidateRegions(regions []string) error {
+	for _, region := range regions {
+		if region == AllRegions {
+			if len(regions) != 1 {
+				return xerrors.Errorf("%q must not be combined with other regions", AllRegions)
+			}
+			continue
+		}
+		if !IsValidRegion(region) {
+			return xerrors.Errorf("invalid region %q", region)
+		}
+	}
+	return nil
+}
+
+// roleArnRegex matches iam role arns of every partition.
+var roleArnRegex = regexp.MustCompile(`^arn:aws[\w-]*:iam::(\d{12}):role/.+$`)
+
+// ValidateRole checks the role arn, and that an external id comes with a role.
+func ValidateRole(roleArn string, externalID string) error {
+	if roleArn == "" {
+		if externalID != "" {
+			return xerrors.New("external-id: requires role-arn")
+		}
+		return nil
+	}
+	if !roleArnRegex.MatchString(roleArn) {
+		return xerrors.Errorf("role-arn: invalid iam role arn %q", roleArn)
+	}
+	return nil
+}
+
+// RoleAccount returns the account id of a role arn, or "" for an invalid arn.
+func RoleAccount(roleArn string) string {
+	m := roleArnRegex.FindStringSubmatch(roleArn)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// regionRegex matches region names of the aws, aws-cn and aws-us-gov partitions.
+var regionRegex = regexp.MustCompile(`^(us|us-gov|eu|ap|sa|ca|me|af|il|mx|cn)-\w+-\d+$`)
+
+// ParseAge parses an age like "90d" or any time.ParseDuration string like "36h".
+func ParseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days < 0 {
+			return 0, xerrors.Errorf("invalid age %q: expected days like 90d or a duration like 36h", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, xerrors.Errorf("invalid age %q: expected days like 90d or a duration like 36h", s)
+	}
+	return d, nil
 }
 
 //IsValidProfile validate given profile.
@@ -1,14 +1,60 @@
 package fsm
 
 import (
+	"time"
+
 	"github.com/looplab/fsm"
 	"github.com/nest-egg/ami-replacer/log"
+	"golang.org/x/xerrors"
+)
+
+// States of a replacement. Each state is entered by the event of the same name.
+const (
+	Planning           = "planning"
+	Surging            = "surging"
+	WaitingForCapacity = "waiting-for-capacity"
+	Draining           = "draining"
+	Terminating        = "terminating"
+	Stabilizing        = "stabilizing"
+	Shrinking          = "shrinking"
+	Done               = "done"
+	Failed             = "failed"
+	RolledBack         = "rolled-back"
 )
 
+// transitions maps every state to the states it can be entered from.
+var transitions = map[string][]string{
+	Surging:            {Planning, Stabilizing},
+	WaitingForCapacity: {Planning, Surging, Stabilizing},
+	// batches are drained one after another, once the previous one has stabilized.
+	Draining: {Planning, Surging, WaitingForCapacity, Stabilizing},
+	// unused instances are terminated without being drained.
+	Terminating: {Planning, Draining, Stabilizing},
+	Stabilizing: {Terminating},
+	Shrinking:   {Planning, Surging, WaitingForCapacity, Stabilizing},
+	Done:        {Shrinking},
+	Failed:      {Planning, Surging, WaitingForCapacity, Draining, Terminating, Stabilizing, Shrinking},
+	RolledBack:  {Failed},
+}
+
+// Guard vetoes entering a state from another one by returning an error.
+type Guard func(from string) error
+
+// Transition is a change of state of a replacement.
+type Transition struct {
+	From string    `json:"from"`
+	To   string    `json:"to"`
+	At   time.Time `json:"at"`
+}
+
 // Deploy defines ASG state while deploying.
 type Deploy struct {
 	To  string
 	FSM *fsm.FSM
+
+	guards    map[string][]Guard
+	callbacks []func(Transition)
+	history   []Transition
 }
 
 // State is current cluster state information
@@ -24,22 +70,76 @@ type State struct {
 func NewDeploy(to string) *Deploy {
 
 	d := &Deploy{
-		To: to,
+		To:     to,
+		guards: map[string][]Guard{},
 	}
 
+	var events fsm.Events
+	for dst, src := range transitions {
+		events = append(events, fsm.EventDesc{Name: dst, Src: src, Dst: dst})
+	}
 	d.FSM = fsm.NewFSM(
-		"closed",
-		fsm.Events{
-			{Name: "start", Src: []string{"closed"}, Dst: "running"},
-			{Name: "finish", Src: []string{"running"}, Dst: "closed"},
-		},
+		Planning,
+		events,
 		fsm.Callbacks{
-			"enter_state": func(e *fsm.Event) { d.enterState(e) },
+			"before_event": func(e *fsm.Event) { d.beforeEvent(e) },
+			"enter_state":  func(e *fsm.Event) { d.enterState(e) },
 		},
 	)
+	d.OnTransition(func(t Transition) {
+		log.Logger.Debugf("the state of %s changed %s to %s", d.To, t.From, t.To)
+	})
 	return d
 }
 
+// Guard adds a guard to entering state.
+func (d *Deploy) Guard(state string, guard Guard) {
+	d.guards[state] = append(d.guards[state], guard)
+}
+
+// OnTransition calls callback after every transition, e.g. for logging, metrics or hooks.
+func (d *Deploy) OnTransition(callback func(Transition)) {
+	d.callbacks = append(d.callbacks, callback)
+}
+
+// Enter moves the replacement to state, unless it cannot be entered from the current
+// state or a guard vetoes it.
+func (d *Deploy) Enter(state string) error {
+
+	from := d.FSM.Current()
+	err := d.FSM.Event(state)
+	if canceled, ok := err.(fsm.CanceledError); ok {
+		return xerrors.Errorf("Cannot enter state %s from %s: %w", state, from, canceled.Err)
+	}
+	if err != nil {
+		return xerrors.Errorf("Cannot enter state %s from %s: %w", state, from, err)
+	}
+	return nil
+}
+
+// Current returns the state of the replacement.
+func (d *Deploy) Current() string {
+	return d.FSM.Current()
+}
+
+// History returns the transitions of the replacement so far, oldest first.
+func (d *Deploy) History() []Transition {
+	return append([]Transition(nil), d.history...)
+}
+
+func (d *Deploy) beforeEvent(e *fsm.Event) {
+	for _, guard := range d.guards[e.Dst] {
+		if err := guard(e.Src); err != nil {
+			e.Cancel(err)
+			return
+		}
+	}
+}
+
 func (d *Deploy) enterState(e *fsm.Event) {
-	log.Logger.Debugf("the state changed %s to %s\n", d.To, e.Dst)
+	t := Transition{From: e.Src, To: e.Dst, At: time.Now()}
+	d.history = append(d.history, t)
+	for _, callback := range d.callbacks {
+		callback(t)
+	}
 }
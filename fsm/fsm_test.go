@@ -0,0 +1,98 @@
+package fsm
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/xerrors"
+)
+
+func TestDeploy_Enter(t *testing.T) {
+	testCases := []struct {
+		name    string
+		states  []string
+		wantErr bool
+	}{
+		{
+			name:   "replacement",
+			states: []string{Surging, Draining, Terminating, Stabilizing, Draining, Terminating, Stabilizing, Shrinking, Done},
+		},
+		{
+			name:   "unused_instances",
+			states: []string{Terminating, Stabilizing, WaitingForCapacity, Draining},
+		},
+		{
+			name:   "rollback",
+			states: []string{Surging, Draining, Failed, RolledBack},
+		},
+		{
+			name:    "shrink_while_draining",
+			states:  []string{Draining, Shrinking},
+			wantErr: true,
+		},
+		{
+			name:    "rollback_without_failure",
+			states:  []string{Shrinking, Done, RolledBack},
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := NewDeploy("asg")
+			var err error
+			for _, state := range tc.states {
+				if err = d.Enter(state); err != nil {
+					break
+				}
+			}
+			if (err != nil) != tc.wantErr {
+				t.Errorf("got: %v\nwant error: %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestDeploy_Guard(t *testing.T) {
+	d := NewDeploy("asg")
+	steady := xerrors.New("Cluster is not steady state")
+	draining := true
+	d.Guard(Shrinking, func(from string) error {
+		if draining {
+			return steady
+		}
+		return nil
+	})
+	var got []Transition
+	d.OnTransition(func(t Transition) {
+		got = append(got, t)
+	})
+
+	if err := d.Enter(Shrinking); !xerrors.Is(err, steady) {
+		t.Errorf("got: %v\nwant: %v", err, steady)
+	}
+	if d.Current() != Planning {
+		t.Errorf("got: %s\nwant: %s", d.Current(), Planning)
+	}
+	draining = false
+	if err := d.Enter(Shrinking); err != nil {
+		t.Fatalf("got: %v\nwant: %v", err, nil)
+	}
+	if err := d.Enter(Done); err != nil {
+		t.Fatalf("got: %v\nwant: %v", err, nil)
+	}
+
+	var states []string
+	for _, tr := range d.History() {
+		if tr.At.IsZero() {
+			t.Errorf("got: %+v\nwant: timestamped transition", tr)
+		}
+		states = append(states, tr.From+"->"+tr.To)
+	}
+	want := []string{"planning->shrinking", "shrinking->done"}
+	if !reflect.DeepEqual(states, want) {
+		t.Errorf("got: %v\nwant: %v", states, want)
+	}
+	if !reflect.DeepEqual(got, d.History()) {
+		t.Errorf("got: %v\nwant: %v", got, d.History())
+	}
+}
@@ -1,22 +1,27 @@
 module github.com/nest-egg/ami-replacer
 
-go 1.12
+go 1.19
 
 require (
-	github.com/aws/aws-sdk-go v1.19.11
+	github.com/aws/aws-sdk-go v1.55.8
 	github.com/cenkalti/backoff v2.1.1+incompatible
 	github.com/looplab/fsm v0.1.0
+	github.com/urfave/cli v1.20.0
+	go.uber.org/zap v1.10.0
+	golang.org/x/xerrors v0.0.0-20190717185122-a985d3407aa7
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
 	github.com/mitchellh/go-homedir v1.1.0 // indirect
 	github.com/spf13/cobra v0.0.3 // indirect
 	github.com/spf13/viper v1.3.2 // indirect
-	github.com/urfave/cli v1.20.0
 	go.uber.org/atomic v1.4.0 // indirect
 	go.uber.org/multierr v1.1.0 // indirect
-	go.uber.org/zap v1.10.0
 	golang.org/x/crypto v0.0.0-20190404164418-38d8ce5564a5 // indirect
 	golang.org/x/lint v0.0.0-20190409202823-959b441ac422 // indirect
 	golang.org/x/net v0.0.0-20190404232315-eb5bcb51f2a3 // indirect
 	golang.org/x/sys v0.0.0-20190405154228-4b34438f7a67 // indirect
 	golang.org/x/tools v0.0.0-20190409223705-96f2e7ef861b // indirect
-	golang.org/x/xerrors v0.0.0-20190717185122-a985d3407aa7
 )
@@ -8,19 +8,30 @@ import (
 
 var (
 	//Logger represents zap sugared logger.
-	Logger *zap.SugaredLogger
+	//It discards everything until InitLogger is called.
+	Logger = zap.NewNop().Sugar()
 )
 
-//InitLogger creates new zap logger.
+// InitLogger creates new zap logger.
 func InitLogger(debug bool) (err error) {
-	Logger, err = newLogger(debug)
+	Logger, err = newLogger(debug, "stdout")
 	if err != nil {
 		return xerrors.Errorf("error in new logger: %w", err)
 	}
 	return nil
 }
 
-func newLogger(debug bool) (*zap.SugaredLogger, error) {
+// InitStderrLogger creates new zap logger writing to stderr,
+// which keeps stdout free for command output.
+func InitStderrLogger(debug bool) (err error) {
+	Logger, err = newLogger(debug, "stderr")
+	if err != nil {
+		return xerrors.Errorf("error in new logger: %w", err)
+	}
+	return nil
+}
+
+func newLogger(debug bool, output string) (*zap.SugaredLogger, error) {
 	level := zap.NewAtomicLevel()
 	if debug {
 		level.SetLevel(zapcore.DebugLevel)
@@ -46,7 +57,7 @@ func newLogger(debug bool) (*zap.SugaredLogger, error) {
 			EncodeDuration: zapcore.StringDurationEncoder,
 			EncodeCaller:   zapcore.ShortCallerEncoder,
 		},
-		OutputPaths:      []string{"stdout"},
+		OutputPaths:      []string{output},
 		ErrorOutputPaths: []string{"stderr"},
 	}
 	logger, err := myConfig.Build()
@@ -13,23 +13,71 @@ import (
 )
 
 var (
-	cmds     []cli.Command
-	rmiFlags []cli.Flag
-	rmsFlags []cli.Flag
-	rplFlags []cli.Flag
-	asg      actions.AutoScaling
-	region   string
-	profile  string
-	owner    string
-	image    string
-	dryrun   bool
+	cmds          []cli.Command
+	appFlags      []cli.Flag
+	rmiFlags      []cli.Flag
+	rmsFlags      []cli.Flag
+	rplFlags      []cli.Flag
+	planFlags     []cli.Flag
+	reportFlags   []cli.Flag
+	rollbackFlags []cli.Flag
+	asg           actions.AutoScaling
+	owner         string
+	image         string
+	dryrun        bool
 )
 
 var makeReplacer = actions.NewReplacer
 
 func init() {
 	cli.VersionFlag = cli.BoolFlag{Name: "version, V"}
+	appFlags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "region, r",
+			Value:  "ap-northeast-1",
+			Usage:  "aws region",
+			EnvVar: "AWS_REGION,AWS_DEFAULT_REGION",
+		},
+		cli.StringFlag{
+			Name:   "profile, p",
+			Value:  "admin",
+			Usage:  "aws shared config profile",
+			EnvVar: "AWS_PROFILE",
+		},
+		cli.StringFlag{
+			Name:   "config",
+			Usage:  "YAML or JSON file describing targets, flags override file values",
+			EnvVar: "AMI_REPLACER_CONFIG",
+		},
+		cli.IntFlag{
+			Name:  "concurrency",
+			Value: 1,
+			Usage: "max number of targets processed at once",
+		},
+		cli.BoolFlag{
+			Name:  "fail-fast",
+			Usage: "stop starting new targets after the first failure",
+		},
+		cli.StringFlag{
+			Name:  "role-arn",
+			Usage: "iam role to assume with the profile credentials, e.g. to work in another account",
+		},
+		cli.StringFlag{
+			Name:  "external-id",
+			Usage: "external id required to assume --role-arn",
+		},
+		cli.StringFlag{
+			Name:   "state-dir",
+			Usage:  "directory recording rpl runs to roll back, ~/.ami-replacer/runs by default",
+			EnvVar: "AMI_REPLACER_STATE_DIR",
+		},
+	}
+
 	rmiFlags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "output,O",
+			Usage: "print a result document: table, json or yaml",
+		},
 		cli.BoolFlag{
 			Name:  "dry-run, d",
 			Usage: "dry run",
@@ -46,9 +94,59 @@ func init() {
 		},
 		cli.IntFlag{
 			Name:  "gen,g",
-			Value: 2,
+			Value: config.DefaultGeneration,
 			Usage: "max generations to retain",
 		},
+		cli.IntFlag{
+			Name:  "keep-days",
+			Usage: "also retain images younger than this many days",
+		},
+		cli.StringFlag{
+			Name:  "max-age",
+			Usage: "delete images older than this regardless of generations, e.g. 90d",
+		},
+		cli.BoolFlag{
+			Name:  "delete-snapshots",
+			Usage: "also delete the snapshots of deregistered images unless still in use",
+		},
+		cli.BoolFlag{
+			Name:  "retire",
+			Usage: "deprecate outdated images first, and deregister them once --grace-period has passed",
+		},
+		cli.StringFlag{
+			Name:  "grace-period",
+			Value: "14d",
+			Usage: "time between deprecation and deregistration of retired images, e.g. 14d",
+		},
+		cli.BoolFlag{
+			Name:  "force-unshare",
+			Usage: "revoke launch permissions of images shared with other accounts or public before deregistering them",
+		},
+		cli.StringSliceFlag{
+			Name:  "tag",
+			Usage: "select images by tag key=value (or just key) in addition to --image, may be repeated",
+		},
+		cli.StringFlag{
+			Name:  "keep-tag",
+			Value: "ami-replacer/keep=true",
+			Usage: "never deregister images having this tag key=value (or just key)",
+		},
+		cli.StringFlag{
+			Name:  "lineage-regex",
+			Usage: "apply retention per lineage, named by the first capture group of the image name",
+		},
+		cli.StringFlag{
+			Name:  "lineage-tag",
+			Usage: "apply retention per lineage, named by the value of this image tag",
+		},
+		cli.StringFlag{
+			Name:  "regions",
+			Usage: "comma separated regions to sweep in parallel, or all for every enabled region",
+		},
+		cli.StringFlag{
+			Name:  "source-tag",
+			Usage: "image tag holding the source AMI id, to match copies across regions instead of by name",
+		},
 		cli.BoolFlag{
 			Name:  "verbose,v",
 			Usage: "enable debug mode",
@@ -56,6 +154,10 @@ func init() {
 	}
 
 	rmsFlags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "output,O",
+			Usage: "print a result document: table, json or yaml",
+		},
 		cli.BoolFlag{
 			Name:  "dry-run, d",
 			Usage: "dry run",
@@ -65,6 +167,37 @@ func init() {
 			Value: "admin",
 			Usage: "owner of amis",
 		},
+		cli.StringFlag{
+			Name:  "min-age",
+			Usage: "keep snapshots younger than this, e.g. 30d",
+		},
+		cli.StringSliceFlag{
+			Name:  "snapshot-tag",
+			Usage: "select snapshots by tag key=value (or just key), may be repeated",
+		},
+		cli.StringSliceFlag{
+			Name:  "exclude-tag",
+			Usage: "keep snapshots having this tag key=value (or just key), may be repeated",
+		},
+		cli.StringFlag{
+			Name:  "description",
+			Usage: "select snapshots whose description matches this regex",
+		},
+		cli.StringFlag{
+			Name:  "action",
+			Value: "delete",
+			Usage: "what to do with unused snapshots: delete, archive (move to the archive tier once older than --min-age) or recycle (delete only those a Recycle Bin rule retains)",
+		},
+		cli.IntFlag{
+			Name:  "workers",
+			Value: 4,
+			Usage: "number of snapshots to delete or archive at once",
+		},
+		cli.Float64Flag{
+			Name:  "rate",
+			Value: 5,
+			Usage: "max snapshot deletions or archivals per second, 0 for unlimited",
+		},
 		cli.BoolFlag{
 			Name:  "verbose,v",
 			Usage: "enable debug mode",
@@ -72,10 +205,26 @@ func init() {
 	}
 
 	rplFlags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "output,O",
+			Usage: "print a result document: table, json or yaml",
+		},
 		cli.BoolFlag{
 			Name:  "dry-run, d",
 			Usage: "dry run",
 		},
+		cli.BoolFlag{
+			Name:  "no-rollback",
+			Usage: "leave a failed replacement as it is instead of rolling it back",
+		},
+		cli.BoolFlag{
+			Name:  "resume",
+			Usage: "continue the last unfinished run against the asg from its last completed step",
+		},
+		cli.StringFlag{
+			Name:  "update-template",
+			Usage: "create a launch template version with the newest AMI and make it the `default` or `pin` the asg to it before replacing instances",
+		},
 		cli.StringFlag{
 			Name:  "asgname,a",
 			Value: "asg",
@@ -86,6 +235,23 @@ func init() {
 			Value: "admin",
 			Usage: "ecs cluster name",
 		},
+		cli.StringSliceFlag{
+			Name:  "asg-tag",
+			Usage: "select asgs by tag key=value instead of asgname, may be repeated",
+		},
+		cli.StringFlag{
+			Name:  "cluster-tag",
+			Value: "ami-replacer/cluster",
+			Usage: "asg tag holding the ecs cluster name, falls back to ECS_CLUSTER in the launch template user data",
+		},
+		cli.IntFlag{
+			Name:  "batch-size",
+			Usage: "number of instances to drain and replace together, the asg is surged by as many",
+		},
+		cli.IntFlag{
+			Name:  "batch-percent",
+			Usage: "percentage of the asg to drain and replace together, instead of batch-size",
+		},
 		cli.StringFlag{
 			Name:  "image,i",
 			Value: "other",
@@ -102,6 +268,166 @@ func init() {
 		},
 	}
 
+	rollbackFlags = []cli.Flag{
+		cli.BoolFlag{
+			Name:  "verbose,v",
+			Usage: "enable debug mode",
+		},
+	}
+
+	planFlags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "output,O",
+			Value: "table",
+			Usage: "output format: table, json or yaml",
+		},
+		cli.StringFlag{
+			Name:  "asgname,a",
+			Value: "asg",
+			Usage: "auto scaling group name",
+		},
+		cli.StringFlag{
+			Name:  "clustername,c",
+			Value: "admin",
+			Usage: "ecs cluster name",
+		},
+		cli.StringSliceFlag{
+			Name:  "asg-tag",
+			Usage: "select asgs by tag key=value instead of asgname, may be repeated",
+		},
+		cli.StringFlag{
+			Name:  "cluster-tag",
+			Value: "ami-replacer/cluster",
+			Usage: "asg tag holding the ecs cluster name, falls back to ECS_CLUSTER in the launch template user data",
+		},
+		cli.IntFlag{
+			Name:  "batch-size",
+			Usage: "number of instances to drain and replace together, the asg is surged by as many",
+		},
+		cli.IntFlag{
+			Name:  "batch-percent",
+			Usage: "percentage of the asg to drain and replace together, instead of batch-size",
+		},
+		cli.StringFlag{
+			Name:  "update-template",
+			Usage: "create a launch template version with the newest AMI and make it the `default` or `pin` the asg to it before replacing instances",
+		},
+		cli.StringFlag{
+			Name:  "image,i",
+			Value: "other",
+			Usage: "image name",
+		},
+		cli.StringFlag{
+			Name:  "owner,o",
+			Value: "admin",
+			Usage: "owner of amis",
+		},
+		cli.IntFlag{
+			Name:  "gen,g",
+			Value: config.DefaultGeneration,
+			Usage: "max generations to retain",
+		},
+		cli.IntFlag{
+			Name:  "keep-days",
+			Usage: "also retain images younger than this many days",
+		},
+		cli.StringFlag{
+			Name:  "max-age",
+			Usage: "delete images older than this regardless of generations, e.g. 90d",
+		},
+		cli.BoolFlag{
+			Name:  "delete-snapshots",
+			Usage: "also delete the snapshots of deregistered images unless still in use",
+		},
+		cli.BoolFlag{
+			Name:  "retire",
+			Usage: "deprecate outdated images first, and deregister them once --grace-period has passed",
+		},
+		cli.StringFlag{
+			Name:  "grace-period",
+			Value: "14d",
+			Usage: "time between deprecation and deregistration of retired images, e.g. 14d",
+		},
+		cli.BoolFlag{
+			Name:  "force-unshare",
+			Usage: "revoke launch permissions of images shared with other accounts or public before deregistering them",
+		},
+		cli.StringSliceFlag{
+			Name:  "tag",
+			Usage: "select images by tag key=value (or just key) in addition to --image, may be repeated",
+		},
+		cli.StringSliceFlag{
+			Name:  "snapshot-tag",
+			Usage: "select snapshots by tag key=value (or just key), may be repeated",
+		},
+		cli.StringFlag{
+			Name:  "min-age",
+			Usage: "keep snapshots younger than this, e.g. 30d",
+		},
+		cli.StringSliceFlag{
+			Name:  "exclude-tag",
+			Usage: "keep snapshots having this tag key=value (or just key), may be repeated",
+		},
+		cli.StringFlag{
+			Name:  "description",
+			Usage: "select snapshots whose description matches this regex",
+		},
+		cli.StringFlag{
+			Name:  "action",
+			Value: "delete",
+			Usage: "what to do with unused snapshots: delete, archive (move to the archive tier once older than --min-age) or recycle (delete only those a Recycle Bin rule retains)",
+		},
+		cli.StringFlag{
+			Name:  "keep-tag",
+			Value: "ami-replacer/keep=true",
+			Usage: "never deregister images having this tag key=value (or just key)",
+		},
+		cli.StringFlag{
+			Name:  "lineage-regex",
+			Usage: "apply retention per lineage, named by the first capture group of the image name",
+		},
+		cli.StringFlag{
+			Name:  "lineage-tag",
+			Usage: "apply retention per lineage, named by the value of this image tag",
+		},
+		cli.StringFlag{
+			Name:  "regions",
+			Usage: "comma separated regions to sweep in parallel, or all for every enabled region",
+		},
+		cli.StringFlag{
+			Name:  "source-tag",
+			Usage: "image tag holding the source AMI id, to match copies across regions instead of by name",
+		},
+		cli.BoolFlag{
+			Name:  "verbose,v",
+			Usage: "enable debug mode",
+		},
+	}
+
+	reportFlags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "output,O",
+			Value: "table",
+			Usage: "output format: table, csv or json",
+		},
+		cli.StringSliceFlag{
+			Name:  "price",
+			Usage: "USD per GB-month of a snapshot storage tier, e.g. archive=0.0125, may be repeated",
+		},
+		cli.StringFlag{
+			Name:  "group-tag",
+			Usage: "also total snapshots by the value of this tag",
+		},
+	}
+	for _, flag := range planFlags {
+		switch flag.GetName() {
+		case "output,O", "asgname,a", "clustername,c", "asg-tag", "cluster-tag", "batch-size", "batch-percent", "update-template", "action":
+			// rpl is not reported on.
+		default:
+			reportFlags = append(reportFlags, flag)
+		}
+	}
+
 	cmds = []cli.Command{
 		{
 			Name:    "rmi",
@@ -124,9 +450,28 @@ func init() {
 			Flags:   rplFlags,
 			Action:  replaceInstances,
 		},
+		{
+			Name:      "rollback",
+			Usage:     "roll back a replacement recorded by rpl",
+			ArgsUsage: "<run-id>",
+			Flags:     rollbackFlags,
+			Action:    rollback,
+		},
+		{
+			Name:      "plan",
+			Usage:     "show what rmi, rms and rpl would do without changing anything",
+			ArgsUsage: "[rmi|rms|rpl]...",
+			Flags:     planFlags,
+			Action:    plan,
+		},
+		{
+			Name:      "report",
+			Usage:     "estimate the monthly storage cost rmi and rms would save",
+			ArgsUsage: "[rmi|rms]...",
+			Flags:     reportFlags,
+			Action:    report,
+		},
 	}
-	region = "ap-northeast-1"
-	profile = "admin"
 }
 
 func main() {
@@ -138,6 +483,7 @@ func doMain(args []string) {
 	app.Name = "ami-replacer"
 	app.Usage = "replace ecs instance and amis"
 	app.Version = "0.1"
+	app.Flags = appFlags
 	app.Commands = cmds
 	app.Action = noArgs
 
@@ -153,73 +499,310 @@ func noArgs(context *cli.Context) error {
 	return cli.NewExitError("No args provided", 2)
 }
 
-func removeAMIs(ctx *cli.Context) error {
-	conf := config.SetConfig(ctx)
-	log.InitLogger(conf.Debug)
+func loadConfigs(ctx *cli.Context) ([]*config.Config, error) {
+	if format := ctx.String("output"); format != "" && !isValidFormat(format, ctx.Command.Name) {
+		return nil, xerrors.Errorf("Unknown output format: %s", format)
+	}
+	if ctx.String("output") != "" {
+		log.InitStderrLogger(ctx.Bool("verbose"))
+	} else {
+		log.InitLogger(ctx.Bool("verbose"))
+	}
 
-	log.Logger.Infof("AMI prefix to delete: %s\n", conf.Image)
+	confs, err := config.LoadConfigs(ctx)
+	if err != nil {
+		return nil, xerrors.Errorf("Failed to load config: %w", err)
+	}
+	return confs, nil
+}
 
-	_, err := config.ParseRegion(region)
+func newReplacer(conf *config.Config) (*actions.Replacer, error) {
+	_, err := config.ParseRegion(conf.Region)
 	if err != nil {
-		return xerrors.Errorf("Invalid aws region: %w", err)
+		return nil, xerrors.Errorf("Invalid aws region %s: %w", conf.Region, err)
 	}
 
-	if !config.IsValidProfile(profile) {
-		return xerrors.New("Invalid config")
+	if !config.IsValidProfile(conf.Profile) {
+		return nil, xerrors.Errorf("Invalid aws profile: %s", conf.Profile)
 	}
 
 	r := makeReplacer(
 		context.Background(),
-		region,
-		profile,
+		conf.Region,
+		conf.Profile,
+		actions.AssumeRole{RoleArn: conf.RoleArn, ExternalID: conf.ExternalID},
 	)
+	return r, nil
+}
+
+// snapshotScope identifies the account and region whose snapshots rms sweeps,
+// as snapshots are swept per account and region, not per target.
+func snapshotScope(conf *config.Config) string {
+	return conf.Region + "/" + conf.Profile + "/" + conf.RoleArn + "/" + conf.Owner
+}
+
+func runTargets(ctx *cli.Context, confs []*config.Config, fn func(*config.Config, *actions.Result) error) error {
+	results := actions.RunTargets(confs, actions.RunOptions{
+		Concurrency: ctx.GlobalInt("concurrency"),
+		FailFast:    ctx.GlobalBool("fail-fast"),
+	}, fn)
+
+	if format := ctx.String("output"); format != "" {
+		if err := writeDocument(os.Stdout, format, results); err != nil {
+			return xerrors.Errorf("Failed to write output: %w", err)
+		}
+	}
+	if len(results) == 1 {
+		return results[0].Err
+	}
+	return actions.Summarize(results)
+}
 
-	if err := r.RemoveAMIs(conf); err != nil {
-		return xerrors.Errorf("Failed to remove AMIs: %w", err)
+func removeAMIs(ctx *cli.Context) error {
+	confs, err := loadConfigs(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = runTargets(ctx, confs, func(conf *config.Config, res *actions.Result) error {
+		log.Logger.Infof("AMI prefix to delete: %s\n", conf.Image)
+
+		r, err := newReplacer(conf)
+		if err != nil {
+			return err
+		}
+		r.Record(res)
+
+		if err := r.RemoveAMIs(conf); err != nil {
+			return xerrors.Errorf("Failed to remove AMIs: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 	log.Logger.Info("Successfully removed all unused AMIs")
 	return nil
 }
 
 func removeSnapshots(ctx *cli.Context) error {
-	conf := config.SetConfig(ctx)
-	log.InitLogger(conf.Debug)
+	confs, err := loadConfigs(ctx)
+	if err != nil {
+		return err
+	}
 
-	r := makeReplacer(
-		context.Background(),
-		region,
-		profile,
-	)
+	var accounts []*config.Config
+	done := map[string]bool{}
+	for _, conf := range confs {
+		key := snapshotScope(conf)
+		if !done[key] {
+			done[key] = true
+			accounts = append(accounts, conf)
+		}
+	}
 
-	err := r.RemoveSnapShots(conf)
+	err = runTargets(ctx, accounts, func(conf *config.Config, res *actions.Result) error {
+		r, err := newReplacer(conf)
+		if err != nil {
+			return err
+		}
+		r.Record(res)
+
+		if err := r.RemoveSnapShots(conf); err != nil {
+			return xerrors.Errorf("Failed to remove snapshots: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return xerrors.Errorf("Failed to remove snapshots: %w", err)
+		return err
 	}
 	log.Logger.Info("Successfully removed all unused snapshots")
 	return nil
 }
 
-func replaceInstances(ctx *cli.Context) error {
-	conf := config.SetConfig(ctx)
-	log.InitLogger(conf.Debug)
+func discoverTargets(confs []*config.Config) ([]*config.Config, error) {
+	var targets []*config.Config
+	for _, conf := range confs {
+		if len(conf.AsgTags) == 0 {
+			targets = append(targets, conf)
+			continue
+		}
 
-	_, err := config.ParseRegion(region)
+		r, err := newReplacer(conf)
+		if err != nil {
+			return nil, err
+		}
+		found, err := r.DiscoverTargets(conf)
+		if err != nil {
+			return nil, xerrors.Errorf("Failed to discover asgs of %s: %w", conf.Name, err)
+		}
+		targets = append(targets, found...)
+	}
+	return targets, nil
+}
+
+func replaceInstances(ctx *cli.Context) error {
+	confs, err := loadConfigs(ctx)
 	if err != nil {
-		return xerrors.Errorf("aws region is invalid!: %w", err)
+		return err
 	}
 
-	if !config.IsValidProfile(profile) {
-		return xerrors.New("Invalid Config")
+	confs, err = discoverTargets(confs)
+	if err != nil {
+		return err
 	}
 
-	r := makeReplacer(
-		context.Background(),
-		region,
-		profile,
-	)
+	return runTargets(ctx, confs, func(conf *config.Config, res *actions.Result) error {
+		log.Logger.Infof("Replace instances of asg %s in cluster %s", conf.Asgname, conf.Clustername)
+
+		r, err := newReplacer(conf)
+		if err != nil {
+			return err
+		}
+		r.Record(res)
+
+		if err := r.ReplaceInstance(conf); err != nil {
+			return xerrors.Errorf("Failed to replace instance: %w", err)
+		}
+		return nil
+	})
+}
+
+func rollback(ctx *cli.Context) error {
+	log.InitLogger(ctx.Bool("verbose"))
+	if ctx.NArg() != 1 {
+		return xerrors.New("Expected the id of the run to roll back")
+	}
 
-	if err := r.ReplaceInstance(conf); err != nil {
-		return xerrors.Errorf("Failed to replace instance: %w", err)
+	dir := config.StateDir(ctx)
+	run, err := actions.LoadRun(dir, ctx.Args().First())
+	if err != nil {
+		return err
+	}
+	if run.RolledBack {
+		log.Logger.Infof("Run %s was already rolled back, rolling it back again", run.ID)
+	}
+	externalID, err := config.TargetExternalID(ctx, run.Target)
+	if err != nil {
+		return err
+	}
+	r, err := newReplacer(&config.Config{
+		Region:     run.Region,
+		Profile:    run.Profile,
+		RoleArn:    run.RoleArn,
+		ExternalID: externalID,
+	})
+	if err != nil {
+		return err
+	}
+	if err := r.Rollback(run); err != nil {
+		return xerrors.Errorf("Failed to roll back run %s: %w", run.ID, err)
 	}
 	return nil
 }
+
+func plan(ctx *cli.Context) error {
+	commands := map[string]bool{"rmi": true, "rms": true, "rpl": true}
+	if ctx.NArg() != 0 {
+		commands = map[string]bool{}
+		for _, arg := range ctx.Args() {
+			switch arg {
+			case "rmi", "rms", "rpl":
+				commands[arg] = true
+			default:
+				return xerrors.Errorf("Unknown command to plan: %s", arg)
+			}
+		}
+	}
+	confs, err := loadConfigs(ctx)
+	if err != nil {
+		return err
+	}
+	if commands["rpl"] {
+		confs, err = discoverTargets(confs)
+		if err != nil {
+			return err
+		}
+	}
+
+	plans := make(actions.Plans, len(confs))
+	accounts := map[string]bool{}
+	for i, conf := range confs {
+		key := snapshotScope(conf)
+		sweep := commands["rms"] && !accounts[key]
+		accounts[key] = true
+
+		p := &actions.Plan{Target: conf.Name}
+		plans[i] = p
+
+		r, err := newReplacer(conf)
+		if err != nil {
+			return err
+		}
+		if commands["rmi"] {
+			if err := r.PlanAMIs(conf, p); err != nil {
+				return xerrors.Errorf("Failed to plan rmi for %s: %w", conf.Name, err)
+			}
+		}
+		if sweep {
+			if err := r.PlanSnapshots(conf, p); err != nil {
+				return xerrors.Errorf("Failed to plan rms for %s: %w", conf.Name, err)
+			}
+		}
+		if commands["rpl"] {
+			if err := r.PlanReplacement(conf, p); err != nil {
+				return xerrors.Errorf("Failed to plan rpl for %s: %w", conf.Name, err)
+			}
+		}
+	}
+
+	return writeDocument(os.Stdout, ctx.String("output"), plans)
+}
+
+func report(ctx *cli.Context) error {
+	commands := map[string]bool{"rmi": true, "rms": true}
+	if ctx.NArg() != 0 {
+		commands = map[string]bool{}
+		for _, arg := range ctx.Args() {
+			switch arg {
+			case "rmi", "rms":
+				commands[arg] = true
+			default:
+				return xerrors.Errorf("Unknown command to report on: %s", arg)
+			}
+		}
+	}
+	confs, err := loadConfigs(ctx)
+	if err != nil {
+		return err
+	}
+
+	reports := make(actions.Reports, len(confs))
+	accounts := map[string]bool{}
+	for i, conf := range confs {
+		key := snapshotScope(conf)
+		sweep := commands["rms"] && !accounts[key]
+		accounts[key] = true
+
+		rep := &actions.Report{Target: conf.Name}
+		reports[i] = rep
+
+		r, err := newReplacer(conf)
+		if err != nil {
+			return err
+		}
+		if commands["rmi"] {
+			if err := r.ReportAMIs(conf, rep); err != nil {
+				return xerrors.Errorf("Failed to report on rmi for %s: %w", conf.Name, err)
+			}
+		}
+		if sweep {
+			if err := r.ReportSnapshots(conf, rep); err != nil {
+				return xerrors.Errorf("Failed to report on rms for %s: %w", conf.Name, err)
+			}
+		}
+		rep.Summarize()
+	}
+
+	return writeDocument(os.Stdout, ctx.String("output"), reports)
+}
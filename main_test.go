@@ -1,29 +1,139 @@
 package main
 
 import (
+	"context"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/nest-egg/ami-replacer/actions"
+	"github.com/nest-egg/ami-replacer/config"
 	"github.com/urfave/cli"
 )
 
 func TestMain(t *testing.T) {
 
-	makeReplacer = actions.NewMockReplacer
+	makeReplacer = func(ctx context.Context, region string, profile string, role actions.AssumeRole) *actions.Replacer {
+		return actions.NewMockReplacer(ctx, region, profile)
+	}
+	awsHome, err := ioutil.TempDir("", "ami-replacer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(awsHome)
+	if err := ioutil.WriteFile(filepath.Join(awsHome, "config"), []byte("[profile admin]\n[profile prod]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config.AWSHomeDir = func() string { return awsHome }
+	stateDir := filepath.Join(awsHome, "runs")
+	os.Setenv("AMI_REPLACER_STATE_DIR", stateDir)
+	defer os.Unsetenv("AMI_REPLACER_STATE_DIR")
+
 	app := cli.NewApp()
 	app.Name = "finbeeami"
 	app.Usage = "remove unused ami"
 	app.Version = "0.0.1"
+	app.Flags = appFlags
 	app.Commands = cmds
-	args := os.Args[0:1]
 
 	t.Run("remove images", func(t *testing.T) {
 		//setup args
+		args := os.Args[0:1]
+		args = append(args, "rmi")
+		args = append(args, "--image", "test-infra*")
+		args = append(args, "--owner", "owner")
+
+		err := app.Run(args)
+		if err != nil {
+			t.Errorf("got: %v\nwant: %v", err, nil)
+		}
+	})
+
+	t.Run("remove images in other region", func(t *testing.T) {
+		//setup args
+		args := os.Args[0:1]
+		args = append(args, "--region", "us-gov-west-1", "--profile", "prod")
+		args = append(args, "rmi")
+		args = append(args, "--image", "test-infra*")
+		args = append(args, "--owner", "owner")
+
+		err := app.Run(args)
+		if err != nil {
+			t.Errorf("got: %v\nwant: %v", err, nil)
+		}
+	})
+
+	t.Run("remove images with config file", func(t *testing.T) {
+		path := filepath.Join(awsHome, "ami-replacer.yaml")
+		content := "defaults:\n  owner: owner\ntargets:\n  - name: infra\n    image: test-infra*\n  - name: app\n    image: test-app*\n    region: eu-west-1\n"
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		//setup args
+		args := os.Args[0:1]
+		args = append(args, "--config", path)
 		args = append(args, "rmi")
+		args = append(args, "--gen", "1")
+
+		err := app.Run(args)
+		if err != nil {
+			t.Errorf("got: %v\nwant: %v", err, nil)
+		}
+	})
+
+	t.Run("replace asgs selected by tag", func(t *testing.T) {
+		//setup args
+		args := os.Args[0:1]
+		args = append(args, "--concurrency", "2")
+		args = append(args, "rpl")
+		args = append(args, "--image", "test-infra*")
+		args = append(args, "--owner", "owner")
+		args = append(args, "--asg-tag", "ami-replacer/managed=true")
+
+		err := app.Run(args)
+		if err != nil {
+			t.Errorf("got: %v\nwant: %v", err, nil)
+		}
+	})
+
+	t.Run("plan", func(t *testing.T) {
+		//setup args
+		args := os.Args[0:1]
+		args = append(args, "plan", "--output", "json")
 		args = append(args, "--image", "test-infra*")
 		args = append(args, "--owner", "owner")
 		args = append(args, "--asgname", "myasg")
+		args = append(args, "rmi", "rpl")
+
+		err := app.Run(args)
+		if err != nil {
+			t.Errorf("got: %v\nwant: %v", err, nil)
+		}
+	})
+
+	t.Run("report as csv", func(t *testing.T) {
+		//setup args
+		args := os.Args[0:1]
+		args = append(args, "report", "--output", "csv")
+		args = append(args, "--image", "testimage*")
+		args = append(args, "--owner", "filtered")
+		args = append(args, "--price", "standard=0.06")
+		args = append(args, "--group-tag", "Team")
+
+		err := app.Run(args)
+		if err != nil {
+			t.Errorf("got: %v\nwant: %v", err, nil)
+		}
+	})
+
+	t.Run("report as yaml", func(t *testing.T) {
+		//setup args
+		args := os.Args[0:1]
+		args = append(args, "report", "--output", "yaml")
+		args = append(args, "--image", "testimage*")
+		args = append(args, "--owner", "filtered")
 
 		err := app.Run(args)
 		if err != nil {
@@ -31,8 +141,107 @@ func TestMain(t *testing.T) {
 		}
 	})
 
+	t.Run("csv output of rms", func(t *testing.T) {
+		//setup args
+		args := os.Args[0:1]
+		args = append(args, "rms", "--output", "csv")
+
+		err := app.Run(args)
+		if err == nil {
+			t.Errorf("should raise error: %v", err)
+		}
+	})
+
+	t.Run("remove images with yaml output", func(t *testing.T) {
+		//setup args
+		args := os.Args[0:1]
+		args = append(args, "rmi", "--output", "yaml")
+		args = append(args, "--image", "test-infra*")
+		args = append(args, "--owner", "owner")
+
+		err := app.Run(args)
+		if err != nil {
+			t.Errorf("got: %v\nwant: %v", err, nil)
+		}
+	})
+
+	t.Run("unknown output format", func(t *testing.T) {
+		//setup args
+		args := os.Args[0:1]
+		args = append(args, "rms", "--output", "xml")
+
+		err := app.Run(args)
+		if err == nil {
+			t.Errorf("should raise error: %v", err)
+		}
+	})
+
+	t.Run("invalid region", func(t *testing.T) {
+		//setup args
+		args := os.Args[0:1]
+		args = append(args, "--region", "moon-1")
+		args = append(args, "rmi")
+		args = append(args, "--image", "test-infra*")
+
+		err := app.Run(args)
+		if err == nil {
+			t.Errorf("should raise error: %v", err)
+		}
+	})
+
+	t.Run("unknown profile", func(t *testing.T) {
+		//setup args
+		args := os.Args[0:1]
+		args = append(args, "--profile", "unknown")
+		args = append(args, "rms")
+
+		err := app.Run(args)
+		if err == nil {
+			t.Errorf("should raise error: %v", err)
+		}
+	})
+
+	t.Run("zero workers", func(t *testing.T) {
+		//setup args
+		args := os.Args[0:1]
+		args = append(args, "rms")
+		args = append(args, "--workers", "0")
+
+		err := app.Run(args)
+		if err == nil || !strings.Contains(err.Error(), "--workers") {
+			t.Errorf("should raise error: %v", err)
+		}
+	})
+
+	t.Run("zero generations", func(t *testing.T) {
+		//setup args
+		args := os.Args[0:1]
+		args = append(args, "rmi")
+		args = append(args, "--image", "test-infra*", "--owner", "owner")
+		args = append(args, "-g", "0")
+
+		err := app.Run(args)
+		if err == nil || !strings.Contains(err.Error(), "gen") {
+			t.Errorf("should raise error: %v", err)
+		}
+	})
+
+	t.Run("zero batch size", func(t *testing.T) {
+		//setup args
+		args := os.Args[0:1]
+		args = append(args, "rpl")
+		args = append(args, "--asgname", "ok", "--clustername", "test-cluster")
+		args = append(args, "--batch-size", "0")
+
+		err := app.Run(args)
+		if err == nil || !strings.Contains(err.Error(), "--batch-size") {
+			t.Errorf("should raise error: %v", err)
+		}
+	})
+
 	t.Run("replace", func(t *testing.T) {
 		//setup args
+		args := os.Args[0:1]
 		args = append(args, "replace")
 		args = append(args, "--image", "test-infra*")
 		args = append(args, "--owner", "owner")
@@ -43,4 +252,50 @@ func TestMain(t *testing.T) {
 			t.Errorf("got: %v\nwant: %v", err, nil)
 		}
 	})
+
+	t.Run("rollback", func(t *testing.T) {
+		run := `{"id":"20190401T123000-ok","region":"ap-northeast-1","profile":"admin","clustername":"during-deploy",` +
+			`"asg":{"name":"ok","desired_capacity":2,"min_size":2,"instances":["i-00000000000000000"]},` +
+			`"progress":[{"instance_id":"instance2","instance_arn":"arn2","step":"draining"}]}`
+		if err := os.MkdirAll(stateDir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(stateDir, "20190401T123000-ok.json"), []byte(run), 0600); err != nil {
+			t.Fatal(err)
+		}
+		args := os.Args[0:1]
+		args = append(args, "rollback", "20190401T123000-ok")
+
+		err := app.Run(args)
+		if err != nil {
+			t.Errorf("got: %v\nwant: %v", err, nil)
+		}
+		rolledBack, err := actions.LoadRun(stateDir, "20190401T123000-ok")
+		if err != nil || !rolledBack.RolledBack {
+			t.Errorf("got: %v %v\nwant: rolled back run", rolledBack, err)
+		}
+	})
+
+	t.Run("resume of rolled back run", func(t *testing.T) {
+		args := os.Args[0:1]
+		args = append(args, "rpl", "--resume")
+		args = append(args, "--image", "test-infra*")
+		args = append(args, "--owner", "owner")
+		args = append(args, "--asgname", "ok")
+
+		err := app.Run(args)
+		if err == nil {
+			t.Errorf("should raise error: %v", err)
+		}
+	})
+
+	t.Run("rollback of unknown run", func(t *testing.T) {
+		args := os.Args[0:1]
+		args = append(args, "rollback", "unknown")
+
+		err := app.Run(args)
+		if err == nil {
+			t.Errorf("should raise error: %v", err)
+		}
+	})
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+
+	"golang.org/x/xerrors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+type tabler interface {
+	WriteTable(w io.Writer) error
+}
+
+// csvWriter is a document that can be rendered as csv as well.
+type csvWriter interface {
+	WriteCSV(w io.Writer) error
+}
+
+// csvCommands are the commands whose documents can be rendered as csv.
+var csvCommands = map[string]bool{"report": true}
+
+func isValidFormat(format string, command string) bool {
+	switch format {
+	case "table", "json", "yaml":
+		return true
+	case "csv":
+		return csvCommands[command]
+	}
+	return false
+}
+
+// writeDocument renders v as a human readable table, json, yaml or csv.
+func writeDocument(w io.Writer, format string, v tabler) error {
+	switch format {
+	case "table":
+		return v.WriteTable(w)
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case "yaml":
+		out, err := yaml.Marshal(v)
+		if err != nil {
+			return xerrors.Errorf("Failed to marshal yaml: %w", err)
+		}
+		_, err = w.Write(out)
+		return err
+	case "csv":
+		if cw, ok := v.(csvWriter); ok {
+			return cw.WriteCSV(w)
+		}
+	}
+	return xerrors.Errorf("Unknown output format: %s", format)
+}